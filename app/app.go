@@ -2,6 +2,7 @@ package app
 
 import (
 	"context"
+	"time"
 
 	_http "github.com/g-graziano/user-auth-golang/delivery/http"
 	"github.com/joho/godotenv"
@@ -17,6 +18,9 @@ func Run() {
 	ctx := context.Background()
 
 	dep := buildDependency()
+	dep.Keys.StartRotation(ctx, time.Minute)
 
-	_http.Router(ctx, dep.User, dep.Token)
+	go dep.Outbox.Run(ctx)
+
+	_http.Router(dep.Config, dep.User, dep.Token, dep.OAuth, dep.Keys, dep.Outbox, dep.Storage)
 }
@@ -1,35 +1,139 @@
 package app
 
 import (
-	"fmt"
 	"os"
 
+	"github.com/g-graziano/user-auth-golang/config"
+	"github.com/g-graziano/user-auth-golang/emails"
+	"github.com/g-graziano/user-auth-golang/keyset"
+	"github.com/g-graziano/user-auth-golang/password"
+	"github.com/g-graziano/user-auth-golang/repository/mailer"
 	"github.com/g-graziano/user-auth-golang/repository/postgres"
 	"github.com/g-graziano/user-auth-golang/repository/redis"
+	"github.com/g-graziano/user-auth-golang/repository/storage"
+	"github.com/g-graziano/user-auth-golang/service/attempt"
+	"github.com/g-graziano/user-auth-golang/service/oauth"
+	"github.com/g-graziano/user-auth-golang/service/outbox"
 	"github.com/g-graziano/user-auth-golang/service/token"
 	"github.com/g-graziano/user-auth-golang/service/user"
 )
 
 type Dependency struct {
-	User  user.User
-	Token token.Token
+	Config  *config.Config
+	User    user.User
+	Token   token.Token
+	OAuth   oauth.OAuth
+	Keys    keyset.KeySet
+	Outbox  outbox.Outbox
+	Storage storage.Storage
 	// Point        point.Point
 	// PointHistory pointHistory.PointHistory
 }
 
 func buildDependency() Dependency {
 	var dep Dependency
-	dbHost := os.Getenv("DATABASE_HOST")
-	dbPort := os.Getenv("DATABASE_PORT")
-	dbUser := os.Getenv("DATABASE_USER")
-	dbPass := os.Getenv("DATABASE_PASS")
-	dbName := os.Getenv("DATABASE_NAME")
-
-	connStr := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable", dbUser, dbPass, dbHost, dbPort, dbName)
-	pg := postgres.New(connStr)
-	rd := redis.New()
-
-	dep.User = user.New(pg, rd)
-	dep.Token = token.New(pg, rd)
+
+	cfg, err := config.Load(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		panic(err)
+	}
+
+	dep.Config = cfg
+
+	if cfg.Database.AutoMigrate {
+		if err := migrateUp(cfg); err != nil {
+			panic(err)
+		}
+	}
+
+	var pg postgres.Postgres
+	if cfg.Database.Driver == "sqlite" {
+		pg = postgres.NewSQLite(cfg.Database.Path)
+	} else {
+		pg = postgres.New(append([]string{cfg.Database.DSN()}, cfg.Database.ReplicaDSNs()...)...)
+	}
+
+	var rd redis.Redis
+	if cfg.Redis.Driver == "memory" || cfg.Redis.Address == "" {
+		rd = redis.NewMemory()
+	} else {
+		rd = redis.New(cfg.Redis.Address, cfg.Redis.Password, cfg.Redis.DB)
+	}
+
+	ml, err := mailer.New(cfg.Mail)
+	if err != nil {
+		panic(err)
+	}
+
+	ml = mailer.WithRecorder(ml, pg, cfg.Mail.Driver)
+
+	st, err := storage.New(cfg.Storage, cfg.Server.PublicBaseURL)
+	if err != nil {
+		panic(err)
+	}
+
+	dep.Storage = st
+
+	er, err := emails.New(cfg.Mail.TemplateDir, cfg.Mail.FromName)
+	if err != nil {
+		panic(err)
+	}
+
+	keys, err := keyset.New(keyset.Options{
+		Algorithm:        cfg.JWT.SigningAlg,
+		Dir:              cfg.JWT.KeysDir,
+		RotationInterval: cfg.JWT.KeyRotation,
+		Retention:        cfg.JWT.KeyRetention,
+		LegacySecret:     cfg.JWT.LegacySecret,
+		LegacyCutoff:     cfg.JWT.LegacyCutoff,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	keyset.SetDefault(keys)
+	dep.Keys = keys
+
+	at := attempt.New(pg, rd, attempt.Options{
+		MaxAccountFailures: cfg.Attempt.MaxAccount,
+		MaxIPFailures:      cfg.Attempt.MaxIP,
+		MaxClientFailures:  cfg.Attempt.MaxClient,
+		Window:             cfg.Attempt.Window,
+		Lockout:            cfg.Attempt.Lockout,
+		MaxLockout:         cfg.Attempt.MaxLockout,
+	})
+
+	hasher, err := password.New(password.Options{
+		Algorithm:     cfg.Password.Hasher,
+		BcryptCost:    cfg.Password.BcryptCost,
+		Argon2Time:    uint32(cfg.Password.Argon2Time),
+		Argon2Memory:  uint32(cfg.Password.Argon2Memory),
+		Argon2Threads: uint8(cfg.Password.Argon2Threads),
+		ScryptLogN:    uint8(cfg.Password.ScryptLogN),
+		ScryptR:       cfg.Password.ScryptR,
+		ScryptP:       cfg.Password.ScryptP,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	policy, err := password.NewPolicy(password.PolicyOptions{
+		MinLength:     cfg.Password.MinLength,
+		MaxLength:     cfg.Password.MaxLength,
+		RequireUpper:  cfg.Password.RequireUpper,
+		RequireLower:  cfg.Password.RequireLower,
+		RequireDigit:  cfg.Password.RequireDigit,
+		RequireSymbol: cfg.Password.RequireSymbol,
+		HistorySize:   cfg.Password.History,
+		BreachedFile:  cfg.Password.BreachedFile,
+	}, hasher)
+	if err != nil {
+		panic(err)
+	}
+
+	dep.User = user.New(pg, rd, st, er, at, hasher, policy, cfg)
+	dep.Token = token.New(pg, rd, at, cfg)
+	dep.OAuth = oauth.New(pg, rd, st, cfg)
+	dep.Outbox = outbox.New(pg, ml, cfg.Outbox)
 	return dep
 }
@@ -0,0 +1,126 @@
+package app
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/g-graziano/user-auth-golang/config"
+	"github.com/g-graziano/user-auth-golang/migrate"
+	"github.com/g-graziano/user-auth-golang/repository/postgres"
+)
+
+const migrateUsage = `usage: %s migrate up|down [steps]|status
+
+  up            apply every pending migration
+  down [steps]  revert the last steps migrations, 1 by default
+  status        list migrations and when they were applied
+`
+
+// Migrate runs the migrate command with its arguments and returns the exit code
+func Migrate(args []string) int {
+	cfg, err := config.Load(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if len(args) < 1 {
+		fmt.Fprintf(os.Stderr, migrateUsage, os.Args[0])
+		return 2
+	}
+
+	migrator, db, err := newMigrator(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	defer db.Close()
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up()
+		for _, migration := range applied {
+			fmt.Printf("applied %04d_%s\n", migration.Version, migration.Name)
+		}
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		if len(applied) == 0 {
+			fmt.Println("database is up to date")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				fmt.Fprintf(os.Stderr, migrateUsage, os.Args[0])
+				return 2
+			}
+		}
+
+		reverted, err := migrator.Down(steps)
+		for _, migration := range reverted {
+			fmt.Printf("reverted %04d_%s\n", migration.Version, migration.Name)
+		}
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(out, "VERSION\tNAME\tAPPLIED AT")
+
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if !status.AppliedAt.IsZero() {
+				appliedAt = status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+
+			fmt.Fprintf(out, "%04d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+
+		out.Flush()
+	default:
+		fmt.Fprintf(os.Stderr, migrateUsage, os.Args[0])
+		return 2
+	}
+
+	return 0
+}
+
+func migrateUp(cfg *config.Config) error {
+	migrator, db, err := newMigrator(cfg)
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	applied, err := migrator.Up()
+	for _, migration := range applied {
+		fmt.Printf("Applied migration %04d_%s\n", migration.Version, migration.Name)
+	}
+
+	return err
+}
+
+func newMigrator(cfg *config.Config) (migrate.Migrator, *sql.DB, error) {
+	if cfg.Database.Driver == "sqlite" {
+		return postgres.NewSQLiteMigrator(cfg.Database.Path)
+	}
+
+	return postgres.NewMigrator(cfg.Database.DSN())
+}
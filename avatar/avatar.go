@@ -0,0 +1,161 @@
+// Package avatar turns an uploaded profile picture into the square JPEG
+// thumbnails the service stores. Re-encoding drops EXIF and any other
+// metadata the upload carried.
+package avatar
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+// Sizes are the edges, in pixels, of the thumbnails generated for a picture
+var Sizes = []int{64, 128, Large}
+
+// Large is the size used where a single picture URL is expected
+const Large = 512
+
+// ContentTypes are the accepted upload types
+var ContentTypes = map[string]func([]byte) (image.Image, error){
+	"image/jpeg": decodeWith(jpeg.Decode),
+	"image/png":  decodeWith(png.Decode),
+	"image/gif":  decodeWith(gif.Decode),
+	"image/webp": decodeWith(webp.Decode),
+}
+
+const (
+	// ContentType of every generated thumbnail
+	ContentType = "image/jpeg"
+
+	// maxPixels guards against small files that decode to huge images
+	maxPixels = 40 * 1000 * 1000
+	minEdge   = 32
+	quality   = 90
+)
+
+var (
+	ErrUnsupported = errors.New("picture must be a jpeg, png, gif or webp image")
+	ErrTooLarge    = fmt.Errorf("picture must be at most %d megapixels", maxPixels/1000/1000)
+	ErrTooSmall    = fmt.Errorf("picture must be at least %dx%d pixels", minEdge, minEdge)
+)
+
+type Thumbnail struct {
+	Size    int
+	Content []byte
+}
+
+// Process decodes content, rotates it upright, crops the center square and
+// encodes it at every size in Sizes
+func Process(contentType string, content []byte) ([]*Thumbnail, error) {
+	decode, ok := ContentTypes[contentType]
+	if !ok {
+		return nil, ErrUnsupported
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+
+	if config.Width*config.Height > maxPixels {
+		return nil, ErrTooLarge
+	}
+
+	if config.Width < minEdge || config.Height < minEdge {
+		return nil, ErrTooSmall
+	}
+
+	img, err := decode(content)
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+
+	if contentType == "image/jpeg" {
+		img = orient(img, jpegOrientation(content))
+	}
+
+	square := cropSquare(img)
+
+	var thumbnails []*Thumbnail
+	for _, size := range Sizes {
+		dst := image.NewRGBA(image.Rect(0, 0, size, size))
+
+		// transparent pixels end up white rather than black in the JPEG
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		xdraw.CatmullRom.Scale(dst, dst.Bounds(), square, square.Bounds(), draw.Over, nil)
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, err
+		}
+
+		thumbnails = append(thumbnails, &Thumbnail{Size: size, Content: buf.Bytes()})
+	}
+
+	return thumbnails, nil
+}
+
+// Key is the storage key of the size thumbnail of a picture stored under
+// prefix. Pictures stored before thumbnails existed are a single object, or a
+// URL, and are returned as is for every size.
+func Key(prefix string, size int) string {
+	if single(prefix) {
+		return prefix
+	}
+
+	return prefix + "/" + strconv.Itoa(size) + ".jpg"
+}
+
+// Keys lists every object stored for the picture under prefix
+func Keys(prefix string) []string {
+	if single(prefix) {
+		return []string{prefix}
+	}
+
+	var keys []string
+	for _, size := range Sizes {
+		keys = append(keys, Key(prefix, size))
+	}
+
+	return keys
+}
+
+func single(prefix string) bool {
+	return path.Ext(prefix) != "" || strings.Contains(prefix, "://")
+}
+
+func decodeWith(decode func(r io.Reader) (image.Image, error)) func([]byte) (image.Image, error) {
+	return func(content []byte) (image.Image, error) {
+		return decode(bytes.NewReader(content))
+	}
+}
+
+func cropSquare(img image.Image) image.Image {
+	b := img.Bounds()
+
+	edge := b.Dx()
+	if b.Dy() < edge {
+		edge = b.Dy()
+	}
+
+	x := b.Min.X + (b.Dx()-edge)/2
+	y := b.Min.Y + (b.Dy()-edge)/2
+
+	dst := image.NewRGBA(image.Rect(0, 0, edge, edge))
+	draw.Draw(dst, dst.Bounds(), img, image.Point{X: x, Y: y}, draw.Src)
+
+	return dst
+}
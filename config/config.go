@@ -0,0 +1,523 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/g-graziano/user-auth-golang/helper"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the whole service configuration. Values come from the defaults
+// below, then the YAML file named by CONFIG_FILE, then the environment
+// variables in the env tags, each overriding the previous one.
+type Config struct {
+	Server   Server   `yaml:"server"`
+	Database Database `yaml:"database"`
+	Redis    Redis    `yaml:"redis"`
+	Mail     Mail     `yaml:"mail"`
+	Storage  Storage  `yaml:"storage"`
+	JWT      JWT      `yaml:"jwt"`
+	Token    Token    `yaml:"token"`
+	TFA      TFA      `yaml:"tfa"`
+	Password Password `yaml:"password"`
+	Attempt  Attempt  `yaml:"attempt"`
+	Outbox   Outbox   `yaml:"outbox"`
+	Admin    Admin    `yaml:"admin"`
+}
+
+type Server struct {
+	Address       string   `yaml:"address" env:"SERVER_ADDRESS"`
+	PublicBaseURL string   `yaml:"public_base_url" env:"PUBLIC_BASE_URL"`
+	CORSOrigins   []string `yaml:"cors_origins" env:"CORS_ORIGINS"`
+	// TrustedProxies are the CIDRs of the proxies in front of the server, only
+	// their X-Forwarded-For is believed
+	TrustedProxies []string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+	// LoginURL is the first party page that signs users in and asks for their
+	// consent to an OAuth client, it gets the authorize URL to return to
+	LoginURL string `yaml:"login_url" env:"LOGIN_URL"`
+}
+
+type Database struct {
+	// Driver is postgres or sqlite
+	Driver string `yaml:"driver" env:"DATABASE_DRIVER"`
+	// Path is the database file of the sqlite driver
+	Path string `yaml:"path" env:"DATABASE_PATH"`
+
+	Host     string `yaml:"host" env:"DATABASE_HOST"`
+	Port     int    `yaml:"port" env:"DATABASE_PORT"`
+	User     string `yaml:"user" env:"DATABASE_USER"`
+	Password string `yaml:"password" env:"DATABASE_PASS"`
+	Name     string `yaml:"name" env:"DATABASE_NAME"`
+	SSLMode  string `yaml:"ssl_mode" env:"DATABASE_SSL_MODE"`
+	// AutoMigrate applies pending migrations on startup, turn it off to run
+	// them with the migrate command instead
+	AutoMigrate bool `yaml:"auto_migrate" env:"DATABASE_AUTO_MIGRATE"`
+	// Replicas are the host:port of read replicas, reached with the same
+	// credentials and database name as the primary
+	Replicas []string `yaml:"replicas" env:"DATABASE_REPLICAS"`
+}
+
+type Redis struct {
+	// Driver is redis, or memory to keep keys in process memory for a single
+	// node. Without an address the sqlite database driver also keeps them there.
+	Driver   string `yaml:"driver" env:"REDIS_DRIVER"`
+	Address  string `yaml:"address" env:"REDIS_ADDRESS"`
+	Password string `yaml:"password" env:"REDIS_PASSWORD"`
+	DB       int    `yaml:"db" env:"REDIS_DB"`
+}
+
+type Mail struct {
+	// Driver is one of sendgrid, smtp or file
+	Driver      string `yaml:"driver" env:"MAIL_DRIVER"`
+	FromName    string `yaml:"from_name" env:"MAIL_FROM_NAME"`
+	FromAddress string `yaml:"from_address" env:"MAIL_FROM_ADDRESS"`
+
+	SendGridAPIKey string `yaml:"sendgrid_api_key" env:"SENDGRID_API_KEY"`
+
+	SMTPHost     string `yaml:"smtp_host" env:"SMTP_HOST"`
+	SMTPPort     int    `yaml:"smtp_port" env:"SMTP_PORT"`
+	SMTPUsername string `yaml:"smtp_username" env:"SMTP_USERNAME"`
+	SMTPPassword string `yaml:"smtp_password" env:"SMTP_PASSWORD"`
+
+	// FilePath is the mbox file the file driver appends to
+	FilePath string `yaml:"file_path" env:"MAIL_FILE_PATH"`
+
+	// TemplateDir replaces the built in email templates, see package emails
+	TemplateDir string `yaml:"template_dir" env:"MAIL_TEMPLATE_DIR"`
+
+	// a user can request ResendLimit emails per ResendWindow, at least
+	// ResendInterval apart
+	ResendInterval time.Duration `yaml:"resend_interval" env:"MAIL_RESEND_INTERVAL"`
+	ResendLimit    int           `yaml:"resend_limit" env:"MAIL_RESEND_LIMIT"`
+	ResendWindow   time.Duration `yaml:"resend_window" env:"MAIL_RESEND_WINDOW"`
+}
+
+type Storage struct {
+	// Driver is local or s3
+	Driver string `yaml:"driver" env:"STORAGE_DRIVER"`
+
+	// LocalDir is where the local driver keeps files, served on /media
+	LocalDir string `yaml:"local_dir" env:"STORAGE_LOCAL_DIR"`
+
+	S3Endpoint  string `yaml:"s3_endpoint" env:"S3_ENDPOINT"`
+	S3Region    string `yaml:"s3_region" env:"S3_REGION"`
+	S3Bucket    string `yaml:"s3_bucket" env:"S3_BUCKET"`
+	S3AccessKey string `yaml:"s3_access_key" env:"S3_ACCESS_KEY"`
+	S3SecretKey string `yaml:"s3_secret_key" env:"S3_SECRET_KEY"`
+	// S3PathStyle puts the bucket in the path instead of the host name, as
+	// MinIO and most self hosted services expect
+	S3PathStyle bool `yaml:"s3_path_style" env:"S3_PATH_STYLE"`
+	// S3PublicURL serves objects from a CDN or custom domain instead of the
+	// bucket URL
+	S3PublicURL string `yaml:"s3_public_url" env:"S3_PUBLIC_URL"`
+
+	// PictureMaxSize is the largest profile picture upload, in bytes
+	PictureMaxSize int `yaml:"picture_max_size" env:"PICTURE_MAX_SIZE"`
+}
+
+type JWT struct {
+	SigningAlg   string        `yaml:"signing_alg" env:"JWT_SIGNING_ALG"`
+	KeysDir      string        `yaml:"keys_dir" env:"JWT_KEYS_DIR"`
+	KeyRotation  time.Duration `yaml:"key_rotation" env:"JWT_KEY_ROTATION"`
+	KeyRetention time.Duration `yaml:"key_retention" env:"JWT_KEY_RETENTION"`
+	// LegacySecret verifies HS256 tokens issued before asymmetric signing
+	LegacySecret string `yaml:"legacy_secret" env:"JWT_SIGNATURE_KEY"`
+	// LegacyCutoff is when asymmetric signing was enabled, only tokens issued
+	// before it are verified with LegacySecret
+	LegacyCutoff time.Time `yaml:"legacy_cutoff" env:"JWT_LEGACY_CUTOFF"`
+}
+
+// Token holds the lifetime of every token the service issues
+type Token struct {
+	Access        time.Duration `yaml:"access" env:"TOKEN_ACCESS_TTL"`
+	Refresh       time.Duration `yaml:"refresh" env:"TOKEN_REFRESH_TTL"`
+	TFA           time.Duration `yaml:"tfa" env:"TOKEN_TFA_TTL"`
+	TFAEnroll     time.Duration `yaml:"tfa_enroll" env:"TOKEN_TFA_ENROLL_TTL"`
+	VerifyEmail   time.Duration `yaml:"verify_email" env:"TOKEN_VERIFY_EMAIL_TTL"`
+	ResetPassword time.Duration `yaml:"reset_password" env:"TOKEN_RESET_PASSWORD_TTL"`
+	ChangeEmail   time.Duration `yaml:"change_email" env:"TOKEN_CHANGE_EMAIL_TTL"`
+	RevertEmail   time.Duration `yaml:"revert_email" env:"TOKEN_REVERT_EMAIL_TTL"`
+	OAuthCode     time.Duration `yaml:"oauth_code" env:"TOKEN_OAUTH_CODE_TTL"`
+	OAuthAccess   time.Duration `yaml:"oauth_access" env:"TOKEN_OAUTH_ACCESS_TTL"`
+	// OAuthConsent is how long an approved client is authorized again without asking
+	OAuthConsent time.Duration `yaml:"oauth_consent" env:"TOKEN_OAUTH_CONSENT_TTL"`
+}
+
+type TFA struct {
+	SecretKey       string `yaml:"secret_key" env:"TFA_SECRET_KEY"`
+	TOTPSkew        int    `yaml:"totp_skew" env:"TOTP_SKEW"`
+	BackupCodeCount int    `yaml:"backup_code_count" env:"BACKUP_CODE_COUNT"`
+}
+
+type Password struct {
+	Hasher        string `yaml:"hasher" env:"PASSWORD_HASHER"`
+	BcryptCost    int    `yaml:"bcrypt_cost" env:"BCRYPT_COST"`
+	Argon2Time    int    `yaml:"argon2_time" env:"ARGON2_TIME"`
+	Argon2Memory  int    `yaml:"argon2_memory" env:"ARGON2_MEMORY"`
+	Argon2Threads int    `yaml:"argon2_threads" env:"ARGON2_THREADS"`
+	ScryptLogN    int    `yaml:"scrypt_log_n" env:"SCRYPT_LOG_N"`
+	ScryptR       int    `yaml:"scrypt_r" env:"SCRYPT_R"`
+	ScryptP       int    `yaml:"scrypt_p" env:"SCRYPT_P"`
+
+	MinLength     int    `yaml:"min_length" env:"PASSWORD_MIN_LENGTH"`
+	MaxLength     int    `yaml:"max_length" env:"PASSWORD_MAX_LENGTH"`
+	RequireUpper  bool   `yaml:"require_upper" env:"PASSWORD_REQUIRE_UPPER"`
+	RequireLower  bool   `yaml:"require_lower" env:"PASSWORD_REQUIRE_LOWER"`
+	RequireDigit  bool   `yaml:"require_digit" env:"PASSWORD_REQUIRE_DIGIT"`
+	RequireSymbol bool   `yaml:"require_symbol" env:"PASSWORD_REQUIRE_SYMBOL"`
+	History       int    `yaml:"history" env:"PASSWORD_HISTORY"`
+	BreachedFile  string `yaml:"breached_file" env:"PASSWORD_BREACHED_FILE"`
+}
+
+type Attempt struct {
+	MaxAccount int           `yaml:"max_account" env:"ATTEMPT_MAX_ACCOUNT"`
+	MaxIP      int           `yaml:"max_ip" env:"ATTEMPT_MAX_IP"`
+	MaxClient  int           `yaml:"max_client" env:"ATTEMPT_MAX_CLIENT"`
+	Window     time.Duration `yaml:"window" env:"ATTEMPT_WINDOW"`
+	Lockout    time.Duration `yaml:"lockout" env:"ATTEMPT_LOCKOUT"`
+	MaxLockout time.Duration `yaml:"max_lockout" env:"ATTEMPT_MAX_LOCKOUT"`
+}
+
+// Outbox tunes the worker delivering queued emails. A failed email is retried
+// after RetryBase, doubling up to RetryMax, and is dead after MaxAttempts.
+type Outbox struct {
+	PollInterval time.Duration `yaml:"poll_interval" env:"OUTBOX_POLL_INTERVAL"`
+	BatchSize    int           `yaml:"batch_size" env:"OUTBOX_BATCH_SIZE"`
+	MaxAttempts  int           `yaml:"max_attempts" env:"OUTBOX_MAX_ATTEMPTS"`
+	RetryBase    time.Duration `yaml:"retry_base" env:"OUTBOX_RETRY_BASE"`
+	RetryMax     time.Duration `yaml:"retry_max" env:"OUTBOX_RETRY_MAX"`
+	// Lease is how long a claimed email is hidden from other workers
+	Lease time.Duration `yaml:"lease" env:"OUTBOX_LEASE"`
+}
+
+type Admin struct {
+	// Token is the bearer token of the /admin routes, empty disables them
+	Token string `yaml:"token" env:"ADMIN_TOKEN"`
+}
+
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Address:       ":8080",
+			PublicBaseURL: "http://localhost:8080",
+			CORSOrigins:   []string{"*"},
+		},
+		Database: Database{
+			Driver:  "postgres",
+			Path:    "user-auth.db",
+			Host:    "localhost",
+			Port:    5432,
+			SSLMode: "disable",
+
+			AutoMigrate: true,
+		},
+		Redis: Redis{
+			Driver:  "redis",
+			Address: "localhost:6379",
+		},
+		Mail: Mail{
+			Driver:      "sendgrid",
+			SMTPPort:    587,
+			FilePath:    "outbox.mbox",
+			FromName:    "User Land",
+			FromAddress: "verifier@userland.com",
+
+			ResendInterval: time.Minute,
+			ResendLimit:    5,
+			ResendWindow:   time.Hour * 24,
+		},
+		Storage: Storage{
+			Driver:   "local",
+			LocalDir: "media",
+			S3Region: "us-east-1",
+
+			PictureMaxSize: 5 << 20,
+		},
+		JWT: JWT{
+			SigningAlg:   "RS256",
+			KeyRetention: time.Hour * 8760,
+		},
+		Token: Token{
+			Access:        time.Hour * 24,
+			Refresh:       time.Hour * 8760,
+			TFA:           time.Minute * 5,
+			TFAEnroll:     time.Minute * 60,
+			VerifyEmail:   time.Hour * 24,
+			ResetPassword: time.Minute * 5,
+			ChangeEmail:   time.Minute * 10,
+			RevertEmail:   time.Hour * 168,
+			OAuthCode:     time.Minute * 10,
+			OAuthAccess:   time.Hour,
+			OAuthConsent:  time.Hour * 720,
+		},
+		TFA: TFA{
+			TOTPSkew:        1,
+			BackupCodeCount: 10,
+		},
+		Password: Password{
+			Hasher:        "bcrypt",
+			MinLength:     8,
+			MaxLength:     128,
+			History:       5,
+			BcryptCost:    10,
+			ScryptLogN:    15,
+			ScryptR:       8,
+			ScryptP:       1,
+			Argon2Time:    3,
+			Argon2Memory:  64 * 1024,
+			Argon2Threads: 2,
+		},
+		Attempt: Attempt{
+			MaxAccount: 5,
+			MaxIP:      20,
+			MaxClient:  200,
+			Window:     time.Minute * 15,
+			Lockout:    time.Minute,
+			MaxLockout: time.Hour,
+		},
+		Outbox: Outbox{
+			PollInterval: time.Second * 5,
+			BatchSize:    20,
+			MaxAttempts:  8,
+			RetryBase:    time.Minute,
+			RetryMax:     time.Hour * 6,
+			Lease:        time.Minute * 5,
+		},
+	}
+}
+
+// Load reads the configuration from path, if not empty, and the environment
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+			return nil, fmt.Errorf("config %s: %v", path, err)
+		}
+	}
+
+	if err := loadEnv(reflect.ValueOf(cfg).Elem()); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) Validate() error {
+	var problems []string
+
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Server.Address != "", "server.address is required")
+	base, err := url.Parse(c.Server.PublicBaseURL)
+	check(err == nil && base.Scheme != "" && base.Host != "", "server.public_base_url must be an absolute URL")
+	if c.Server.LoginURL != "" {
+		login, err := url.Parse(c.Server.LoginURL)
+		check(err == nil && login.Scheme != "" && login.Host != "", "server.login_url must be an absolute URL")
+	}
+	_, err = helper.ParseTrustedProxies(c.Server.TrustedProxies)
+	check(err == nil, "server.trusted_proxies must be CIDRs or addresses")
+
+	switch c.Database.Driver {
+	case "postgres":
+		check(c.Database.Host != "", "database.host is required")
+		check(c.Database.Name != "", "database.name is required")
+		check(c.Database.Port > 0 && c.Database.Port < 65536, "database.port must be a valid port")
+	case "sqlite":
+		check(c.Database.Path != "", "database.path is required by the sqlite driver")
+		check(len(c.Database.Replicas) == 0, "database.replicas are not supported by the sqlite driver")
+	default:
+		check(false, "database.driver must be postgres or sqlite")
+	}
+
+	switch c.Redis.Driver {
+	case "redis":
+		// lockouts, OAuth codes and TFA state must be shared between nodes
+		check(c.Redis.Address != "" || c.Database.Driver == "sqlite", "redis.address is required unless redis.driver is memory or database.driver is sqlite")
+	case "memory":
+	default:
+		check(false, "redis.driver must be redis or memory")
+	}
+
+	check(c.Mail.FromAddress != "", "mail.from_address is required")
+	switch c.Mail.Driver {
+	case "sendgrid":
+		check(c.Mail.SendGridAPIKey != "", "mail.sendgrid_api_key is required by the sendgrid driver")
+	case "smtp":
+		check(c.Mail.SMTPHost != "" && c.Mail.SMTPPort > 0, "mail.smtp_host and smtp_port are required by the smtp driver")
+	case "file":
+		check(c.Mail.FilePath != "", "mail.file_path is required by the file driver")
+	default:
+		check(false, "mail.driver must be sendgrid, smtp or file")
+	}
+	check(c.Mail.ResendLimit > 0 && c.Mail.ResendWindow > 0, "mail.resend_limit and resend_window must be positive")
+
+	switch c.Storage.Driver {
+	case "local":
+		check(c.Storage.LocalDir != "", "storage.local_dir is required by the local driver")
+	case "s3":
+		check(c.Storage.S3Endpoint != "" && c.Storage.S3Bucket != "" && c.Storage.S3Region != "", "storage.s3_endpoint, s3_bucket and s3_region are required by the s3 driver")
+		check(c.Storage.S3AccessKey != "" && c.Storage.S3SecretKey != "", "storage.s3_access_key and s3_secret_key are required by the s3 driver")
+	default:
+		check(false, "storage.driver must be local or s3")
+	}
+
+	check(c.Storage.PictureMaxSize > 0, "storage.picture_max_size must be positive")
+
+	if c.JWT.LegacySecret != "" {
+		check(!c.JWT.LegacyCutoff.IsZero(), "jwt.legacy_cutoff is required with jwt.legacy_secret")
+	}
+
+	check(c.TFA.SecretKey != "", "tfa.secret_key is required")
+	check(c.TFA.TOTPSkew >= 0, "tfa.totp_skew must not be negative")
+	check(c.TFA.BackupCodeCount > 0, "tfa.backup_code_count must be positive")
+
+	tokens := reflect.ValueOf(c.Token)
+	for i := 0; i < tokens.NumField(); i++ {
+		ttl := tokens.Field(i).Interface().(time.Duration)
+		check(ttl > 0, "token.%s must be positive", tokens.Type().Field(i).Tag.Get("yaml"))
+	}
+
+	check(c.Password.MinLength > 0 && c.Password.MaxLength >= c.Password.MinLength, "password.min_length and max_length must form a valid range")
+	check(c.Password.History >= 0, "password.history must not be negative")
+
+	check(c.Attempt.Window > 0, "attempt.window must be positive")
+	check(c.Attempt.MaxLockout >= c.Attempt.Lockout, "attempt.max_lockout must not be below attempt.lockout")
+
+	check(c.Outbox.PollInterval > 0 && c.Outbox.BatchSize > 0, "outbox.poll_interval and batch_size must be positive")
+	check(c.Outbox.MaxAttempts > 0, "outbox.max_attempts must be positive")
+	check(c.Outbox.RetryBase > 0 && c.Outbox.RetryMax >= c.Outbox.RetryBase, "outbox.retry_max must not be below outbox.retry_base")
+	check(c.Outbox.Lease > 0, "outbox.lease must be positive")
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// DSN is the lib/pq connection string of the database
+func (d Database) DSN() string {
+	return d.dsn(fmt.Sprintf("%s:%d", d.Host, d.Port))
+}
+
+// ReplicaDSNs are the lib/pq connection strings of the read replicas
+func (d Database) ReplicaDSNs() []string {
+	var dsns []string
+	for _, host := range d.Replicas {
+		dsns = append(dsns, d.dsn(host))
+	}
+
+	return dsns
+}
+
+func (d Database) dsn(host string) string {
+	u := url.URL{
+		Scheme:   "postgres",
+		Host:     host,
+		Path:     "/" + d.Name,
+		RawQuery: "sslmode=" + d.SSLMode,
+	}
+
+	if d.User != "" {
+		u.User = url.UserPassword(d.User, d.Password)
+	}
+
+	return u.String()
+}
+
+// loadEnv overrides every field tagged with env whose variable is set
+func loadEnv(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		tag := v.Type().Field(i).Tag.Get("env")
+
+		if _, isTime := field.Interface().(time.Time); field.Kind() == reflect.Struct && !isTime {
+			if err := loadEnv(field); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		value, ok := os.LookupEnv(tag)
+		if tag == "" || !ok || value == "" {
+			continue
+		}
+
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("environment variable %s: %v", tag, err)
+		}
+	}
+
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+	case int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+
+		field.SetInt(int64(n))
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+
+		field.SetBool(b)
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+
+		field.SetInt(int64(d))
+	case time.Time:
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return err
+		}
+
+		field.Set(reflect.ValueOf(t))
+	case []string:
+		var list []string
+		for _, each := range strings.Split(value, ",") {
+			if each = strings.TrimSpace(each); each != "" {
+				list = append(list, each)
+			}
+		}
+
+		field.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package http
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/g-graziano/user-auth-golang/helper"
+	"github.com/g-graziano/user-auth-golang/service/outbox"
+	"github.com/go-chi/chi"
+	json "github.com/json-iterator/go"
+)
+
+func HandleListOutbox(o outbox.Outbox) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		offset, _ := strconv.Atoi(query.Get("offset"))
+
+		list, err := o.List(r.Context(), query.Get("status"), limit, offset)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			log.Printf("error %q: %v", r.RequestURI, err.Error())
+			return
+		}
+
+		bs, err := json.ConfigFastest.Marshal(list)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			log.Printf("error %q: %v", r.RequestURI, err.Error())
+			return
+		}
+
+		w.Write(bs)
+
+		return
+	}
+}
+
+func HandleRetryOutbox(o outbox.Outbox) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+		if err == nil {
+			err = o.Retry(r.Context(), id)
+		}
+
+		if err == outbox.ErrNotDead {
+			w.WriteHeader(http.StatusNotFound)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			return
+		}
+
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			log.Printf("error %q: %v", r.RequestURI, err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		helper.Response(w, helper.Message(true, "Email queued again"))
+
+		return
+	}
+}
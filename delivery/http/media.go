@@ -0,0 +1,39 @@
+package http
+
+import (
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/g-graziano/user-auth-golang/helper"
+	"github.com/g-graziano/user-auth-golang/repository/storage"
+	"github.com/go-chi/chi"
+)
+
+// HandleGetMedia serves stored files. Keys are content addressed, so a key
+// always has the same content and can be cached forever.
+func HandleGetMedia(st storage.Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file, contentType, err := st.Get(chi.URLParam(r, "*"))
+		if err == storage.ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			return
+		}
+
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			log.Printf("error %q: %v", r.RequestURI, err.Error())
+			return
+		}
+
+		defer file.Close()
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+
+		io.Copy(w, file)
+	}
+}
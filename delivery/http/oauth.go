@@ -0,0 +1,359 @@
+package http
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/g-graziano/user-auth-golang/helper"
+	"github.com/g-graziano/user-auth-golang/middleware"
+	"github.com/g-graziano/user-auth-golang/models"
+	"github.com/g-graziano/user-auth-golang/service/oauth"
+	"github.com/g-graziano/user-auth-golang/service/user"
+	"github.com/go-chi/chi"
+	json "github.com/json-iterator/go"
+)
+
+func HandleRegisterOAuthClient(o oauth.OAuth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var newClient *models.OAuthClientRequest
+		if err := json.NewDecoder(r.Body).Decode(&newClient); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			log.Printf("error %q: %v", r.RequestURI, err.Error())
+			return
+		}
+
+		newClient.XID = helper.XID(r.Context())
+
+		client, err := o.RegisterClient(r.Context(), newClient)
+		if err != nil {
+			writeOAuthError(w, r, err)
+			return
+		}
+
+		bs, err := json.ConfigFastest.Marshal(client)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			log.Printf("error %q: %v", r.RequestURI, err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write(bs)
+	}
+}
+
+func HandleListOAuthClients(o oauth.OAuth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clients, err := o.ListClients(r.Context(), helper.XID(r.Context()))
+		if err != nil {
+			writeOAuthError(w, r, err)
+			return
+		}
+
+		bs, err := json.ConfigFastest.Marshal(clients)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			log.Printf("error %q: %v", r.RequestURI, err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(bs)
+	}
+}
+
+func HandleRevokeOAuthClient(o oauth.OAuth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := o.RevokeClient(r.Context(), helper.XID(r.Context()), chi.URLParam(r, "clientID"))
+		if err != nil {
+			writeOAuthError(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		helper.Response(w, helper.Message(true, "Client revoked!"))
+	}
+}
+
+func HandleGetOAuthConsent(o oauth.OAuth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		consent, err := o.GetConsent(r.Context(), authorizeRequestFromQuery(r))
+		if err != nil {
+			writeOAuthError(w, r, err)
+			return
+		}
+
+		bs, err := json.ConfigFastest.Marshal(consent)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			log.Printf("error %q: %v", r.RequestURI, err.Error())
+			return
+		}
+
+		w.Write(bs)
+	}
+}
+
+func HandleOAuthAuthorize(o oauth.OAuth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var authorize *models.AuthorizeRequest
+		if err := json.NewDecoder(r.Body).Decode(&authorize); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			log.Printf("error %q: %v", r.RequestURI, err.Error())
+			return
+		}
+
+		authorize.XID = helper.XID(r.Context())
+		authorize.AuthTime = helper.AuthTime(r.Context())
+
+		redirect, err := o.Authorize(r.Context(), authorize)
+		if err != nil {
+			writeOAuthError(w, r, err)
+			return
+		}
+
+		bs, err := json.ConfigFastest.Marshal(redirect)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			log.Printf("error %q: %v", r.RequestURI, err.Error())
+			return
+		}
+
+		w.Write(bs)
+	}
+}
+
+// HandleOAuthBrowserAuthorize is the authorization endpoint OAuth clients send
+// browsers to. The user is the one of the session cookie HandleCreateOAuthSession
+// sets, the answer is always a redirect but for an unknown client or redirect uri.
+func HandleOAuthBrowserAuthorize(o oauth.OAuth, u user.User) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authorize := authorizeRequestFromQuery(r)
+		authorize.Prompt = r.URL.Query().Get("prompt")
+
+		if claims := sessionClaims(r, u); claims != nil {
+			authorize.XID = claims.XID
+			authorize.AuthTime = time.Unix(claims.IssuedAt, 0)
+		}
+
+		location, err := o.BrowserAuthorize(r.Context(), authorize, r.URL.RawQuery)
+		if err != nil {
+			writeOAuthError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, location, http.StatusFound)
+	}
+}
+
+// HandleCreateOAuthSession stores the login token of the request in a cookie
+// for the browser authorization endpoint. The first party login page calls it
+// once the user signed in.
+func HandleCreateOAuthSession(expiry time.Duration, secure bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{
+			Name:     oauthSessionCookie,
+			Value:    helper.Token(r.Context()),
+			Path:     "/oauth",
+			MaxAge:   int(expiry.Seconds()),
+			Secure:   secure,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		w.WriteHeader(http.StatusAccepted)
+		helper.Response(w, helper.Message(true, "Session created!"))
+	}
+}
+
+func HandleDeleteOAuthSession(secure bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{
+			Name:     oauthSessionCookie,
+			Path:     "/oauth",
+			MaxAge:   -1,
+			Secure:   secure,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		w.WriteHeader(http.StatusAccepted)
+		helper.Response(w, helper.Message(true, "Session deleted!"))
+	}
+}
+
+func HandleOAuthToken(o oauth.OAuth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Pragma", "no-cache")
+
+		ctx, err := helper.GetReqHeader(r)
+		if err != nil {
+			writeOAuthError(w, r, err)
+			return
+		}
+
+		token, err := o.Exchange(ctx, &models.OAuthTokenRequest{
+			GrantType:    r.PostFormValue("grant_type"),
+			Code:         r.PostFormValue("code"),
+			RedirectURI:  r.PostFormValue("redirect_uri"),
+			CodeVerifier: r.PostFormValue("code_verifier"),
+		})
+		if err != nil {
+			writeOAuthError(w, r, err)
+			return
+		}
+
+		bs, err := json.ConfigFastest.Marshal(token)
+		if err != nil {
+			writeOAuthError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(bs)
+	}
+}
+
+func HandleOpenIDConfiguration(o oauth.OAuth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		discovery, err := o.Discovery()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			log.Printf("error %q: %v", r.RequestURI, err.Error())
+			return
+		}
+
+		bs, err := json.ConfigFastest.Marshal(discovery)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			log.Printf("error %q: %v", r.RequestURI, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.Write(bs)
+	}
+}
+
+func HandleUserInfo(user user.User) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		xid := helper.XID(r.Context())
+		scopes := strings.Fields(helper.Scope(r.Context()))
+
+		if !containsScope(scopes, "openid") {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+			w.WriteHeader(http.StatusForbidden)
+			helper.Response(w, helper.OAuthErrorMessage("insufficient_scope", "the openid scope is required"))
+			return
+		}
+
+		info := &models.UserInfo{Sub: xid}
+
+		if containsScope(scopes, "profile") {
+			profile, err := user.GetUserProfile(r.Context(), &models.User{XID: xid})
+			if err != nil {
+				writeOAuthError(w, r, err)
+				return
+			}
+
+			info.Name = profile.Fullname
+			info.Picture = profile.Picture
+		}
+
+		if containsScope(scopes, "email") {
+			email, err := user.GetUserEmail(r.Context(), &models.User{XID: xid})
+			if err != nil {
+				writeOAuthError(w, r, err)
+				return
+			}
+
+			info.Email = email.Email
+			info.EmailVerified = &email.Verified
+		}
+
+		bs, err := json.ConfigFastest.Marshal(info)
+		if err != nil {
+			writeOAuthError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(bs)
+	}
+}
+
+func containsScope(scopes []string, name string) bool {
+	for _, scope := range scopes {
+		if scope == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func authorizeRequestFromQuery(r *http.Request) *models.AuthorizeRequest {
+	query := r.URL.Query()
+
+	return &models.AuthorizeRequest{
+		XID:                 helper.XID(r.Context()),
+		ResponseType:        query.Get("response_type"),
+		ClientID:            query.Get("client_id"),
+		RedirectURI:         query.Get("redirect_uri"),
+		Scope:               query.Get("scope"),
+		State:               query.Get("state"),
+		CodeChallenge:       query.Get("code_challenge"),
+		CodeChallengeMethod: query.Get("code_challenge_method"),
+		Nonce:               query.Get("nonce"),
+	}
+}
+
+const oauthSessionCookie = "oauth_session"
+
+// sessionClaims returns the login token of the session cookie, nil when there
+// is none or it is no longer active
+func sessionClaims(r *http.Request, u user.User) *models.TokenClaim {
+	cookie, err := r.Cookie(oauthSessionCookie)
+	if err != nil {
+		return nil
+	}
+
+	claims, err := middleware.VerifyToken(cookie.Value)
+	if err != nil || claims.AccessType != "login" {
+		return nil
+	}
+
+	if u.CheckJWTIsActive(r.Context(), &models.UserToken{Token: cookie.Value}) != nil {
+		return nil
+	}
+
+	return claims
+}
+
+func writeOAuthError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("error %q: %v", r.RequestURI, err.Error())
+
+	var oauthErr *models.OAuthError
+	if errors.As(err, &oauthErr) {
+		w.WriteHeader(oauthErr.Status)
+		helper.Response(w, helper.OAuthErrorMessage(oauthErr.Code, oauthErr.Description))
+		return
+	}
+
+	w.WriteHeader(http.StatusInternalServerError)
+	helper.Response(w, helper.OAuthErrorMessage("server_error", err.Error()))
+}
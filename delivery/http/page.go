@@ -0,0 +1,71 @@
+package http
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/g-graziano/user-auth-golang/service/user"
+	"github.com/go-chi/chi"
+)
+
+// emailLinkPage is what the page of an emailed link asks the user to confirm
+type emailLinkPage struct {
+	Title  string
+	Prompt string
+	Action string
+	Error  string
+}
+
+var (
+	changeEmailPage = emailLinkPage{
+		Title:  "Confirm your new email",
+		Prompt: "Use this address for your account? You will be signed out everywhere.",
+		Action: "Change email",
+	}
+	revertEmailPage = emailLinkPage{
+		Title:  "Restore your email",
+		Prompt: "Restore this address on your account and cancel the change? You will be signed out everywhere.",
+		Action: "Restore email",
+	}
+)
+
+// the form posts to the link itself
+var emailLinkTemplate = template.Must(template.New("email-link").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Error}}<p>{{.Error}}</p>{{else}}<p>{{.Prompt}}</p>
+<form method="post"><button type="submit">{{.Action}}</button></form>{{end}}
+</body>
+</html>
+`))
+
+// HandleEmailLinkPage answers the GET of a link emailed for purpose with a page
+// asking to confirm, only the POST it submits uses the token. Mail scanners and
+// link prefetchers open links but don't submit forms.
+func HandleEmailLinkPage(user user.User, purpose string, page emailLinkPage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+
+		err := user.CheckVerificationToken(r.Context(), chi.URLParam(r, "token"), purpose)
+		if err != nil {
+			status = tokenErrorStatus(err)
+			page.Error = "This link is not valid anymore: " + err.Error()
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		w.WriteHeader(status)
+
+		if err := emailLinkTemplate.Execute(w, page); err != nil {
+			log.Printf("error %q: %v", r.RequestURI, err.Error())
+		}
+	}
+}
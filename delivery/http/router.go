@@ -1,12 +1,18 @@
 package http
 
 import (
-	"context"
 	"net/http"
-	"os"
+	"strings"
 	"time"
 
+	"github.com/g-graziano/user-auth-golang/config"
+	"github.com/g-graziano/user-auth-golang/helper"
+	"github.com/g-graziano/user-auth-golang/keyset"
 	"github.com/g-graziano/user-auth-golang/middleware"
+	"github.com/g-graziano/user-auth-golang/models"
+	"github.com/g-graziano/user-auth-golang/repository/storage"
+	"github.com/g-graziano/user-auth-golang/service/oauth"
+	"github.com/g-graziano/user-auth-golang/service/outbox"
 	"github.com/g-graziano/user-auth-golang/service/token"
 	"github.com/g-graziano/user-auth-golang/service/user"
 	"github.com/go-chi/chi"
@@ -14,14 +20,18 @@ import (
 	"github.com/go-chi/cors"
 )
 
-func Router(ctx context.Context, user user.User, token token.Token) {
+func Router(cfg *config.Config, user user.User, token token.Token, oauth oauth.OAuth, keys keyset.KeySet, outbox outbox.Outbox, storage storage.Storage) {
+	http.ListenAndServe(cfg.Server.Address, NewRouter(cfg, user, token, oauth, keys, outbox, storage))
+}
+
+// NewRouter builds the handler serving every route, without listening
+func NewRouter(cfg *config.Config, user user.User, token token.Token, oauth oauth.OAuth, keys keyset.KeySet, outbox outbox.Outbox, storage storage.Storage) http.Handler {
 	r := chi.NewRouter()
 
 	// Basic CORS
 	// for more ideas, see: https://developer.github.com/v3/#cross-origin-resource-sharing
 	cors := cors.New(cors.Options{
-		// AllowedOrigins: []string{"https://foo.com"}, // Use this to allow specific origin hosts
-		AllowedOrigins: []string{"*"},
+		AllowedOrigins: cfg.Server.CORSOrigins,
 		// AllowOriginFunc:  func(r *http.Request, origin string) bool { return true },
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
@@ -30,15 +40,29 @@ func Router(ctx context.Context, user user.User, token token.Token) {
 		MaxAge:           300, // Maximum value not ignored by any of major browsers
 	})
 
+	// Validate already parsed them
+	trustedProxies, _ := helper.ParseTrustedProxies(cfg.Server.TrustedProxies)
+
 	r.Use(cors.Handler)
+	r.Use(middleware.RealIP(trustedProxies))
 	r.Use(mdlw.Logger)
 	r.Use(mdlw.Timeout(60 * time.Second))
 	r.Use(mdlw.Recoverer)
 
+	r.Get("/.well-known/jwks.json", HandleJWKS(keys))
+	r.Get("/.well-known/openid-configuration", HandleOpenIDConfiguration(oauth))
+
+	r.Get("/media/*", HandleGetMedia(storage))
+
+	r.With(middleware.JwtOAuthAuthentication(user)).Group(func(r chi.Router) {
+		r.Get("/userinfo", HandleUserInfo(user))
+		r.Post("/userinfo", HandleUserInfo(user))
+	})
+
 	r.Route("/auth", func(r chi.Router) {
 		r.With(middleware.APIClientAuthentication(user)).Group(func(r chi.Router) {
 			r.Post("/register", HandleUserRegister(user))
-			r.Post("/login", HandleLogin(ctx, user))
+			r.Post("/login", HandleLogin(user))
 
 			r.Post("/verification", HandleRequestEmailVerification(user))
 
@@ -46,26 +70,53 @@ func Router(ctx context.Context, user user.User, token token.Token) {
 			r.Post("/password/reset", HandleResetPassword(user))
 		})
 
-		r.Get("/verification/{xid}", HandleEmailVerification(user))
+		r.Get("/verification/{token}", HandleEmailVerification(user))
 
 		r.With(middleware.JwtTfaAuthentication).Group(func(r chi.Router) {
-			r.Post("/tfa/bypass", HandleByPassTfa(ctx, user))
-			r.Post("/tfa/verify", HandleVerifyTfa(ctx, token))
+			r.Post("/tfa/bypass", HandleByPassTfa(user))
+			r.Post("/tfa/verify", HandleVerifyTfa(token))
+		})
+	})
+
+	secureCookies := strings.HasPrefix(cfg.Server.PublicBaseURL, "https://")
+
+	r.Route("/oauth", func(r chi.Router) {
+		r.Get("/authorize/browser", HandleOAuthBrowserAuthorize(oauth, user))
+		r.Delete("/session", HandleDeleteOAuthSession(secureCookies))
+
+		r.With(middleware.JwtAuthentication(user)).Group(func(r chi.Router) {
+			r.Post("/session", HandleCreateOAuthSession(cfg.Token.Access, secureCookies))
+
+			r.Post("/clients", HandleRegisterOAuthClient(oauth))
+			r.Get("/clients", HandleListOAuthClients(oauth))
+			r.Delete("/clients/{clientID}", HandleRevokeOAuthClient(oauth))
+
+			r.Get("/authorize", HandleGetOAuthConsent(oauth))
+			r.Post("/authorize", HandleOAuthAuthorize(oauth))
 		})
+
+		r.With(middleware.OAuthClientAuthentication(oauth)).Post("/token", HandleOAuthToken(oauth))
 	})
 
 	r.Route("/me", func(r chi.Router) {
+		// opened from emailed links, the token is the credential. GET only
+		// asks for confirmation, link scanners must not use the token.
+		r.Get("/change-email/{token}", HandleEmailLinkPage(user, models.PurposeChangeEmail, changeEmailPage))
+		r.Post("/change-email/{token}", HandleConfirmChangeEmail(user))
+		r.Get("/revert-email/{token}", HandleEmailLinkPage(user, models.PurposeRevertEmail, revertEmailPage))
+		r.Post("/revert-email/{token}", HandleRevertEmail(user))
+
 		r.With(middleware.JwtAuthentication(user)).Group(func(r chi.Router) {
 			r.Get("/", HandleGetUserProfile(user))
 			r.Post("/", HandleUpdateUserProfile(user))
 
 			r.Get("/email", HandleGetUserEmail(user))
-			r.Post("/email", HandleRequestChangePassword(user))
+			r.Post("/email", HandleRequestChangeEmail(user))
 
 			r.Post("/password", HandleUpdatePassword(user))
 
 			r.Delete("/picture", HandleDeleteProfilePicture(user))
-			r.Post("/picture", HandleSetProfilePicture(user))
+			r.Post("/picture", HandleSetProfilePicture(user, int64(cfg.Storage.PictureMaxSize)))
 
 			r.Post("/delete", HandleDeleteUser(user))
 
@@ -73,17 +124,26 @@ func Router(ctx context.Context, user user.User, token token.Token) {
 			r.Post("/tfa/remove", HandleRemoveTfa(user))
 			r.Get("/tfa/enroll", HandleTfaEnroll(user))
 			r.Post("/tfa/enroll", HandleActivateTfa(user))
+			r.Get("/tfa/backup-codes", HandleGetBackupCodesStatus(user))
+			r.Post("/tfa/backup-codes/regenerate", HandleRegenerateBackupCodes(user))
 
 			r.Get("/session", HandleGetListSession(user))
-			r.Get("/session/refresh_token", HandleGetRefreshToken(ctx, user))
+			r.Get("/session/refresh_token", HandleGetRefreshToken(user))
 			r.Delete("/session/other", HandleDeleteOtherSession(user))
 			r.Delete("/session", HandleEndCurrentSession(user))
 
 			r.Get("/events", HandleGetListEvent(user))
 		})
 
-		r.With(middleware.JwtACTAuthentication).Get("/session/access_token", HandleGetNewAccessToken(ctx, user))
+		r.With(middleware.JwtACTAuthentication).Get("/session/access_token", HandleGetNewAccessToken(user))
+	})
+
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(middleware.AdminAuthentication(cfg.Admin.Token))
+
+		r.Get("/outbox", HandleListOutbox(outbox))
+		r.Post("/outbox/{id}/retry", HandleRetryOutbox(outbox))
 	})
 
-	http.ListenAndServe(os.Getenv("SERVER_ADDRESS"), r)
+	return r
 }
@@ -0,0 +1,1785 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/g-graziano/user-auth-golang/config"
+	"github.com/g-graziano/user-auth-golang/emails"
+	"github.com/g-graziano/user-auth-golang/helper"
+	"github.com/g-graziano/user-auth-golang/keyset"
+	"github.com/g-graziano/user-auth-golang/models"
+	"github.com/g-graziano/user-auth-golang/password"
+	"github.com/g-graziano/user-auth-golang/repository/mailer"
+	"github.com/g-graziano/user-auth-golang/repository/postgres"
+	"github.com/g-graziano/user-auth-golang/repository/redis"
+	"github.com/g-graziano/user-auth-golang/repository/storage"
+	"github.com/g-graziano/user-auth-golang/service/attempt"
+	"github.com/g-graziano/user-auth-golang/service/oauth"
+	"github.com/g-graziano/user-auth-golang/service/outbox"
+	"github.com/g-graziano/user-auth-golang/service/token"
+	"github.com/g-graziano/user-auth-golang/service/user"
+	json "github.com/json-iterator/go"
+)
+
+const (
+	testAPIKey     = "test-api-key"
+	testAdminToken = "test-admin-token"
+	testEmail      = "jane@example.com"
+	testNewEmail   = "jane@example.org"
+	testPassword   = "Correct-Horse-42"
+)
+
+// testServer serves the router on in-memory repositories
+type testServer struct {
+	handler  http.Handler
+	postgres postgres.Postgres
+}
+
+// backends are the Postgres implementations the router is tested on
+var backends = []struct {
+	name string
+	new  func(t *testing.T) postgres.Postgres
+}{
+	{name: "memory", new: func(t *testing.T) postgres.Postgres { return postgres.NewMemory() }},
+	{name: "sqlite", new: func(t *testing.T) postgres.Postgres {
+		path := t.TempDir() + "/test.db"
+
+		migrator, db, err := postgres.NewSQLiteMigrator(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer db.Close()
+
+		if _, err := migrator.Up(); err != nil {
+			t.Fatal(err)
+		}
+
+		return postgres.NewSQLite(path)
+	}},
+}
+
+func newTestServer(t *testing.T, pg postgres.Postgres) *testServer {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.Mail.Driver = mailer.File
+	cfg.Mail.FilePath = t.TempDir() + "/outbox.mbox"
+	cfg.Storage.LocalDir = t.TempDir()
+	cfg.TFA.SecretKey = "test-secret-key"
+	cfg.Password.BcryptCost = 4
+	cfg.Server.LoginURL = testLoginURL
+	cfg.Admin.Token = testAdminToken
+
+	rd := redis.NewMemory()
+
+	ml, err := mailer.New(cfg.Mail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := storage.New(cfg.Storage, cfg.Server.PublicBaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	er, err := emails.New("", cfg.Mail.FromName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := keyset.New(keyset.Options{Algorithm: cfg.JWT.SigningAlg})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyset.SetDefault(keys)
+
+	at := attempt.New(pg, rd, attempt.Options{
+		MaxAccountFailures: cfg.Attempt.MaxAccount,
+		MaxIPFailures:      cfg.Attempt.MaxIP,
+		MaxClientFailures:  cfg.Attempt.MaxClient,
+		Window:             cfg.Attempt.Window,
+		Lockout:            cfg.Attempt.Lockout,
+		MaxLockout:         cfg.Attempt.MaxLockout,
+	})
+
+	hasher, err := password.New(password.Options{
+		Algorithm:  cfg.Password.Hasher,
+		BcryptCost: cfg.Password.BcryptCost,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := password.NewPolicy(password.PolicyOptions{
+		MinLength:   cfg.Password.MinLength,
+		MaxLength:   cfg.Password.MaxLength,
+		HistorySize: cfg.Password.History,
+	}, hasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pg.CreateClientID(context.Background(), &models.ClientID{API: testAPIKey, Name: "test", Type: models.ClientFirstParty})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testServer{
+		handler: NewRouter(cfg,
+			user.New(pg, rd, st, er, at, hasher, policy, cfg),
+			token.New(pg, rd, at, cfg),
+			oauth.New(pg, rd, st, cfg),
+			keys,
+			outbox.New(pg, ml, cfg.Outbox),
+			st,
+		),
+		postgres: pg,
+	}
+}
+
+// upload is posted as the file of a multipart form
+type upload []byte
+
+func (s *testServer) do(method string, path string, auth string, client string, cookies []*http.Cookie, body interface{}) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	contentType := "application/json"
+
+	switch body := body.(type) {
+	case url.Values:
+		// posted as a form, like the OAuth token endpoint expects
+		buf.WriteString(body.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	case upload:
+		form := multipart.NewWriter(&buf)
+
+		file, _ := form.CreateFormFile("file", "picture")
+		_, _ = file.Write(body)
+		_ = form.Close()
+
+		contentType = form.FormDataContentType()
+	case nil:
+	default:
+		_ = json.NewEncoder(&buf).Encode(body)
+	}
+
+	r := httptest.NewRequest(method, path, &buf)
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Set("X-API-ClientID", client)
+
+	if auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, r)
+
+	return w
+}
+
+// mailedToken returns the token in the latest email queued for the recipient
+func (s *testServer) mailedToken(t *testing.T, recipient string, pattern *regexp.Regexp) string {
+	t.Helper()
+
+	queued, err := s.postgres.ClaimOutboxEmails(context.Background(), 100, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := len(queued) - 1; i >= 0; i-- {
+		if queued[i].RecipientEmail != recipient {
+			continue
+		}
+
+		if match := pattern.FindStringSubmatch(queued[i].PlainContent); match != nil {
+			return match[1]
+		}
+	}
+
+	t.Fatalf("no email to %s matching %s", recipient, pattern)
+
+	return ""
+}
+
+var (
+	verifyLink      = regexp.MustCompile(`/auth/verification/(\S+)`)
+	changeEmailLink = regexp.MustCompile(`/me/change-email/(\S+)`)
+	revertEmailLink = regexp.MustCompile(`/me/revert-email/(\S+)`)
+	resetCode       = regexp.MustCompile(`(?m)^\s*([0-9A-Za-z_-]{16,})\s*$`)
+)
+
+// flow holds what earlier steps of a test case learned, for the later ones
+type flow struct {
+	s *testServer
+	t *testing.T
+
+	access      string
+	refresh     string
+	tfaSecret   string
+	tfaCode     string
+	backupCodes []string
+	resetToken  string
+	verifyPath  string
+	oauthClient string
+	oauthSecret string
+	oauthCode   string
+	oauthAccess string
+	cursor      string
+	outboxID    uint64
+	// pictures are the thumbnail paths of the profile, by size
+	pictures map[string]string
+	// links are the emailed links opened so far, by recipient and pattern
+	links map[string]string
+	// cookies are sent back like a browser does
+	cookies []*http.Cookie
+}
+
+type step struct {
+	name   string
+	method string
+	path   string
+	// link builds the path when it is only known from an email
+	link func(f *flow) string
+	// auth picks the Authorization header, nil sends none
+	auth func(f *flow) string
+	// client picks the X-API-ClientID header, nil sends the test client
+	client func(f *flow) string
+	body   func(f *flow) interface{}
+	status int
+	// check inspects a response with the expected status
+	check func(f *flow, body []byte)
+	// location inspects where a redirect points
+	location func(f *flow, location *url.URL)
+	// header inspects the response headers
+	header func(f *flow, header http.Header)
+}
+
+func (f *flow) run(steps []step) {
+	for _, st := range steps {
+		var auth string
+		if st.auth != nil {
+			auth = st.auth(f)
+		}
+
+		var body interface{}
+		if st.body != nil {
+			body = st.body(f)
+		}
+
+		path := st.path
+		if st.link != nil {
+			path = st.link(f)
+		}
+
+		client := testAPIKey
+		if st.client != nil {
+			client = st.client(f)
+		}
+
+		w := f.s.do(st.method, path, auth, client, f.cookies, body)
+
+		if w.Code != st.status {
+			f.t.Fatalf("%s: %s %s returned %d, want %d: %s", st.name, st.method, path, w.Code, st.status, w.Body.String())
+		}
+
+		f.keepCookies(w.Result().Cookies())
+
+		if st.check != nil {
+			st.check(f, w.Body.Bytes())
+		}
+
+		if st.location != nil {
+			location, err := url.Parse(w.Header().Get("Location"))
+			if err != nil {
+				f.t.Fatalf("%s: %v", st.name, err)
+			}
+
+			st.location(f, location)
+		}
+
+		if st.header != nil {
+			st.header(f, w.Header())
+		}
+	}
+}
+
+// keepCookies replaces the cookies of the same name, an expired one is dropped
+func (f *flow) keepCookies(cookies []*http.Cookie) {
+	for _, cookie := range cookies {
+		kept := f.cookies[:0]
+		for _, c := range f.cookies {
+			if c.Name != cookie.Name {
+				kept = append(kept, c)
+			}
+		}
+
+		f.cookies = kept
+		if cookie.MaxAge >= 0 {
+			f.cookies = append(f.cookies, cookie)
+		}
+	}
+}
+
+func (f *flow) decode(body []byte, v interface{}) {
+	f.t.Helper()
+
+	if err := json.Unmarshal(body, v); err != nil {
+		f.t.Fatalf("decode %s: %v", body, err)
+	}
+}
+
+// verificationLink opens the link emailed on registration
+func verificationLink(f *flow) string {
+	if f.verifyPath == "" {
+		f.verifyPath = "/auth/verification/" + f.s.mailedToken(f.t, testEmail, verifyLink)
+	}
+
+	return f.verifyPath
+}
+
+// emailedLink opens the link of pattern in the latest email to recipient, the
+// email is only read once so later steps reuse the link
+func emailedLink(recipient string, pattern *regexp.Regexp, prefix string) func(f *flow) string {
+	return func(f *flow) string {
+		key := recipient + " " + pattern.String()
+
+		if f.links[key] == "" {
+			if f.links == nil {
+				f.links = map[string]string{}
+			}
+
+			f.links[key] = prefix + f.s.mailedToken(f.t, recipient, pattern)
+		}
+
+		return f.links[key]
+	}
+}
+
+// loginEvents pages through the login events, after the cursor of the previous
+// page when cursor is set, and expects want events of the total and whether
+// there is a next cursor
+func loginEvents(query string, cursor bool, want int, total int, next bool) step {
+	return step{
+		name:   "login events " + query,
+		method: http.MethodGet,
+		link: func(f *flow) string {
+			path := "/me/events?event=login&per_page=2&" + query
+			if cursor {
+				path += "&cursor=" + f.cursor
+			}
+
+			return path
+		},
+		auth:   accessToken,
+		status: http.StatusOK,
+		check: func(f *flow, body []byte) {
+			var list models.ListEventResponse
+			f.decode(body, &list)
+
+			if len(list.Data) != want || list.Pagination.Total != total {
+				f.t.Fatalf("%d events of %d, want %d of %d: %s", len(list.Data), list.Pagination.Total, want, total, body)
+			}
+
+			if (list.Pagination.NextCursor != "") != next {
+				f.t.Fatalf("next cursor %q, want one: %v", list.Pagination.NextCursor, next)
+			}
+
+			f.cursor = list.Pagination.NextCursor
+		},
+	}
+}
+
+// pngPicture uploads a blank width by height PNG
+func pngPicture(width int, height int) func(f *flow) interface{} {
+	return func(f *flow) interface{} {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+			f.t.Fatal(err)
+		}
+
+		return upload(buf.Bytes())
+	}
+}
+
+// thumbnail fetches the size thumbnail listed on the profile and expects a
+// square JPEG of that size when it is served
+func thumbnail(size int, status int) step {
+	return step{
+		name:   "thumbnail " + strconv.Itoa(size),
+		method: http.MethodGet,
+		link:   func(f *flow) string { return f.pictures[strconv.Itoa(size)] },
+		status: status,
+		check: func(f *flow, body []byte) {
+			if status != http.StatusOK {
+				return
+			}
+
+			img, err := jpeg.Decode(bytes.NewReader(body))
+			if err != nil {
+				f.t.Fatalf("thumbnail %d: %v", size, err)
+			}
+
+			if bounds := img.Bounds(); bounds.Dx() != size || bounds.Dy() != size {
+				f.t.Fatalf("thumbnail %d is %dx%d", size, bounds.Dx(), bounds.Dy())
+			}
+		},
+	}
+}
+
+// failedLogins tries a wrong password n times
+func failedLogins(n int) []step {
+	var steps []step
+	for i := 1; i <= n; i++ {
+		steps = append(steps, step{
+			name:   "wrong password " + strconv.Itoa(i),
+			method: http.MethodPost,
+			path:   "/auth/login",
+			body:   login("Wrong-Horse-42"),
+			status: http.StatusBadRequest,
+		})
+	}
+
+	return steps
+}
+
+// retryAfter expects a Retry-After of at most the lockout
+func retryAfter(f *flow, header http.Header) {
+	seconds, err := strconv.Atoi(header.Get("Retry-After"))
+	if err != nil || seconds < 1 || seconds > int(config.Default().Attempt.Lockout.Seconds()) {
+		f.t.Fatalf("Retry-After %q, want at most the lockout", header.Get("Retry-After"))
+	}
+}
+
+func adminToken(f *flow) string { return "Bearer " + testAdminToken }
+
+func accessToken(f *flow) string  { return "Bearer " + f.access }
+func refreshToken(f *flow) string { return "Bearer " + f.refresh }
+
+func storeAccess(f *flow, body []byte) {
+	var token models.AccessToken
+	f.decode(body, &token)
+
+	if token.Value == "" {
+		f.t.Fatalf("no access token in %s", body)
+	}
+
+	f.access = token.Value
+}
+
+func storeRefresh(f *flow, body []byte) {
+	var token models.AccessToken
+	f.decode(body, &token)
+
+	if token.Value == "" {
+		f.t.Fatalf("no refresh token in %s", body)
+	}
+
+	f.refresh = token.Value
+}
+
+func login(pass string) func(f *flow) interface{} {
+	return func(f *flow) interface{} {
+		return models.Login{Email: testEmail, Password: pass}
+	}
+}
+
+func totpCode(f *flow) interface{} {
+	return totpCodeAt(0)(f)
+}
+
+// totpCodeAt is the code of steps time steps from now, within the skew so a
+// code other than the one just used is still accepted
+func totpCodeAt(steps int) func(f *flow) interface{} {
+	return func(f *flow) interface{} {
+		code, err := helper.GenerateTOTPCode(f.tfaSecret, time.Now().Add(time.Duration(steps)*helper.TOTPPeriod*time.Second))
+		if err != nil {
+			f.t.Fatal(err)
+		}
+
+		return models.OTPRequest{Code: code}
+	}
+}
+
+// registered registers and verifies the test user, then logs in
+var registered = []step{
+	{
+		name:   "register",
+		method: http.MethodPost,
+		path:   "/auth/register",
+		body: func(f *flow) interface{} {
+			return models.RegisterRequest{Fullname: "Jane", Email: testEmail, Password: testPassword, PasswordConfirm: testPassword}
+		},
+		status: http.StatusAccepted,
+	},
+	{
+		name:   "login before verifying",
+		method: http.MethodPost,
+		path:   "/auth/login",
+		body:   login(testPassword),
+		status: http.StatusBadRequest,
+	},
+	{
+		name:   "verify email",
+		method: http.MethodGet,
+		link:   verificationLink,
+		status: http.StatusAccepted,
+	},
+	{
+		name:   "login",
+		method: http.MethodPost,
+		path:   "/auth/login",
+		body:   login(testPassword),
+		status: http.StatusOK,
+		check:  storeAccess,
+	},
+}
+
+// then continues from a registered and logged in user
+func then(steps ...step) []step {
+	return append(append([]step(nil), registered...), steps...)
+}
+
+const (
+	testLoginURL    = "https://example.com/login"
+	testRedirectURI = "https://app.example.com/callback"
+	// testCodeChallenge is the S256 challenge of the RFC 7636 example verifier
+	testCodeChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	testCodeVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+var registerOAuthClient = step{
+	name:   "register oauth client",
+	method: http.MethodPost,
+	path:   "/oauth/clients",
+	auth:   accessToken,
+	body: func(f *flow) interface{} {
+		return models.OAuthClientRequest{Name: "app", RedirectURIs: []string{testRedirectURI}}
+	},
+	status: http.StatusCreated,
+	check: func(f *flow, body []byte) {
+		var client models.OAuthClientResponse
+		f.decode(body, &client)
+
+		if client.ClientID == "" || client.ClientSecret == "" {
+			f.t.Fatalf("no client credentials in %s", body)
+		}
+
+		f.oauthClient = client.ClientID
+		f.oauthSecret = client.ClientSecret
+	},
+}
+
+// approveOAuthClient approves the authorization request of the registered
+// client and keeps the code it is redirected with
+var approveOAuthClient = step{
+	name:   "approve",
+	method: http.MethodPost,
+	path:   "/oauth/authorize",
+	auth:   accessToken,
+	body: func(f *flow) interface{} {
+		return models.AuthorizeRequest{
+			ResponseType:        "code",
+			ClientID:            f.oauthClient,
+			RedirectURI:         testRedirectURI,
+			Scope:               "openid email",
+			State:               "xyz",
+			CodeChallenge:       testCodeChallenge,
+			CodeChallengeMethod: "S256",
+			Nonce:               "n-0S6_WzA2Mj",
+			Approve:             true,
+		}
+	},
+	status: http.StatusOK,
+	check: func(f *flow, body []byte) {
+		var authorize models.AuthorizeResponse
+		f.decode(body, &authorize)
+
+		location, err := url.Parse(authorize.RedirectURI)
+		if err != nil || location.Query().Get("code") == "" {
+			f.t.Fatalf("no code in %s", body)
+		}
+
+		f.oauthCode = location.Query().Get("code")
+	},
+}
+
+// exchangeCode exchanges the last code at the token endpoint, override
+// replaces form parameters like browserAuthorize does
+func exchangeCode(name string, override url.Values, status int, check func(f *flow, body []byte)) step {
+	return step{
+		name:   name,
+		method: http.MethodPost,
+		path:   "/oauth/token",
+		auth: func(f *flow) string {
+			return "Basic " + base64.StdEncoding.EncodeToString([]byte(f.oauthClient+":"+f.oauthSecret))
+		},
+		body: func(f *flow) interface{} {
+			form := url.Values{
+				"grant_type":    {"authorization_code"},
+				"code":          {f.oauthCode},
+				"redirect_uri":  {testRedirectURI},
+				"code_verifier": {testCodeVerifier},
+			}
+
+			for name, values := range override {
+				if values == nil {
+					form.Del(name)
+				} else {
+					form[name] = values
+				}
+			}
+
+			return form
+		},
+		status: status,
+		check:  check,
+	}
+}
+
+// oauthError expects the OAuth error code in the body
+func oauthError(code string) func(f *flow, body []byte) {
+	return func(f *flow, body []byte) {
+		var oauthErr struct {
+			Error string `json:"error"`
+		}
+		f.decode(body, &oauthErr)
+
+		if oauthErr.Error != code {
+			f.t.Fatalf("error %q, want %s: %s", oauthErr.Error, code, body)
+		}
+	}
+}
+
+// browserAuthorize links to the browser authorization endpoint for the
+// registered client, override replaces parameters and drops the nil ones
+func browserAuthorize(override url.Values) func(f *flow) string {
+	return func(f *flow) string {
+		query := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {f.oauthClient},
+			"redirect_uri":          {testRedirectURI},
+			"scope":                 {"openid"},
+			"state":                 {"xyz"},
+			"code_challenge":        {testCodeChallenge},
+			"code_challenge_method": {"S256"},
+			"prompt":                {"none"},
+		}
+
+		for name, values := range override {
+			if values == nil {
+				query.Del(name)
+			} else {
+				query[name] = values
+			}
+		}
+
+		return "/oauth/authorize/browser?" + query.Encode()
+	}
+}
+
+// redirectError expects a redirect to the client with the OAuth error code
+func redirectError(code string) func(f *flow, location *url.URL) {
+	return func(f *flow, location *url.URL) {
+		query := location.Query()
+
+		if !strings.HasPrefix(location.String(), testRedirectURI+"?") || query.Get("error") != code || query.Get("state") != "xyz" {
+			f.t.Fatalf("redirected to %s, want %s with error %s and the state", location, testRedirectURI, code)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "register and verify",
+			steps: []step{
+				{
+					name:   "register with mismatched passwords",
+					method: http.MethodPost,
+					path:   "/auth/register",
+					body: func(f *flow) interface{} {
+						return models.RegisterRequest{Fullname: "Jane", Email: testEmail, Password: testPassword, PasswordConfirm: "other"}
+					},
+					status: http.StatusAccepted,
+					check: func(f *flow, body []byte) {
+						var res map[string]interface{}
+						f.decode(body, &res)
+
+						if res["success"] == true {
+							f.t.Fatalf("register succeeded: %s", body)
+						}
+					},
+				},
+				registered[0],
+				{
+					name:   "register the same email again",
+					method: http.MethodPost,
+					path:   "/auth/register",
+					body: func(f *flow) interface{} {
+						return models.RegisterRequest{Fullname: "Jane", Email: testEmail, Password: testPassword, PasswordConfirm: testPassword}
+					},
+					status: http.StatusAccepted,
+					check: func(f *flow, body []byte) {
+						var res map[string]interface{}
+						f.decode(body, &res)
+
+						if res["message"] != "Email Already Exists" {
+							f.t.Fatalf("registered twice: %s", body)
+						}
+					},
+				},
+				registered[2],
+				{
+					name:   "verify with a used link",
+					method: http.MethodGet,
+					link:   verificationLink,
+					status: http.StatusGone,
+				},
+			},
+		},
+		{
+			name: "login",
+			steps: then(
+				step{
+					name:   "login with a wrong password",
+					method: http.MethodPost,
+					path:   "/auth/login",
+					body:   login("Wrong-Horse-42"),
+					status: http.StatusBadRequest,
+				},
+				step{
+					name:   "login with an unknown email",
+					method: http.MethodPost,
+					path:   "/auth/login",
+					body: func(f *flow) interface{} {
+						return models.Login{Email: "nobody@example.com", Password: testPassword}
+					},
+					status: http.StatusBadRequest,
+				},
+				step{
+					name:   "profile",
+					method: http.MethodGet,
+					path:   "/me/",
+					auth:   accessToken,
+					status: http.StatusOK,
+					check: func(f *flow, body []byte) {
+						var profile map[string]interface{}
+						f.decode(body, &profile)
+
+						if profile["fullname"] != "jane" {
+							f.t.Fatalf("profile of another user: %s", body)
+						}
+					},
+				},
+				step{
+					name:   "profile without a token",
+					method: http.MethodGet,
+					path:   "/me/",
+					status: http.StatusBadRequest,
+				},
+			),
+		},
+		{
+			name: "tfa",
+			steps: then(
+				step{
+					name:   "enroll",
+					method: http.MethodGet,
+					path:   "/me/tfa/enroll",
+					auth:   accessToken,
+					status: http.StatusOK,
+					check: func(f *flow, body []byte) {
+						var enroll models.EnrollTfa
+						f.decode(body, &enroll)
+
+						f.tfaSecret = enroll.Secret
+					},
+				},
+				step{
+					name:   "activate",
+					method: http.MethodPost,
+					path:   "/me/tfa/enroll",
+					auth:   accessToken,
+					body: func(f *flow) interface{} {
+						f.tfaCode = totpCode(f).(models.OTPRequest).Code
+						return models.ActivateTfaRequest{Secret: f.tfaSecret, Code: f.tfaCode}
+					},
+					status: http.StatusOK,
+					check: func(f *flow, body []byte) {
+						var codes models.BackupCodesResponse
+						f.decode(body, &codes)
+
+						if len(codes.BackupCodes) == 0 {
+							f.t.Fatalf("no backup codes in %s", body)
+						}
+
+						f.backupCodes = codes.BackupCodes
+					},
+				},
+				step{
+					name:   "login asks for a code",
+					method: http.MethodPost,
+					path:   "/auth/login",
+					body:   login(testPassword),
+					status: http.StatusOK,
+					check:  storeAccess,
+				},
+				step{
+					name:   "tfa token is not a login",
+					method: http.MethodGet,
+					path:   "/me/",
+					auth:   accessToken,
+					status: http.StatusForbidden,
+				},
+				step{
+					name:   "verify a wrong code",
+					method: http.MethodPost,
+					path:   "/auth/tfa/verify",
+					auth:   accessToken,
+					body:   func(f *flow) interface{} { return models.OTPRequest{Code: "000000x"} },
+					status: http.StatusBadRequest,
+				},
+				step{
+					name:   "bypass with a backup code",
+					method: http.MethodPost,
+					path:   "/auth/tfa/bypass",
+					auth:   accessToken,
+					body:   func(f *flow) interface{} { return models.OTPRequest{Code: f.backupCodes[0]} },
+					status: http.StatusOK,
+				},
+				step{
+					name:   "bypass with a used backup code",
+					method: http.MethodPost,
+					path:   "/auth/tfa/bypass",
+					auth:   accessToken,
+					body:   func(f *flow) interface{} { return models.OTPRequest{Code: f.backupCodes[0]} },
+					status: http.StatusBadRequest,
+				},
+				step{
+					name:   "verify replays the activation code",
+					method: http.MethodPost,
+					path:   "/auth/tfa/verify",
+					auth:   accessToken,
+					body:   func(f *flow) interface{} { return models.OTPRequest{Code: f.tfaCode} },
+					status: http.StatusBadRequest,
+				},
+				step{
+					name:   "verify",
+					method: http.MethodPost,
+					path:   "/auth/tfa/verify",
+					auth:   accessToken,
+					body:   totpCodeAt(1),
+					status: http.StatusOK,
+					check:  storeAccess,
+				},
+				step{
+					name:   "status",
+					method: http.MethodGet,
+					path:   "/me/tfa",
+					auth:   accessToken,
+					status: http.StatusOK,
+					check: func(f *flow, body []byte) {
+						var status models.TFAStatus
+						f.decode(body, &status)
+
+						if !status.Enabled {
+							f.t.Fatalf("tfa not enabled: %s", body)
+						}
+					},
+				},
+				step{
+					name:   "backup codes status",
+					method: http.MethodGet,
+					path:   "/me/tfa/backup-codes",
+					auth:   accessToken,
+					status: http.StatusOK,
+					check: func(f *flow, body []byte) {
+						var status models.BackupCodesStatus
+						f.decode(body, &status)
+
+						if status.Total != len(f.backupCodes) || status.Remaining != len(f.backupCodes)-1 {
+							f.t.Fatalf("one of %d backup codes used, got %s", len(f.backupCodes), body)
+						}
+					},
+				},
+				step{
+					name:   "regenerate with a wrong password",
+					method: http.MethodPost,
+					path:   "/me/tfa/backup-codes/regenerate",
+					auth:   accessToken,
+					body: func(f *flow) interface{} {
+						return map[string]string{"password": "Wrong-Horse-42"}
+					},
+					status: http.StatusBadRequest,
+				},
+				step{
+					name:   "regenerate backup codes",
+					method: http.MethodPost,
+					path:   "/me/tfa/backup-codes/regenerate",
+					auth:   accessToken,
+					body: func(f *flow) interface{} {
+						return map[string]string{"password": testPassword}
+					},
+					status: http.StatusOK,
+					check: func(f *flow, body []byte) {
+						var codes models.BackupCodesResponse
+						f.decode(body, &codes)
+
+						if len(codes.BackupCodes) != len(f.backupCodes) {
+							f.t.Fatalf("%d backup codes, want %d: %s", len(codes.BackupCodes), len(f.backupCodes), body)
+						}
+
+						for _, code := range codes.BackupCodes {
+							for _, old := range f.backupCodes {
+								if code == old {
+									f.t.Fatalf("backup code %s kept after regenerating", code)
+								}
+							}
+						}
+
+						f.backupCodes = codes.BackupCodes
+					},
+				},
+				step{
+					name:   "backup codes status after regenerating",
+					method: http.MethodGet,
+					path:   "/me/tfa/backup-codes",
+					auth:   accessToken,
+					status: http.StatusOK,
+					check: func(f *flow, body []byte) {
+						var status models.BackupCodesStatus
+						f.decode(body, &status)
+
+						if status.Total != len(f.backupCodes) || status.Remaining != status.Total {
+							f.t.Fatalf("fresh backup codes, got %s", body)
+						}
+					},
+				},
+				step{
+					name:   "login again",
+					method: http.MethodPost,
+					path:   "/auth/login",
+					body:   login(testPassword),
+					status: http.StatusOK,
+					check:  storeAccess,
+				},
+				step{
+					name:   "verify replays the code",
+					method: http.MethodPost,
+					path:   "/auth/tfa/verify",
+					auth:   accessToken,
+					body:   totpCodeAt(1),
+					status: http.StatusBadRequest,
+				},
+				step{
+					name:   "bypass with a regenerated backup code",
+					method: http.MethodPost,
+					path:   "/auth/tfa/bypass",
+					auth:   accessToken,
+					body:   func(f *flow) interface{} { return models.OTPRequest{Code: f.backupCodes[0]} },
+					status: http.StatusOK,
+				},
+			),
+		},
+		{
+			name: "oauth clients",
+			steps: then(
+				registerOAuthClient,
+				step{
+					name:   "not a first party client",
+					method: http.MethodPost,
+					path:   "/auth/login",
+					client: func(f *flow) string { return f.oauthClient },
+					body:   login(testPassword),
+					status: http.StatusBadRequest,
+				},
+				step{
+					name:   "list",
+					method: http.MethodGet,
+					path:   "/oauth/clients",
+					auth:   accessToken,
+					status: http.StatusOK,
+					check: func(f *flow, body []byte) {
+						var clients []models.OAuthClientResponse
+						f.decode(body, &clients)
+
+						if len(clients) != 1 || clients[0].ClientID != f.oauthClient || clients[0].ClientSecret != "" {
+							f.t.Fatalf("clients = %s, want only %s without secret", body, f.oauthClient)
+						}
+					},
+				},
+				step{
+					name:   "revoke the first party client",
+					method: http.MethodDelete,
+					path:   "/oauth/clients/" + testAPIKey,
+					auth:   accessToken,
+					status: http.StatusNotFound,
+				},
+				step{
+					name:   "revoke",
+					method: http.MethodDelete,
+					link:   func(f *flow) string { return "/oauth/clients/" + f.oauthClient },
+					auth:   accessToken,
+					status: http.StatusAccepted,
+				},
+				step{
+					name:   "list after revoke",
+					method: http.MethodGet,
+					path:   "/oauth/clients",
+					auth:   accessToken,
+					status: http.StatusOK,
+					check: func(f *flow, body []byte) {
+						if strings.TrimSpace(string(body)) != "[]" {
+							f.t.Fatalf("clients after revoke = %s, want none", body)
+						}
+					},
+				},
+			),
+		},
+		{
+			name: "oauth browser authorize",
+			steps: then(
+				registerOAuthClient,
+				step{
+					name:   "unknown client",
+					method: http.MethodGet,
+					path:   "/oauth/authorize/browser?" + url.Values{"client_id": {"unknown"}, "redirect_uri": {testRedirectURI}}.Encode(),
+					status: http.StatusBadRequest,
+				},
+				step{
+					name:     "without a session",
+					method:   http.MethodGet,
+					link:     browserAuthorize(nil),
+					status:   http.StatusFound,
+					location: redirectError("login_required"),
+				},
+				step{
+					name:   "sent to the login page",
+					method: http.MethodGet,
+					link:   browserAuthorize(url.Values{"prompt": nil}),
+					status: http.StatusFound,
+					location: func(f *flow, location *url.URL) {
+						returnTo, err := url.Parse(location.Query().Get("return_to"))
+						if err != nil || !strings.HasPrefix(location.String(), testLoginURL+"?") || returnTo.Path != "/oauth/authorize/browser" || returnTo.Query().Get("client_id") != f.oauthClient {
+							f.t.Fatalf("redirected to %s, want the login page returning to the request", location)
+						}
+					},
+				},
+				step{
+					name:   "create the session",
+					method: http.MethodPost,
+					path:   "/oauth/session",
+					auth:   accessToken,
+					status: http.StatusAccepted,
+				},
+				step{
+					name:     "not approved yet",
+					method:   http.MethodGet,
+					link:     browserAuthorize(nil),
+					status:   http.StatusFound,
+					location: redirectError("consent_required"),
+				},
+				approveOAuthClient,
+				step{
+					name:   "approved",
+					method: http.MethodGet,
+					link:   browserAuthorize(nil),
+					status: http.StatusFound,
+					location: func(f *flow, location *url.URL) {
+						query := location.Query()
+
+						if !strings.HasPrefix(location.String(), testRedirectURI+"?") || query.Get("code") == "" || query.Get("state") != "xyz" {
+							f.t.Fatalf("redirected to %s, want %s with a code and the state", location, testRedirectURI)
+						}
+					},
+				},
+				step{
+					name:     "without a code challenge",
+					method:   http.MethodGet,
+					link:     browserAuthorize(url.Values{"code_challenge": nil}),
+					status:   http.StatusFound,
+					location: redirectError("invalid_request"),
+				},
+				step{
+					name:   "delete the session",
+					method: http.MethodDelete,
+					path:   "/oauth/session",
+					status: http.StatusAccepted,
+				},
+				step{
+					name:     "after the session was deleted",
+					method:   http.MethodGet,
+					link:     browserAuthorize(nil),
+					status:   http.StatusFound,
+					location: redirectError("login_required"),
+				},
+			),
+		},
+		{
+			name: "oauth token exchange",
+			steps: then(
+				registerOAuthClient,
+				approveOAuthClient,
+				exchangeCode("wrong code verifier", url.Values{"code_verifier": {strings.Repeat("x", 43)}}, http.StatusBadRequest, oauthError("invalid_grant")),
+				exchangeCode("the code was spent by the failed exchange", nil, http.StatusBadRequest, oauthError("invalid_grant")),
+				approveOAuthClient,
+				exchangeCode("mismatched redirect uri", url.Values{"redirect_uri": {"https://app.example.com/other"}}, http.StatusBadRequest, oauthError("invalid_grant")),
+				approveOAuthClient,
+				exchangeCode("without code verifier", url.Values{"code_verifier": nil}, http.StatusBadRequest, oauthError("invalid_request")),
+				exchangeCode("unsupported grant type", url.Values{"grant_type": {"password"}}, http.StatusBadRequest, oauthError("unsupported_grant_type")),
+				step{
+					name:   "wrong client secret",
+					method: http.MethodPost,
+					path:   "/oauth/token",
+					auth: func(f *flow) string {
+						return "Basic " + base64.StdEncoding.EncodeToString([]byte(f.oauthClient+":wrong"))
+					},
+					body: func(f *flow) interface{} {
+						return url.Values{"grant_type": {"authorization_code"}, "code": {f.oauthCode}, "redirect_uri": {testRedirectURI}, "code_verifier": {testCodeVerifier}}
+					},
+					status: http.StatusUnauthorized,
+					check:  oauthError("invalid_client"),
+				},
+				exchangeCode("exchange", nil, http.StatusOK, func(f *flow, body []byte) {
+					var token models.OAuthTokenResponse
+					f.decode(body, &token)
+
+					if token.AccessToken == "" || token.TokenType != "Bearer" || token.Scope != "openid email" {
+						f.t.Fatalf("unexpected token response %s", body)
+					}
+
+					var login jwt.StandardClaims
+					if _, _, err := new(jwt.Parser).ParseUnverified(f.access, &login); err != nil {
+						f.t.Fatal(err)
+					}
+
+					var idToken models.IDTokenClaim
+					if _, _, err := new(jwt.Parser).ParseUnverified(token.IDToken, &idToken); err != nil {
+						f.t.Fatal(err)
+					}
+
+					if idToken.AuthTime != login.IssuedAt || idToken.Nonce != "n-0S6_WzA2Mj" || idToken.Audience != f.oauthClient {
+						f.t.Fatalf("id token claims %+v, want the auth_time %d of the login, the nonce and the client", idToken, login.IssuedAt)
+					}
+
+					f.oauthAccess = token.AccessToken
+				}),
+				exchangeCode("reused code", nil, http.StatusBadRequest, oauthError("invalid_grant")),
+				step{
+					name:   "userinfo",
+					method: http.MethodGet,
+					path:   "/userinfo",
+					auth:   func(f *flow) string { return "Bearer " + f.oauthAccess },
+					status: http.StatusOK,
+					check: func(f *flow, body []byte) {
+						var login models.TokenClaim
+						if _, _, err := new(jwt.Parser).ParseUnverified(f.access, &login); err != nil {
+							f.t.Fatal(err)
+						}
+
+						var info models.UserInfo
+						f.decode(body, &info)
+
+						if info.Sub != login.XID || info.Email != testEmail {
+							f.t.Fatalf("userinfo %s, want %s with the email scope", body, login.XID)
+						}
+					},
+				},
+				step{
+					name:   "userinfo with a login token",
+					method: http.MethodGet,
+					path:   "/userinfo",
+					auth:   accessToken,
+					status: http.StatusUnauthorized,
+					check:  oauthError("invalid_token"),
+					header: func(f *flow, header http.Header) {
+						if !strings.HasPrefix(header.Get("WWW-Authenticate"), "Bearer ") {
+							f.t.Fatalf("WWW-Authenticate %q", header.Get("WWW-Authenticate"))
+						}
+					},
+				},
+				step{
+					name:   "openid configuration",
+					method: http.MethodGet,
+					path:   "/.well-known/openid-configuration",
+					status: http.StatusOK,
+					check: func(f *flow, body []byte) {
+						var discovery models.OpenIDConfiguration
+						f.decode(body, &discovery)
+
+						if !strings.HasSuffix(discovery.TokenEndpoint, "/oauth/token") ||
+							!strings.HasSuffix(discovery.UserInfoEndpoint, "/userinfo") ||
+							!strings.HasSuffix(discovery.JWKSURI, "/.well-known/jwks.json") {
+							f.t.Fatalf("unexpected endpoints in %s", body)
+						}
+					},
+				},
+				step{
+					name:   "jwks",
+					method: http.MethodGet,
+					path:   "/.well-known/jwks.json",
+					status: http.StatusOK,
+					check: func(f *flow, body []byte) {
+						token, _, err := new(jwt.Parser).ParseUnverified(f.oauthAccess, &models.TokenClaim{})
+						if err != nil {
+							f.t.Fatal(err)
+						}
+
+						var jwks keyset.JWKS
+						f.decode(body, &jwks)
+
+						for _, key := range jwks.Keys {
+							if key.Kid == token.Header["kid"] {
+								return
+							}
+						}
+
+						f.t.Fatalf("no key %v to verify the access token in %s", token.Header["kid"], body)
+					},
+				},
+			),
+		},
+		{
+			name: "sessions",
+			steps: then(
+				step{
+					name:   "list",
+					method: http.MethodGet,
+					path:   "/me/session",
+					auth:   accessToken,
+					status: http.StatusOK,
+					check: func(f *flow, body []byte) {
+						var list models.ListSessionResponse
+						f.decode(body, &list)
+
+						if len(list.Data) != 1 || !list.Data[0].IsCurrent {
+							f.t.Fatalf("want the current session only: %s", body)
+						}
+					},
+				},
+				step{
+					name:   "refresh token",
+					method: http.MethodGet,
+					path:   "/me/session/refresh_token",
+					auth:   accessToken,
+					status: http.StatusOK,
+					check:  storeRefresh,
+				},
+				step{
+					name:   "access token from the refresh token",
+					method: http.MethodGet,
+					path:   "/me/session/access_token",
+					auth:   refreshToken,
+					status: http.StatusOK,
+					check: func(f *flow, body []byte) {
+						var session models.SessionToken
+						f.decode(body, &session)
+
+						if session.AccessToken == nil || session.RefreshToken == nil {
+							f.t.Fatalf("incomplete session: %s", body)
+						}
+
+						// keep the rotated token, the next step replays it
+						f.access = session.RefreshToken.Value
+					},
+				},
+				step{
+					name:   "replayed refresh token",
+					method: http.MethodGet,
+					path:   "/me/session/access_token",
+					auth:   refreshToken,
+					status: http.StatusBadRequest,
+				},
+				step{
+					name:   "rotated token is revoked with its family",
+					method: http.MethodGet,
+					path:   "/me/session/access_token",
+					auth:   accessToken,
+					status: http.StatusBadRequest,
+				},
+				step{
+					name:   "login again",
+					method: http.MethodPost,
+					path:   "/auth/login",
+					body:   login(testPassword),
+					status: http.StatusOK,
+					check:  storeAccess,
+				},
+				step{
+					name:   "end current session",
+					method: http.MethodDelete,
+					path:   "/me/session",
+					auth:   accessToken,
+					status: http.StatusAccepted,
+				},
+				step{
+					name:   "ended session is rejected",
+					method: http.MethodGet,
+					path:   "/me/",
+					auth:   accessToken,
+					status: http.StatusBadRequest,
+				},
+			),
+		},
+		{
+			name: "password",
+			steps: then(
+				step{
+					name:   "change with a wrong current password",
+					method: http.MethodPost,
+					path:   "/me/password",
+					auth:   accessToken,
+					body: func(f *flow) interface{} {
+						return models.ChangePassword{PasswordCurrent: "Wrong-Horse-42", Password: "Battery-Staple-7", PasswordConfirm: "Battery-Staple-7"}
+					},
+					status: http.StatusAccepted,
+					check: func(f *flow, body []byte) {
+						var res map[string]interface{}
+						f.decode(body, &res)
+
+						if res["success"] == true {
+							f.t.Fatalf("changed with a wrong password: %s", body)
+						}
+					},
+				},
+				step{
+					name:   "change",
+					method: http.MethodPost,
+					path:   "/me/password",
+					auth:   accessToken,
+					body: func(f *flow) interface{} {
+						return models.ChangePassword{PasswordCurrent: testPassword, Password: "Battery-Staple-7", PasswordConfirm: "Battery-Staple-7"}
+					},
+					status: http.StatusAccepted,
+					check: func(f *flow, body []byte) {
+						var res map[string]interface{}
+						f.decode(body, &res)
+
+						if res["success"] != true {
+							f.t.Fatalf("change failed: %s", body)
+						}
+					},
+				},
+				step{
+					name:   "login with the old password",
+					method: http.MethodPost,
+					path:   "/auth/login",
+					body:   login(testPassword),
+					status: http.StatusBadRequest,
+				},
+				step{
+					name:   "login with the new password",
+					method: http.MethodPost,
+					path:   "/auth/login",
+					body:   login("Battery-Staple-7"),
+					status: http.StatusOK,
+				},
+				step{
+					name:   "forgot",
+					method: http.MethodPost,
+					path:   "/auth/password/forgot",
+					body:   func(f *flow) interface{} { return map[string]string{"email": testEmail} },
+					status: http.StatusAccepted,
+					check: func(f *flow, body []byte) {
+						f.resetToken = f.s.mailedToken(f.t, testEmail, resetCode)
+					},
+				},
+				step{
+					name:   "reset to a previous password",
+					method: http.MethodPost,
+					path:   "/auth/password/reset",
+					body: func(f *flow) interface{} {
+						return models.ResetPass{Token: f.resetToken, Password: testPassword, PasswordConfirm: testPassword}
+					},
+					status: http.StatusBadRequest,
+				},
+				step{
+					name:   "reset",
+					method: http.MethodPost,
+					path:   "/auth/password/reset",
+					body: func(f *flow) interface{} {
+						return models.ResetPass{Token: f.resetToken, Password: "Tr0ub4dor-and-3", PasswordConfirm: "Tr0ub4dor-and-3"}
+					},
+					status: http.StatusAccepted,
+				},
+				step{
+					name:   "reset with a used token",
+					method: http.MethodPost,
+					path:   "/auth/password/reset",
+					body: func(f *flow) interface{} {
+						return models.ResetPass{Token: f.resetToken, Password: "Another-Pass-99", PasswordConfirm: "Another-Pass-99"}
+					},
+					status: http.StatusGone,
+				},
+				step{
+					name:   "login with the reset password",
+					method: http.MethodPost,
+					path:   "/auth/login",
+					body:   login("Tr0ub4dor-and-3"),
+					status: http.StatusOK,
+				},
+			),
+		},
+		{
+			name: "events",
+			steps: then(
+				step{
+					name:   "login 2",
+					method: http.MethodPost,
+					path:   "/auth/login",
+					body:   login(testPassword),
+					status: http.StatusOK,
+					check:  storeAccess,
+				},
+				step{
+					name:   "login 3",
+					method: http.MethodPost,
+					path:   "/auth/login",
+					body:   login(testPassword),
+					status: http.StatusOK,
+					check:  storeAccess,
+				},
+				step{
+					name:   "login 4",
+					method: http.MethodPost,
+					path:   "/auth/login",
+					body:   login(testPassword),
+					status: http.StatusOK,
+					check:  storeAccess,
+				},
+				step{
+					name:   "login 5",
+					method: http.MethodPost,
+					path:   "/auth/login",
+					body:   login(testPassword),
+					status: http.StatusOK,
+					check:  storeAccess,
+				},
+				loginEvents("page=1", false, 2, 5, true),
+				loginEvents("", true, 2, 5, true),
+				loginEvents("", true, 1, 5, false),
+				loginEvents("page=3", false, 1, 5, false),
+				loginEvents("page=4", false, 0, 5, false),
+				step{
+					name:   "invalid cursor",
+					method: http.MethodGet,
+					path:   "/me/events?cursor=bm90LWFuLWlk",
+					auth:   accessToken,
+					status: http.StatusBadRequest,
+				},
+			),
+		},
+		{
+			name: "change and revert email",
+			steps: then(
+				step{
+					name:   "request the change",
+					method: http.MethodPost,
+					path:   "/me/email",
+					auth:   accessToken,
+					body: func(f *flow) interface{} {
+						return map[string]string{"email": testNewEmail}
+					},
+					status: http.StatusAccepted,
+				},
+				step{
+					name:   "open the link",
+					method: http.MethodGet,
+					link:   emailedLink(testNewEmail, changeEmailLink, "/me/change-email/"),
+					status: http.StatusOK,
+					check: func(f *flow, body []byte) {
+						if !strings.Contains(string(body), `<form method="post">`) {
+							f.t.Fatalf("no confirmation form in %s", body)
+						}
+					},
+				},
+				step{
+					name:   "opening the link again keeps it usable",
+					method: http.MethodGet,
+					link:   emailedLink(testNewEmail, changeEmailLink, "/me/change-email/"),
+					status: http.StatusOK,
+				},
+				step{
+					name:   "confirm",
+					method: http.MethodPost,
+					link:   emailedLink(testNewEmail, changeEmailLink, "/me/change-email/"),
+					status: http.StatusAccepted,
+				},
+				step{
+					name:   "confirm twice",
+					method: http.MethodPost,
+					link:   emailedLink(testNewEmail, changeEmailLink, "/me/change-email/"),
+					status: http.StatusGone,
+				},
+				step{
+					name:   "used link page",
+					method: http.MethodGet,
+					link:   emailedLink(testNewEmail, changeEmailLink, "/me/change-email/"),
+					status: http.StatusGone,
+				},
+				step{
+					name:   "sessions were revoked",
+					method: http.MethodGet,
+					path:   "/me",
+					auth:   accessToken,
+					status: http.StatusBadRequest,
+				},
+				step{
+					name:   "login with the new email",
+					method: http.MethodPost,
+					path:   "/auth/login",
+					body: func(f *flow) interface{} {
+						return models.Login{Email: testNewEmail, Password: testPassword}
+					},
+					status: http.StatusOK,
+					check:  storeAccess,
+				},
+				step{
+					name:   "revert page",
+					method: http.MethodGet,
+					link:   emailedLink(testEmail, revertEmailLink, "/me/revert-email/"),
+					status: http.StatusOK,
+				},
+				step{
+					name:   "revert",
+					method: http.MethodPost,
+					link:   emailedLink(testEmail, revertEmailLink, "/me/revert-email/"),
+					status: http.StatusAccepted,
+				},
+				step{
+					name:   "revert signed out the new session",
+					method: http.MethodGet,
+					path:   "/me",
+					auth:   accessToken,
+					status: http.StatusBadRequest,
+				},
+				step{
+					name:   "login with the old email",
+					method: http.MethodPost,
+					path:   "/auth/login",
+					body:   login(testPassword),
+					status: http.StatusOK,
+				},
+			),
+		},
+		{
+			name: "profile picture",
+			steps: then(
+				step{
+					name:   "upload a file that is not a picture",
+					method: http.MethodPost,
+					path:   "/me/picture",
+					auth:   accessToken,
+					body:   func(f *flow) interface{} { return upload("not a picture") },
+					status: http.StatusBadRequest,
+				},
+				step{
+					name:   "upload a picture that is too small",
+					method: http.MethodPost,
+					path:   "/me/picture",
+					auth:   accessToken,
+					body:   pngPicture(16, 16),
+					status: http.StatusBadRequest,
+				},
+				step{
+					name:   "upload",
+					method: http.MethodPost,
+					path:   "/me/picture",
+					auth:   accessToken,
+					body:   pngPicture(96, 64),
+					status: http.StatusAccepted,
+				},
+				step{
+					name:   "profile lists the thumbnails",
+					method: http.MethodGet,
+					path:   "/me/",
+					auth:   accessToken,
+					status: http.StatusOK,
+					check: func(f *flow, body []byte) {
+						var profile models.ProfileResponse
+						f.decode(body, &profile)
+
+						f.pictures = map[string]string{}
+						for _, size := range []string{"64", "128", "512"} {
+							link, err := url.Parse(profile.Pictures[size])
+							if err != nil || link.Path == "" {
+								f.t.Fatalf("no %s thumbnail in %s", size, body)
+							}
+
+							f.pictures[size] = link.Path
+						}
+					},
+				},
+				thumbnail(64, http.StatusOK),
+				thumbnail(128, http.StatusOK),
+				thumbnail(512, http.StatusOK),
+				step{
+					name:   "delete",
+					method: http.MethodDelete,
+					path:   "/me/picture",
+					auth:   accessToken,
+					status: http.StatusAccepted,
+				},
+				step{
+					name:   "profile without a picture",
+					method: http.MethodGet,
+					path:   "/me/",
+					auth:   accessToken,
+					status: http.StatusOK,
+					check: func(f *flow, body []byte) {
+						var profile models.ProfileResponse
+						f.decode(body, &profile)
+
+						if profile.Picture != "" || len(profile.Pictures) != 0 {
+							f.t.Fatalf("picture kept after deleting: %s", body)
+						}
+					},
+				},
+				thumbnail(64, http.StatusNotFound),
+				thumbnail(512, http.StatusNotFound),
+			),
+		},
+		{
+			name: "lockout",
+			steps: then(append(failedLogins(config.Default().Attempt.MaxAccount-1),
+				step{
+					name:   "the last failure locks the account",
+					method: http.MethodPost,
+					path:   "/auth/login",
+					body:   login("Wrong-Horse-42"),
+					status: http.StatusTooManyRequests,
+					header: retryAfter,
+				},
+				step{
+					name:   "locked out with the right password",
+					method: http.MethodPost,
+					path:   "/auth/login",
+					body:   login(testPassword),
+					status: http.StatusTooManyRequests,
+					header: retryAfter,
+				},
+				step{
+					name:   "the session from before still works",
+					method: http.MethodGet,
+					path:   "/me/",
+					auth:   accessToken,
+					status: http.StatusOK,
+				},
+			)...),
+		},
+		{
+			name: "admin outbox",
+			steps: then(
+				step{
+					name:   "wrong admin token",
+					method: http.MethodGet,
+					path:   "/admin/outbox",
+					auth:   func(f *flow) string { return "Bearer wrong" },
+					status: http.StatusUnauthorized,
+				},
+				step{
+					name:   "user token",
+					method: http.MethodGet,
+					path:   "/admin/outbox",
+					auth:   accessToken,
+					status: http.StatusUnauthorized,
+				},
+				step{
+					name:   "pending emails",
+					method: http.MethodGet,
+					path:   "/admin/outbox",
+					auth:   adminToken,
+					status: http.StatusOK,
+					check: func(f *flow, body []byte) {
+						// only the fields checked, a null sent_at does not decode into helper.NullTime
+						var list struct {
+							Emails []struct {
+								ID             uint64 `json:"id"`
+								RecipientEmail string `json:"recipient_email"`
+								Status         string `json:"status"`
+							} `json:"emails"`
+						}
+						f.decode(body, &list)
+
+						for _, email := range list.Emails {
+							if email.RecipientEmail == testEmail && email.Status == models.OutboxPending {
+								f.outboxID = email.ID
+								return
+							}
+						}
+
+						f.t.Fatalf("no pending email to %s in %s", testEmail, body)
+					},
+				},
+				step{
+					name:   "dead emails",
+					method: http.MethodGet,
+					path:   "/admin/outbox?status=dead",
+					auth:   adminToken,
+					status: http.StatusOK,
+					check: func(f *flow, body []byte) {
+						var list models.ListOutboxResponse
+						f.decode(body, &list)
+
+						if list.Total != 0 || len(list.Emails) != 0 {
+							f.t.Fatalf("dead emails %s", body)
+						}
+					},
+				},
+				step{
+					name:   "unknown status",
+					method: http.MethodGet,
+					path:   "/admin/outbox?status=lost",
+					auth:   adminToken,
+					status: http.StatusBadRequest,
+				},
+				step{
+					name:   "retry an email that is not dead",
+					method: http.MethodPost,
+					link:   func(f *flow) string { return "/admin/outbox/" + strconv.FormatUint(f.outboxID, 10) + "/retry" },
+					auth:   adminToken,
+					status: http.StatusNotFound,
+				},
+				step{
+					name:   "retry an invalid id",
+					method: http.MethodPost,
+					path:   "/admin/outbox/first/retry",
+					auth:   adminToken,
+					status: http.StatusBadRequest,
+				},
+			),
+		},
+	}
+
+	for _, backend := range backends {
+		for _, tt := range tests {
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				f := &flow{s: newTestServer(t, backend.new(t)), t: t}
+				f.run(tt.steps)
+			})
+		}
+	}
+}
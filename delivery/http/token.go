@@ -1,18 +1,18 @@
 package http
 
 import (
-	"context"
 	"net/http"
 
 	"github.com/g-graziano/user-auth-golang/helper"
+	"github.com/g-graziano/user-auth-golang/keyset"
 	"github.com/g-graziano/user-auth-golang/models"
 	"github.com/g-graziano/user-auth-golang/service/token"
 	json "github.com/json-iterator/go"
 )
 
-func HandleVerifyTfa(ctx context.Context, tkn token.Token) http.HandlerFunc {
+func HandleVerifyTfa(tkn token.Token) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		xid := r.Header.Get("xid")
+		xid := helper.XID(r.Context())
 
 		var otpRequest *models.OTPRequest
 
@@ -24,7 +24,7 @@ func HandleVerifyTfa(ctx context.Context, tkn token.Token) http.HandlerFunc {
 
 		otpRequest.XID = xid
 
-		err := helper.GetReqHeader(&ctx, r)
+		ctx, err := helper.GetReqHeader(r)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -32,6 +32,10 @@ func HandleVerifyTfa(ctx context.Context, tkn token.Token) http.HandlerFunc {
 		}
 
 		verified, err := tkn.VerifyTfa(ctx, otpRequest)
+		if writeTooManyAttempts(w, r, err) {
+			return
+		}
+
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			helper.Response(w, helper.Message(false, "Invalid Request"))
@@ -49,3 +53,18 @@ func HandleVerifyTfa(ctx context.Context, tkn token.Token) http.HandlerFunc {
 		return
 	}
 }
+
+func HandleJWKS(keys keyset.KeySet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bs, err := json.ConfigFastest.Marshal(keys.JWKS())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.Write(bs)
+	}
+}
@@ -2,12 +2,14 @@ package http
 
 import (
 	"bytes"
-	"context"
-	"image"
+	"errors"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/g-graziano/user-auth-golang/avatar"
 	"github.com/g-graziano/user-auth-golang/helper"
 	"github.com/g-graziano/user-auth-golang/models"
 	"github.com/g-graziano/user-auth-golang/service/user"
@@ -25,7 +27,7 @@ func HandleUserRegister(user user.User) http.HandlerFunc {
 			return
 		}
 
-		err := user.Register(newUser)
+		err := user.Register(r.Context(), newUser)
 		if err != nil {
 			w.WriteHeader(http.StatusAccepted)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -43,14 +45,10 @@ func HandleUserRegister(user user.User) http.HandlerFunc {
 
 func HandleEmailVerification(user user.User) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		xid := chi.URLParam(r, "xid")
-
-		err := user.VerifyEmail(&models.User{XID: xid})
-		if err != nil {
-			w.WriteHeader(http.StatusAccepted)
-			helper.Response(w, helper.ErrorMessage(0, err.Error()))
-			log.Printf("error %q: %v", r.RequestURI, err.Error())
+		token := chi.URLParam(r, "token")
 
+		err := user.VerifyEmail(r.Context(), token)
+		if writeTokenError(w, r, err) {
 			return
 		}
 
@@ -72,7 +70,11 @@ func HandleRequestEmailVerification(user user.User) http.HandlerFunc {
 		}
 
 		if input.Type == "email" {
-			err := user.ResendEmailValidation(&models.User{Email: input.Recipient})
+			err := user.ResendEmailValidation(r.Context(), &models.User{Email: input.Recipient})
+
+			if writeTooManyAttempts(w, r, err) {
+				return
+			}
 
 			if err != nil {
 				w.WriteHeader(http.StatusAccepted)
@@ -91,7 +93,7 @@ func HandleRequestEmailVerification(user user.User) http.HandlerFunc {
 	}
 }
 
-func HandleLogin(ctx context.Context, user user.User) http.HandlerFunc {
+func HandleLogin(user user.User) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var loginUser *models.Login
 		if err := json.NewDecoder(r.Body).Decode(&loginUser); err != nil {
@@ -101,7 +103,7 @@ func HandleLogin(ctx context.Context, user user.User) http.HandlerFunc {
 			return
 		}
 
-		err := helper.GetReqHeader(&ctx, r)
+		ctx, err := helper.GetReqHeader(r)
 
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
@@ -111,6 +113,10 @@ func HandleLogin(ctx context.Context, user user.User) http.HandlerFunc {
 		}
 
 		login, err := user.Login(ctx, loginUser)
+		if writeTooManyAttempts(w, r, err) {
+			return
+		}
+
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -132,9 +138,9 @@ func HandleLogin(ctx context.Context, user user.User) http.HandlerFunc {
 
 func HandleLogout(user user.User) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		xid := r.Header.Get("xid")
+		xid := helper.XID(r.Context())
 
-		err := user.Logout(&models.User{XID: xid})
+		err := user.Logout(r.Context(), &models.User{XID: xid})
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -159,7 +165,11 @@ func HandleForgotPassword(user user.User) http.HandlerFunc {
 			return
 		}
 
-		err := user.ForgotPassword(forgotUser)
+		err := user.ForgotPassword(r.Context(), forgotUser)
+		if writeTooManyAttempts(w, r, err) {
+			return
+		}
+
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -174,9 +184,9 @@ func HandleForgotPassword(user user.User) http.HandlerFunc {
 	}
 }
 
-func HandleRequestChangePassword(user user.User) http.HandlerFunc {
+func HandleRequestChangeEmail(user user.User) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		xid := r.Header.Get("xid")
+		xid := helper.XID(r.Context())
 
 		var changeUser *models.User
 		if err := json.NewDecoder(r.Body).Decode(&changeUser); err != nil {
@@ -188,7 +198,11 @@ func HandleRequestChangePassword(user user.User) http.HandlerFunc {
 
 		changeUser.XID = xid
 
-		err := user.RequestChangePassword(changeUser)
+		err := user.RequestChangeEmail(r.Context(), changeUser)
+		if writeTooManyAttempts(w, r, err) {
+			return
+		}
+
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -203,6 +217,42 @@ func HandleRequestChangePassword(user user.User) http.HandlerFunc {
 	}
 }
 
+func HandleConfirmChangeEmail(user user.User) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := chi.URLParam(r, "token")
+
+		ctx := helper.GetReqInfo(r)
+
+		err := user.ConfirmChangeEmail(ctx, token)
+		if writeTokenError(w, r, err) {
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		helper.Response(w, helper.Message(true, "Email Changed!"))
+
+		return
+	}
+}
+
+func HandleRevertEmail(user user.User) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := chi.URLParam(r, "token")
+
+		ctx := helper.GetReqInfo(r)
+
+		err := user.RevertEmail(ctx, token)
+		if writeTokenError(w, r, err) {
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		helper.Response(w, helper.Message(true, "Email Restored!"))
+
+		return
+	}
+}
+
 func HandleResetPassword(user user.User) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var resetPass *models.ResetPass
@@ -213,7 +263,7 @@ func HandleResetPassword(user user.User) http.HandlerFunc {
 			return
 		}
 
-		err := user.ResetPassword(resetPass)
+		ctx, err := helper.GetReqHeader(r)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -221,6 +271,11 @@ func HandleResetPassword(user user.User) http.HandlerFunc {
 			return
 		}
 
+		err = user.ResetPassword(ctx, resetPass)
+		if writeTokenError(w, r, err) {
+			return
+		}
+
 		w.WriteHeader(http.StatusAccepted)
 		helper.Response(w, helper.Message(true, "Reset Password Success!"))
 
@@ -230,9 +285,9 @@ func HandleResetPassword(user user.User) http.HandlerFunc {
 
 func HandleGetUserProfile(user user.User) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		xid := r.Header.Get("xid")
+		xid := helper.XID(r.Context())
 
-		profile, err := user.GetUserProfile(&models.User{XID: xid})
+		profile, err := user.GetUserProfile(r.Context(), &models.User{XID: xid})
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -256,9 +311,9 @@ func HandleGetUserProfile(user user.User) http.HandlerFunc {
 
 func HandleGetTfaStatus(user user.User) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		xid := r.Header.Get("xid")
+		xid := helper.XID(r.Context())
 
-		profile, err := user.GetUserTfaStatus(&models.User{XID: xid})
+		profile, err := user.GetUserTfaStatus(r.Context(), &models.User{XID: xid})
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -280,11 +335,11 @@ func HandleGetTfaStatus(user user.User) http.HandlerFunc {
 	}
 }
 
-func HandleGetRefreshToken(ctx context.Context, user user.User) http.HandlerFunc {
+func HandleGetRefreshToken(user user.User) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		xid := r.Header.Get("xid")
+		xid := helper.XID(r.Context())
 
-		err := helper.GetReqHeader(&ctx, r)
+		ctx, err := helper.GetReqHeader(r)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -314,12 +369,12 @@ func HandleGetRefreshToken(ctx context.Context, user user.User) http.HandlerFunc
 	}
 }
 
-func HandleGetNewAccessToken(ctx context.Context, user user.User) http.HandlerFunc {
+func HandleGetNewAccessToken(user user.User) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		xid := r.Header.Get("xid")
-		refreshToken := r.Header.Get("token")
+		xid := helper.XID(r.Context())
+		refreshToken := helper.Token(r.Context())
 
-		err := helper.GetReqHeader(&ctx, r)
+		ctx, err := helper.GetReqHeader(r)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -351,10 +406,10 @@ func HandleGetNewAccessToken(ctx context.Context, user user.User) http.HandlerFu
 
 func HandleDeleteOtherSession(user user.User) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		xid := r.Header.Get("xid")
-		currentToken := r.Header.Get("token")
+		xid := helper.XID(r.Context())
+		currentToken := helper.Token(r.Context())
 
-		err := user.DeleteOtherSession(&models.AccessTokenRequest{XID: xid, RefreshToken: currentToken})
+		err := user.DeleteOtherSession(r.Context(), &models.AccessTokenRequest{XID: xid, RefreshToken: currentToken})
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -371,9 +426,9 @@ func HandleDeleteOtherSession(user user.User) http.HandlerFunc {
 
 func HandleEndCurrentSession(user user.User) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		currentToken := r.Header.Get("token")
+		currentToken := helper.Token(r.Context())
 
-		err := user.DeleteCurrentSession(&models.UserToken{Token: currentToken})
+		err := user.DeleteCurrentSession(r.Context(), &models.UserToken{Token: currentToken})
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -390,9 +445,9 @@ func HandleEndCurrentSession(user user.User) http.HandlerFunc {
 
 func HandleGetUserEmail(user user.User) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		xid := r.Header.Get("xid")
+		xid := helper.XID(r.Context())
 
-		email, err := user.GetUserEmail(&models.User{XID: xid})
+		email, err := user.GetUserEmail(r.Context(), &models.User{XID: xid})
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -416,9 +471,18 @@ func HandleGetUserEmail(user user.User) http.HandlerFunc {
 
 func HandleGetListEvent(user user.User) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		xid := r.Header.Get("xid")
+		xid := helper.XID(r.Context())
 
-		listEvent, err := user.GetListEvent(&models.User{XID: xid})
+		filter, err := eventFilterFromQuery(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			return
+		}
+
+		filter.XID = xid
+
+		listEvent, err := user.GetListEvent(r.Context(), filter)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -442,7 +506,7 @@ func HandleGetListEvent(user user.User) http.HandlerFunc {
 
 func HandleUpdateUserProfile(user user.User) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		xid := r.Header.Get("xid")
+		xid := helper.XID(r.Context())
 
 		var update *models.User
 		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
@@ -454,7 +518,7 @@ func HandleUpdateUserProfile(user user.User) http.HandlerFunc {
 
 		update.XID = xid
 
-		err := user.UpdateUserProfile(update)
+		err := user.UpdateUserProfile(r.Context(), update)
 		if err != nil {
 			w.WriteHeader(http.StatusAccepted)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -472,7 +536,7 @@ func HandleUpdateUserProfile(user user.User) http.HandlerFunc {
 
 func HandleActivateTfa(user user.User) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		xid := r.Header.Get("xid")
+		xid := helper.XID(r.Context())
 
 		var secret *models.ActivateTfaRequest
 		if err := json.NewDecoder(r.Body).Decode(&secret); err != nil {
@@ -484,7 +548,7 @@ func HandleActivateTfa(user user.User) http.HandlerFunc {
 
 		secret.XID = xid
 
-		codes, err := user.ActivateTfa(secret)
+		codes, err := user.ActivateTfa(r.Context(), secret)
 		if err != nil {
 			w.WriteHeader(http.StatusAccepted)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -509,7 +573,7 @@ func HandleActivateTfa(user user.User) http.HandlerFunc {
 
 func HandleUpdatePassword(user user.User) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		xid := r.Header.Get("xid")
+		xid := helper.XID(r.Context())
 
 		var update *models.ChangePassword
 		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
@@ -521,7 +585,7 @@ func HandleUpdatePassword(user user.User) http.HandlerFunc {
 
 		update.XID = xid
 
-		err := user.UpdateUserPassword(update)
+		err := user.UpdateUserPassword(r.Context(), update)
 		if err != nil {
 			w.WriteHeader(http.StatusAccepted)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -539,12 +603,12 @@ func HandleUpdatePassword(user user.User) http.HandlerFunc {
 
 func HandleTfaEnroll(user user.User) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		xid := r.Header.Get("xid")
+		xid := helper.XID(r.Context())
 
 		var currentUser models.User
 		currentUser.XID = xid
 
-		secretCode, err := user.EnrollTfa(&currentUser)
+		secretCode, err := user.EnrollTfa(r.Context(), &currentUser)
 
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
@@ -568,11 +632,11 @@ func HandleTfaEnroll(user user.User) http.HandlerFunc {
 	}
 }
 
-func HandleSetProfilePicture(user user.User) http.HandlerFunc {
+func HandleSetProfilePicture(user user.User, maxSize int64) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		r.Body = http.MaxBytesReader(w, r.Body, 200000) //200 Kb
+		r.Body = http.MaxBytesReader(w, r.Body, maxSize)
 
-		if err := r.ParseMultipartForm(200000); err != nil {
+		if err := r.ParseMultipartForm(maxSize); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
 			log.Printf("error %q: %v", r.RequestURI, err.Error())
@@ -580,10 +644,10 @@ func HandleSetProfilePicture(user user.User) http.HandlerFunc {
 			return
 		}
 
-		xid := r.Header.Get("xid")
+		xid := helper.XID(r.Context())
 
 		data := &models.UploadProfile{}
-		f, h, err := r.FormFile("file")
+		f, _, err := r.FormFile("file")
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -592,34 +656,32 @@ func HandleSetProfilePicture(user user.User) http.HandlerFunc {
 		}
 		defer f.Close()
 
-		// get image dimension
-		img, _, _ := image.DecodeConfig(f)
-
-		defer f.Close()
-		fopen, _ := h.Open()
-		defer fopen.Close()
 		content := bytes.NewBuffer(nil)
-		if _, err := io.Copy(content, fopen); err != nil {
+		if _, err := io.Copy(content, f); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
 			log.Printf("error %q: %v", r.RequestURI, err.Error())
 			return
 		}
 
-		if http.DetectContentType(content.Bytes()) != "image/jpeg" {
+		data.ContentType = http.DetectContentType(content.Bytes())
+		if _, ok := avatar.ContentTypes[data.ContentType]; !ok {
 			w.WriteHeader(http.StatusBadRequest)
-			helper.Response(w, helper.ErrorMessage(0, "image must jpeg type"))
+			helper.Response(w, helper.ErrorMessage(0, avatar.ErrUnsupported.Error()))
 			return
 		}
 
 		data.File = content
-		data.ContentType = http.DetectContentType(content.Bytes())
 		data.Size = int64(content.Len())
-		data.Width = int64(img.Width)
-		data.Height = int64(img.Height)
 		data.UserXID = xid
 
-		err = user.UpdateUserPicture(data)
+		err = user.UpdateUserPicture(r.Context(), data)
+		if err == avatar.ErrUnsupported || err == avatar.ErrTooLarge || err == avatar.ErrTooSmall {
+			w.WriteHeader(http.StatusBadRequest)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			return
+		}
+
 		if err != nil {
 			w.WriteHeader(http.StatusAccepted)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -637,9 +699,9 @@ func HandleSetProfilePicture(user user.User) http.HandlerFunc {
 
 func HandleDeleteProfilePicture(user user.User) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		xid := r.Header.Get("xid")
+		xid := helper.XID(r.Context())
 
-		err := user.DeleteProfilePicture(&models.User{XID: xid})
+		err := user.DeleteProfilePicture(r.Context(), &models.User{XID: xid})
 		if err != nil {
 			w.WriteHeader(http.StatusAccepted)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -657,7 +719,7 @@ func HandleDeleteProfilePicture(user user.User) http.HandlerFunc {
 
 func HandleDeleteUser(user user.User) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		xid := r.Header.Get("xid")
+		xid := helper.XID(r.Context())
 
 		var delete *models.User
 		if err := json.NewDecoder(r.Body).Decode(&delete); err != nil {
@@ -669,7 +731,7 @@ func HandleDeleteUser(user user.User) http.HandlerFunc {
 
 		delete.XID = xid
 
-		err := user.DeleteUser(delete)
+		err := user.DeleteUser(r.Context(), delete)
 		if err != nil {
 			w.WriteHeader(http.StatusAccepted)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -687,7 +749,7 @@ func HandleDeleteUser(user user.User) http.HandlerFunc {
 
 func HandleRemoveTfa(user user.User) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		xid := r.Header.Get("xid")
+		xid := helper.XID(r.Context())
 
 		var currentUser *models.User
 		if err := json.NewDecoder(r.Body).Decode(&currentUser); err != nil {
@@ -699,7 +761,7 @@ func HandleRemoveTfa(user user.User) http.HandlerFunc {
 
 		currentUser.XID = xid
 
-		err := user.RemoveTfa(currentUser)
+		err := user.RemoveTfa(r.Context(), currentUser)
 		if err != nil {
 			w.WriteHeader(http.StatusAccepted)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -715,9 +777,79 @@ func HandleRemoveTfa(user user.User) http.HandlerFunc {
 	}
 }
 
-func HandleByPassTfa(ctx context.Context, user user.User) http.HandlerFunc {
+func HandleGetBackupCodesStatus(user user.User) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		xid := r.Header.Get("xid")
+		xid := helper.XID(r.Context())
+
+		status, err := user.GetBackupCodesStatus(r.Context(), &models.User{XID: xid})
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			log.Printf("error %q: %v", r.RequestURI, err.Error())
+			return
+		}
+
+		bs, err := json.ConfigFastest.Marshal(status)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			log.Printf("error %q: %v", r.RequestURI, err.Error())
+			return
+		}
+
+		w.Write(bs)
+
+		return
+	}
+}
+
+func HandleRegenerateBackupCodes(user user.User) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		xid := helper.XID(r.Context())
+
+		var currentUser *models.User
+		if err := json.NewDecoder(r.Body).Decode(&currentUser); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			log.Printf("error %q: %v", r.RequestURI, err.Error())
+			return
+		}
+
+		ctx, err := helper.GetReqHeader(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			log.Printf("error %q: %v", r.RequestURI, err.Error())
+			return
+		}
+
+		currentUser.XID = xid
+
+		codes, err := user.RegenerateBackupCodes(ctx, currentUser)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			log.Printf("error %q: %v", r.RequestURI, err.Error())
+			return
+		}
+
+		bs, err := json.ConfigFastest.Marshal(codes)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			helper.Response(w, helper.ErrorMessage(0, err.Error()))
+			log.Printf("error %q: %v", r.RequestURI, err.Error())
+			return
+		}
+
+		w.Write(bs)
+
+		return
+	}
+}
+
+func HandleByPassTfa(user user.User) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		xid := helper.XID(r.Context())
 
 		var currentUser *models.OTPRequest
 
@@ -730,7 +862,7 @@ func HandleByPassTfa(ctx context.Context, user user.User) http.HandlerFunc {
 
 		currentUser.XID = xid
 
-		err := helper.GetReqHeader(&ctx, r)
+		ctx, err := helper.GetReqHeader(r)
 		if err != nil {
 			w.WriteHeader(http.StatusUnauthorized)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -739,6 +871,10 @@ func HandleByPassTfa(ctx context.Context, user user.User) http.HandlerFunc {
 		}
 
 		byPass, err := user.ByPassTfa(ctx, currentUser)
+		if writeTooManyAttempts(w, r, err) {
+			return
+		}
+
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -760,12 +896,12 @@ func HandleByPassTfa(ctx context.Context, user user.User) http.HandlerFunc {
 
 func HandleGetListSession(user user.User) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		xid := r.Header.Get("xid")
-		token := r.Header.Get("token")
+		xid := helper.XID(r.Context())
+		token := helper.Token(r.Context())
 
 		listSessionRequest := &models.ListSessionRequest{Token: token, XID: xid}
 
-		listSession, err := user.GetListSession(listSessionRequest)
+		listSession, err := user.GetListSession(r.Context(), listSessionRequest)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			helper.Response(w, helper.ErrorMessage(0, err.Error()))
@@ -784,3 +920,101 @@ func HandleGetListSession(user user.User) http.HandlerFunc {
 		return
 	}
 }
+
+// eventFilterFromQuery reads the /me/events filters. Dates are RFC 3339 or
+// plain days, a plain to day includes the whole day.
+func eventFilterFromQuery(r *http.Request) (*models.EventFilter, error) {
+	query := r.URL.Query()
+	filter := &models.EventFilter{
+		Event:  query.Get("event"),
+		Cursor: query.Get("cursor"),
+	}
+
+	var err error
+
+	if value := query.Get("page"); value != "" {
+		if filter.Page, err = strconv.Atoi(value); err != nil {
+			return nil, errors.New("page must be a number")
+		}
+	}
+
+	if value := query.Get("per_page"); value != "" {
+		if filter.PerPage, err = strconv.Atoi(value); err != nil {
+			return nil, errors.New("per_page must be a number")
+		}
+	}
+
+	if value := query.Get("client_id"); value != "" {
+		if filter.ClientID, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return nil, errors.New("client_id must be a number")
+		}
+	}
+
+	if value := query.Get("from"); value != "" {
+		if filter.From, _, err = parseQueryTime(value); err != nil {
+			return nil, errors.New("from must be a date")
+		}
+	}
+
+	if value := query.Get("to"); value != "" {
+		var day bool
+		if filter.To, day, err = parseQueryTime(value); err != nil {
+			return nil, errors.New("to must be a date")
+		}
+
+		if day {
+			filter.To = filter.To.AddDate(0, 0, 1)
+		}
+	}
+
+	return filter, nil
+}
+
+func parseQueryTime(value string) (time.Time, bool, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, true, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+
+	return t, false, err
+}
+
+// writeTooManyAttempts answers 429 with a Retry-After header when err is a lockout
+func writeTooManyAttempts(w http.ResponseWriter, r *http.Request, err error) bool {
+	var tooMany *models.TooManyAttemptsError
+	if !errors.As(err, &tooMany) {
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.FormatInt(tooMany.RetryAfterSeconds(), 10))
+	w.WriteHeader(http.StatusTooManyRequests)
+	helper.Response(w, helper.ErrorMessage(0, err.Error()))
+	log.Printf("error %q: %v", r.RequestURI, err.Error())
+
+	return true
+}
+
+// tokenErrorStatus is 410 for expired and used emailed tokens, so clients can
+// offer to send a new link
+func tokenErrorStatus(err error) int {
+	switch err {
+	case models.ErrTokenExpired, models.ErrTokenUsed:
+		return http.StatusGone
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// writeTokenError answers requests made with an emailed token
+func writeTokenError(w http.ResponseWriter, r *http.Request, err error) bool {
+	if err == nil {
+		return false
+	}
+
+	w.WriteHeader(tokenErrorStatus(err))
+	helper.Response(w, helper.ErrorMessage(0, err.Error()))
+	log.Printf("error %q: %v", r.RequestURI, err.Error())
+
+	return true
+}
@@ -0,0 +1,156 @@
+package emails
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/g-graziano/user-auth-golang/models"
+)
+
+// Templates
+const (
+	VerifyEmail   = "verify_email"
+	ChangeEmail   = "change_email"
+	EmailChanged  = "email_changed"
+	ResetPassword = "reset_password"
+)
+
+// DefaultLocale is used when a user has no locale or a template is missing in theirs
+const DefaultLocale = "en"
+
+// Locales the built in templates are translated to
+var Locales = []string{"en", "id"}
+
+//go:embed templates
+var builtin embed.FS
+
+// Renderer turns a named template into an email for the recipient's locale.
+//
+// A template directory holds layout.html and layout.txt shared by every
+// message and one directory per locale with <name>.html and <name>.txt. The
+// text template defines "subject" and "body", the html one defines "body".
+type Renderer interface {
+	Render(email *models.Email, name string, locale string, data *Data) error
+}
+
+// Data is what the templates can refer to
+type Data struct {
+	AppName  string
+	Name     string
+	URL      string
+	Token    string
+	NewEmail string
+}
+
+type set struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+type renderer struct {
+	appName string
+	sets    map[string]set // locale/name
+}
+
+// New parses the templates in dir, or the built in ones when dir is empty
+func New(dir string, appName string) (Renderer, error) {
+	fsys, err := fs.Sub(builtin, "templates")
+	if err != nil {
+		return nil, err
+	}
+
+	if dir != "" {
+		fsys = os.DirFS(dir)
+	}
+
+	r := &renderer{appName: appName, sets: map[string]set{}}
+
+	locales, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, locale := range locales {
+		if !locale.IsDir() {
+			continue
+		}
+
+		files, err := fs.Glob(fsys, locale.Name()+"/*.txt")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			name := strings.TrimSuffix(file[len(locale.Name())+1:], ".txt")
+
+			text, err := texttemplate.ParseFS(fsys, "layout.txt", file)
+			if err != nil {
+				return nil, err
+			}
+
+			html, err := htmltemplate.ParseFS(fsys, "layout.html", locale.Name()+"/"+name+".html")
+			if err != nil {
+				return nil, err
+			}
+
+			r.sets[locale.Name()+"/"+name] = set{html: html, text: text}
+		}
+	}
+
+	if len(r.sets) == 0 {
+		return nil, errors.New("no email templates found")
+	}
+
+	return r, nil
+}
+
+func (r *renderer) Render(email *models.Email, name string, locale string, data *Data) error {
+	tpl, ok := r.sets[locale+"/"+name]
+	if !ok {
+		tpl, ok = r.sets[DefaultLocale+"/"+name]
+	}
+
+	if !ok {
+		return fmt.Errorf("email template %q not found", name)
+	}
+
+	data.AppName = r.appName
+
+	var subject, text, html bytes.Buffer
+
+	if err := tpl.text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return err
+	}
+
+	if err := tpl.text.ExecuteTemplate(&text, "layout.txt", data); err != nil {
+		return err
+	}
+
+	if err := tpl.html.ExecuteTemplate(&html, "layout.html", data); err != nil {
+		return err
+	}
+
+	email.Subject = strings.TrimSpace(subject.String())
+	email.PlainContent = text.String()
+	email.HTMLContent = html.String()
+
+	return nil
+}
+
+// SupportedLocale reports whether the built in templates cover locale
+func SupportedLocale(locale string) bool {
+	for _, each := range Locales {
+		if each == locale {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,6 +1,6 @@
 module github.com/g-graziano/user-auth-golang
 
-go 1.13
+go 1.16
 
 require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
@@ -8,19 +8,21 @@ require (
 	github.com/go-chi/cors v1.0.0
 	github.com/go-playground/universal-translator v0.17.0 // indirect
 	github.com/go-playground/validator v9.31.0+incompatible
-	github.com/go-redis/redis v6.15.7+incompatible
-	github.com/go-redis/redis/v7 v7.0.0-beta.6 // indirect
+	github.com/go-redis/redis/v8 v8.11.4
 	github.com/gorilla/handlers v1.4.2
 	github.com/gorilla/mux v1.7.3
-	github.com/jinzhu/gorm v1.9.12
 	github.com/joho/godotenv v1.3.0
-	github.com/json-iterator/go v1.1.9
+	github.com/json-iterator/go v1.1.12
 	github.com/leodido/go-urn v1.2.0 // indirect
+	github.com/lib/pq v1.1.1
+	github.com/mattn/go-sqlite3 v1.14.8
 	github.com/rs/xid v1.2.1
 	github.com/sendgrid/rest v2.4.1+incompatible // indirect
 	github.com/sendgrid/sendgrid-go v3.5.0+incompatible
 	github.com/skip2/go-qrcode v0.0.0-20191027152451-9434209cb086
 	github.com/spf13/viper v1.6.2 // indirect
-	golang.org/x/crypto v0.0.0-20191205180655-e7c4368fe9dd
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/image v0.0.0-20201208152932-35266b937fa6
 	gopkg.in/go-playground/assert.v1 v1.2.1 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
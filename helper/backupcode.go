@@ -0,0 +1,38 @@
+package helper
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"strings"
+)
+
+// backup codes avoid characters that are easily confused when copied by hand
+const backupCodeAlphabet = "23456789abcdefghjkmnpqrstuvwxyz"
+
+// GenerateBackupCode returns a random code formatted as xxxxx-xxxxx
+func GenerateBackupCode() (string, error) {
+	code := make([]byte, 10)
+	max := big.NewInt(int64(len(backupCodeAlphabet)))
+
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+
+		code[i] = backupCodeAlphabet[n.Int64()]
+	}
+
+	return string(code[:5]) + "-" + string(code[5:]), nil
+}
+
+// HashBackupCode normalizes a code as typed by the user and returns its sha256 hex digest,
+// the codes carry enough entropy that a fast hash is sufficient
+func HashBackupCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+
+	return hex.EncodeToString(sum[:])
+}
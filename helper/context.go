@@ -0,0 +1,115 @@
+package helper
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// contextKey is unexported so no other package can collide with the request
+// info stored here
+type contextKey int
+
+const (
+	clientIDKey contextKey = iota
+	ipAddressKey
+	userAgentKey
+	xidKey
+	tokenKey
+	scopeKey
+	authTimeKey
+)
+
+// GetReqHeader returns the request's context carrying the API client stored by
+// the authentication middleware along with the caller info of GetReqInfo
+func GetReqHeader(r *http.Request) (context.Context, error) {
+	if _, ok := ClientID(r.Context()); !ok {
+		return nil, errors.New("client id not found")
+	}
+
+	return GetReqInfo(r), nil
+}
+
+// GetReqInfo returns the request's context carrying the caller's address and
+// user agent, for requests that don't come through an API client such as links
+// opened from an email. The address is the one WithIPAddress stored, or else
+// the host of the connection.
+func GetReqInfo(r *http.Request) context.Context {
+	ctx := r.Context()
+
+	if _, ok := ctx.Value(ipAddressKey).(string); !ok {
+		ctx = WithIPAddress(ctx, ClientIP(r, nil))
+	}
+
+	return context.WithValue(ctx, userAgentKey, r.Header.Get("User-Agent"))
+}
+
+// WithIPAddress stores the caller's address, as resolved from the trusted
+// proxies by ClientIP
+func WithIPAddress(ctx context.Context, ipAddress string) context.Context {
+	return context.WithValue(ctx, ipAddressKey, ipAddress)
+}
+
+func WithClientID(ctx context.Context, clientID uint64) context.Context {
+	return context.WithValue(ctx, clientIDKey, clientID)
+}
+
+// ClientID returns the API client the request came through, ok is false when
+// there was none
+func ClientID(ctx context.Context) (clientID uint64, ok bool) {
+	clientID, ok = ctx.Value(clientIDKey).(uint64)
+	return clientID, ok
+}
+
+// WithAuth stores the user and the bearer token the request was authenticated
+// with
+func WithAuth(ctx context.Context, xid string, token string) context.Context {
+	ctx = context.WithValue(ctx, xidKey, xid)
+	return context.WithValue(ctx, tokenKey, token)
+}
+
+// XID returns the authenticated user, empty when the request wasn't
+// authenticated
+func XID(ctx context.Context) string {
+	xid, _ := ctx.Value(xidKey).(string)
+	return xid
+}
+
+// Token returns the bearer token the request was authenticated with
+func Token(ctx context.Context) string {
+	token, _ := ctx.Value(tokenKey).(string)
+	return token
+}
+
+// WithAuthTime stores when the user signed in, the issue time of the login
+// token the request was authenticated with
+func WithAuthTime(ctx context.Context, authTime time.Time) context.Context {
+	return context.WithValue(ctx, authTimeKey, authTime)
+}
+
+func AuthTime(ctx context.Context) time.Time {
+	authTime, _ := ctx.Value(authTimeKey).(time.Time)
+	return authTime
+}
+
+func WithScope(ctx context.Context, scope string) context.Context {
+	return context.WithValue(ctx, scopeKey, scope)
+}
+
+// Scope returns the space separated scopes granted to the OAuth access token
+// the request was authenticated with
+func Scope(ctx context.Context) string {
+	scope, _ := ctx.Value(scopeKey).(string)
+	return scope
+}
+
+func IPAddress(ctx context.Context) string {
+	ipAddress, _ := ctx.Value(ipAddressKey).(string)
+	return ipAddress
+}
+
+func UserAgent(ctx context.Context) string {
+	userAgent, _ := ctx.Value(userAgentKey).(string)
+	return userAgent
+}
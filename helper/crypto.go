@@ -0,0 +1,85 @@
+package helper
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+)
+
+// EncryptString seals plaintext with AES-256-GCM using a key derived from passphrase
+func EncryptString(passphrase string, plaintext string) (string, error) {
+	gcm, err := newGCM(passphrase)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptString opens a value produced by EncryptString
+func DecryptString(passphrase string, ciphertext string) (string, error) {
+	gcm, err := newGCM(passphrase)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+func newGCM(passphrase string) (cipher.AEAD, error) {
+	if passphrase == "" {
+		return nil, errors.New("encryption key is not configured")
+	}
+
+	key := sha256.Sum256([]byte(passphrase))
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// GenerateURLToken returns 32 random bytes encoded for use in a URL
+func GenerateURLToken() (string, error) {
+	token := make([]byte, 32)
+
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// HashToken returns the sha256 hex digest under which a random token is stored
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,87 @@
+package helper
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseTrustedProxies parses the CIDRs of the proxies whose X-Forwarded-For is
+// believed, a single address stands for itself
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+// ClientIP returns the address of the host that made r. X-Forwarded-For is only
+// read when the connection comes from a trusted proxy, then the right-most hop
+// that isn't a trusted proxy is the client, the hops left of it can be forged.
+func ClientIP(r *http.Request, trusted []*net.IPNet) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	if !isTrusted(ip, trusted) {
+		return ip
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			// a malformed hop was not written by a trusted proxy
+			return ip
+		}
+
+		ip = hop
+
+		if !isTrusted(hop, trusted) {
+			return hop
+		}
+	}
+
+	return ip
+}
+
+func isTrusted(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, ipNet := range trusted {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
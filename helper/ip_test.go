@@ -0,0 +1,44 @@
+package helper
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{name: "direct", remoteAddr: "198.51.100.7:1234", want: "198.51.100.7"},
+		{name: "forged by an untrusted client", remoteAddr: "198.51.100.7:1234", forwarded: []string{"203.0.113.9"}, want: "198.51.100.7"},
+		{name: "trusted proxy", remoteAddr: "192.0.2.1:1234", forwarded: []string{"203.0.113.9"}, want: "203.0.113.9"},
+		{name: "right-most untrusted hop", remoteAddr: "10.0.0.2:1234", forwarded: []string{"1.1.1.1, 203.0.113.9, 10.0.0.3"}, want: "203.0.113.9"},
+		{name: "hops over several headers", remoteAddr: "10.0.0.2:1234", forwarded: []string{"1.1.1.1", "203.0.113.9"}, want: "203.0.113.9"},
+		{name: "only trusted hops", remoteAddr: "10.0.0.2:1234", forwarded: []string{"10.0.0.4, 10.0.0.3"}, want: "10.0.0.4"},
+		{name: "malformed hop", remoteAddr: "10.0.0.2:1234", forwarded: []string{"1.1.1.1, bogus"}, want: "10.0.0.2"},
+		{name: "trusted proxy without header", remoteAddr: "10.0.0.2:1234", want: "10.0.0.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+
+			for _, header := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+
+			if got := ClientIP(r, trusted); got != tt.want {
+				t.Fatalf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
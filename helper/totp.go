@@ -0,0 +1,100 @@
+package helper
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters as used by Google Authenticator and most other apps (RFC 6238 defaults)
+const (
+	TOTPDigits = 6
+	TOTPPeriod = 30
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a random 160 bit secret encoded as unpadded base32
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPProvisioningURI builds the otpauth:// URI that authenticator apps read from the QR code
+func TOTPProvisioningURI(issuer string, account string, secret string) string {
+	label := url.PathEscape(issuer + ":" + account)
+
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(TOTPDigits))
+	params.Set("period", fmt.Sprint(TOTPPeriod))
+
+	// authenticator apps expect %20 rather than + for spaces in the issuer
+	return "otpauth://totp/" + label + "?" + strings.Replace(params.Encode(), "+", "%20", -1)
+}
+
+// GenerateTOTPCode computes the code for the time step containing t
+func GenerateTOTPCode(secret string, t time.Time) (string, error) {
+	return totpCode(secret, uint64(t.Unix()/TOTPPeriod))
+}
+
+// MatchTOTPCode checks code against the current time step and skew steps on either side of it.
+// It returns the step the code was generated for, callers store it to reject a replayed code
+func MatchTOTPCode(secret string, code string, t time.Time, skew int) (int64, bool) {
+	if len(code) != TOTPDigits {
+		return 0, false
+	}
+
+	counter := t.Unix() / TOTPPeriod
+
+	for i := -skew; i <= skew; i++ {
+		expected, err := totpCode(secret, uint64(counter+int64(i)))
+		if err != nil {
+			return 0, false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter + int64(i), true
+		}
+	}
+
+	return 0, false
+}
+
+func totpCode(secret string, counter uint64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", TOTPDigits, value%mod), nil
+}
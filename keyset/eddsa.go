@@ -0,0 +1,49 @@
+package keyset
+
+import (
+	"crypto/ed25519"
+	"errors"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// SigningMethodEdDSA implements the EdDSA (Ed25519) JWS algorithm from RFC 8037,
+// which jwt-go does not ship with
+var SigningMethodEdDSA = &signingMethodEdDSA{}
+
+type signingMethodEdDSA struct{}
+
+func init() {
+	jwt.RegisterSigningMethod(EdDSA, func() jwt.SigningMethod { return SigningMethodEdDSA })
+}
+
+func (m *signingMethodEdDSA) Alg() string {
+	return EdDSA
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(priv, []byte(signingString))), nil
+}
+
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if len(sig) != ed25519.SignatureSize || !ed25519.Verify(pub, []byte(signingString), sig) {
+		return errors.New("signature is invalid")
+	}
+
+	return nil
+}
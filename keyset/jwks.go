@@ -0,0 +1,84 @@
+package keyset
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+)
+
+// JWK is the public part of a signing key as described in RFC 7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns every key that is still accepted for verification, including retired ones
+func (ks *keySet) JWKS() *JWKS {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	jwks := &JWKS{Keys: []JWK{}}
+
+	for _, key := range ks.keys {
+		if jwk, ok := key.JWK(); ok {
+			jwks.Keys = append(jwks.Keys, jwk)
+		}
+	}
+
+	return jwks
+}
+
+func (k *Key) JWK() (JWK, bool) {
+	jwk := JWK{Use: "sig", Kid: k.ID, Alg: k.Algorithm}
+
+	switch pub := k.Signer.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = encode(pub.N.Bytes())
+		jwk.E = encode(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = encode(pad(pub.X.Bytes(), size))
+		jwk.Y = encode(pad(pub.Y.Bytes(), size))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = encode(pub)
+	default:
+		return jwk, false
+	}
+
+	return jwk, true
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// pad left pads b with zeros, EC coordinates must be full length in a JWK
+func pad(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+
+	return padded
+}
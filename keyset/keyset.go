@@ -0,0 +1,455 @@
+package keyset
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/rs/xid"
+)
+
+// Supported signing algorithms
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+)
+
+type Key struct {
+	ID        string
+	Algorithm string
+	Signer    crypto.Signer
+	CreatedAt time.Time
+	// ExpiresAt is zero for the current signing key, retired keys are
+	// only accepted for verification until then
+	ExpiresAt time.Time
+}
+
+type Options struct {
+	Algorithm string
+	// Dir holds one PEM encoded PKCS#8 private key per file, named <kid>.pem.
+	// Instances sharing the directory share keys. Empty keeps keys in memory.
+	Dir string
+	// RotationInterval is the age after which a new signing key is generated
+	RotationInterval time.Duration
+	// Retention is how long a retired key is still accepted for verification,
+	// it should be at least the lifetime of the longest lived token
+	Retention time.Duration
+	// LegacySecret accepts HS256 tokens without a kid that were issued
+	// before asymmetric signing was enabled
+	LegacySecret string
+	// LegacyCutoff is when asymmetric signing was enabled, legacy tokens
+	// issued at or after it are rejected
+	LegacyCutoff time.Time
+}
+
+type KeySet interface {
+	Sign(claims jwt.Claims) (string, error)
+	Parse(tokenString string, claims jwt.Claims) error
+
+	SigningKey() (*Key, error)
+	VerificationKey(kid string) (*Key, error)
+	Rotate() (*Key, error)
+	JWKS() *JWKS
+	StartRotation(ctx context.Context, checkEvery time.Duration)
+}
+
+type keySet struct {
+	opts Options
+
+	mu         sync.RWMutex
+	keys       []*Key
+	lastReload time.Time
+}
+
+var (
+	defaultMu  sync.RWMutex
+	defaultSet KeySet
+)
+
+// SetDefault installs the key set used by models.TokenClaim and models.VerifyToken
+func SetDefault(ks KeySet) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	defaultSet = ks
+}
+
+// Default returns the key set installed with SetDefault. It panics when none
+// was installed, a key set made up on the spot would sign tokens no other
+// instance or restart can verify.
+func Default() KeySet {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+
+	if defaultSet == nil {
+		panic("keyset: no default key set, install one with SetDefault")
+	}
+
+	return defaultSet
+}
+
+func New(opts Options) (KeySet, error) {
+	if opts.Algorithm == "" {
+		opts.Algorithm = RS256
+	}
+
+	if signingMethod(opts.Algorithm) == nil {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", opts.Algorithm)
+	}
+
+	ks := &keySet{opts: opts}
+
+	if opts.Dir != "" {
+		if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+			return nil, err
+		}
+
+		if err := ks.reload(); err != nil {
+			return nil, err
+		}
+	}
+
+	if current, _ := ks.SigningKey(); current == nil || current.Algorithm != opts.Algorithm {
+		if _, err := ks.Rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return ks, nil
+}
+
+func (ks *keySet) Sign(claims jwt.Claims) (string, error) {
+	key, err := ks.SigningKey()
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(signingMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+
+	return token.SignedString(key.Signer)
+}
+
+func (ks *keySet) Parse(tokenString string, claims jwt.Claims) error {
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+
+		if kid == "" && ks.opts.LegacySecret != "" && token.Method == jwt.SigningMethodHS256 {
+			return ks.legacySecret(tokenString)
+		}
+
+		key, err := ks.VerificationKey(kid)
+		if err != nil {
+			return nil, err
+		}
+
+		if token.Method.Alg() != key.Algorithm {
+			return nil, errors.New("token signing algorithm does not match key")
+		}
+
+		return key.Signer.Public(), nil
+	})
+
+	return err
+}
+
+// legacySecret returns the HS256 secret for a token issued before the cutoff,
+// a forged token would have to claim an issue time from back then
+func (ks *keySet) legacySecret(tokenString string) (interface{}, error) {
+	var claims jwt.StandardClaims
+	if _, _, err := new(jwt.Parser).ParseUnverified(tokenString, &claims); err != nil {
+		return nil, err
+	}
+
+	issuedAt := time.Unix(claims.IssuedAt, 0)
+	if claims.IssuedAt == 0 || ks.opts.LegacyCutoff.IsZero() || !issuedAt.Before(ks.opts.LegacyCutoff) {
+		return nil, errors.New("legacy token not issued before the cutoff")
+	}
+
+	log.Printf("keyset: accepted legacy HS256 token issued at %s", issuedAt.UTC().Format(time.RFC3339))
+
+	return []byte(ks.opts.LegacySecret), nil
+}
+
+func (ks *keySet) SigningKey() (*Key, error) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if len(ks.keys) < 1 {
+		return nil, errors.New("no signing key available")
+	}
+
+	return ks.keys[len(ks.keys)-1], nil
+}
+
+func (ks *keySet) VerificationKey(kid string) (*Key, error) {
+	if key := ks.find(kid); key != nil {
+		return key, nil
+	}
+
+	// another instance sharing the directory may have rotated already
+	if ks.opts.Dir != "" {
+		ks.mu.RLock()
+		stale := time.Since(ks.lastReload) > 10*time.Second
+		ks.mu.RUnlock()
+
+		if stale {
+			if err := ks.reload(); err != nil {
+				return nil, err
+			}
+
+			if key := ks.find(kid); key != nil {
+				return key, nil
+			}
+		}
+	}
+
+	return nil, errors.New("unknown signing key")
+}
+
+func (ks *keySet) find(kid string) *Key {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	now := time.Now()
+
+	for _, key := range ks.keys {
+		if key.ID != kid {
+			continue
+		}
+
+		if !key.ExpiresAt.IsZero() && now.After(key.ExpiresAt) {
+			return nil
+		}
+
+		return key
+	}
+
+	return nil
+}
+
+func (ks *keySet) Rotate() (*Key, error) {
+	signer, err := generateKey(ks.opts.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &Key{
+		ID:        xid.New().String(),
+		Algorithm: ks.opts.Algorithm,
+		Signer:    signer,
+		CreatedAt: time.Now(),
+	}
+
+	if ks.opts.Dir != "" {
+		if err := writeKey(ks.opts.Dir, key); err != nil {
+			return nil, err
+		}
+	}
+
+	ks.mu.Lock()
+	ks.keys = append(ks.keys, key)
+	ks.retire()
+	ks.mu.Unlock()
+
+	return key, nil
+}
+
+// StartRotation periodically picks up keys written by other instances and
+// generates a new signing key once the current one is older than RotationInterval
+func (ks *keySet) StartRotation(ctx context.Context, checkEvery time.Duration) {
+	if ks.opts.RotationInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(checkEvery)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if ks.opts.Dir != "" {
+				if err := ks.reload(); err != nil {
+					log.Printf("keyset: reload failed: %v", err)
+					continue
+				}
+			}
+
+			current, err := ks.SigningKey()
+			if err == nil && time.Since(current.CreatedAt) < ks.opts.RotationInterval {
+				continue
+			}
+
+			key, err := ks.Rotate()
+			if err != nil {
+				log.Printf("keyset: rotation failed: %v", err)
+				continue
+			}
+
+			log.Printf("keyset: rotated signing key, new kid %s", key.ID)
+		}
+	}()
+}
+
+// retire sets the expiry of every key superseded by a newer one and drops
+// the ones past it. Callers must hold ks.mu.
+func (ks *keySet) retire() {
+	sort.Slice(ks.keys, func(i, j int) bool { return ks.keys[i].CreatedAt.Before(ks.keys[j].CreatedAt) })
+
+	now := time.Now()
+	var active []*Key
+
+	for i, key := range ks.keys {
+		if i < len(ks.keys)-1 {
+			key.ExpiresAt = ks.keys[i+1].CreatedAt.Add(ks.opts.Retention)
+		}
+
+		if !key.ExpiresAt.IsZero() && now.After(key.ExpiresAt) {
+			if ks.opts.Dir != "" {
+				os.Remove(filepath.Join(ks.opts.Dir, key.ID+".pem"))
+			}
+
+			continue
+		}
+
+		active = append(active, key)
+	}
+
+	ks.keys = active
+}
+
+func (ks *keySet) reload() error {
+	files, err := ioutil.ReadDir(ks.opts.Dir)
+	if err != nil {
+		return err
+	}
+
+	var keys []*Key
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".pem" {
+			continue
+		}
+
+		key, err := readKey(filepath.Join(ks.opts.Dir, file.Name()))
+		if err != nil {
+			return fmt.Errorf("%s: %v", file.Name(), err)
+		}
+
+		key.ID = strings.TrimSuffix(file.Name(), ".pem")
+		key.CreatedAt = file.ModTime()
+
+		keys = append(keys, key)
+	}
+
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.lastReload = time.Now()
+	ks.retire()
+	ks.mu.Unlock()
+
+	return nil
+}
+
+func generateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case RS256:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case ES256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case EdDSA:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
+
+	return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+}
+
+func writeKey(dir string, key *Key) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key.Signer)
+	if err != nil {
+		return err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	// write then rename so other instances never read a partial key
+	tmp := filepath.Join(dir, "."+key.ID+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	if err := os.Chtimes(tmp, key.CreatedAt, key.CreatedAt); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(dir, key.ID+".pem"))
+}
+
+func readKey(path string) (*Key, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch priv := parsed.(type) {
+	case *rsa.PrivateKey:
+		return &Key{Algorithm: RS256, Signer: priv}, nil
+	case *ecdsa.PrivateKey:
+		if priv.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 ECDSA keys are supported")
+		}
+
+		return &Key{Algorithm: ES256, Signer: priv}, nil
+	case ed25519.PrivateKey:
+		return &Key{Algorithm: EdDSA, Signer: priv}, nil
+	}
+
+	return nil, errors.New("unsupported private key type")
+}
+
+func signingMethod(alg string) jwt.SigningMethod {
+	switch alg {
+	case RS256:
+		return jwt.SigningMethodRS256
+	case ES256:
+		return jwt.SigningMethodES256
+	case EdDSA:
+		return SigningMethodEdDSA
+	}
+
+	return nil
+}
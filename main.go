@@ -1,5 +1,15 @@
 package main
 
-import "github.com/g-graziano/user-auth-golang/app"
+import (
+	"os"
 
-func main() { app.Run() }
+	"github.com/g-graziano/user-auth-golang/app"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(app.Migrate(os.Args[2:]))
+	}
+
+	app.Run()
+}
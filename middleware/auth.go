@@ -1,16 +1,16 @@
 package middleware
 
 import (
+	"crypto/subtle"
 	"errors"
 	"net/http"
-	"os"
-	"strconv"
+	"net/url"
 	"strings"
-
-	"github.com/dgrijalva/jwt-go"
+	"time"
 
 	"github.com/g-graziano/user-auth-golang/helper"
 	"github.com/g-graziano/user-auth-golang/models"
+	"github.com/g-graziano/user-auth-golang/service/oauth"
 	"github.com/g-graziano/user-auth-golang/service/user"
 )
 
@@ -21,19 +21,7 @@ func VerifyToken(tokenString string) (*models.TokenClaim, error) {
 
 	tokenString = strings.Replace(tokenString, "Bearer ", "", 1)
 
-	signKey := []byte(os.Getenv("JWT_SIGNATURE_KEY"))
-
-	claim := new(models.TokenClaim)
-
-	_, err := jwt.ParseWithClaims(tokenString, claim, func(token *jwt.Token) (interface{}, error) {
-		return []byte(signKey), nil
-	})
-
-	if err != nil {
-		return nil, err
-	}
-
-	return claim, nil
+	return models.VerifyToken(tokenString)
 }
 
 func APIClientAuthentication(u user.User) (ret func(http.Handler) http.Handler) {
@@ -41,7 +29,7 @@ func APIClientAuthentication(u user.User) (ret func(http.Handler) http.Handler)
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			tokenString := r.Header.Get("X-API-ClientID")
 
-			client, err := u.GetAPIClientID(&models.ClientID{API: tokenString})
+			client, err := u.GetAPIClientID(r.Context(), &models.ClientID{API: tokenString})
 
 			if err != nil {
 				w.WriteHeader(http.StatusBadRequest)
@@ -57,13 +45,73 @@ func APIClientAuthentication(u user.User) (ret func(http.Handler) http.Handler)
 				return
 			}
 
-			r.Header.Set("client-id", strconv.FormatUint(client.ID, 10))
+			ctx := helper.WithClientID(r.Context(), client.ID)
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// AdminAuthentication lets through requests bearing the configured admin
+// token, with no token configured the admin routes don't exist
+func AdminAuthentication(token string) (ret func(http.Handler) http.Handler) {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				http.NotFound(w, r)
+
+				return
+			}
+
+			bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+			if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+				w.WriteHeader(http.StatusUnauthorized)
+				helper.Response(w, helper.ErrorMessage(0, "Admin token not valid"))
+
+				return
+			}
 
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
+// OAuthClientAuthentication authenticates the client on the OAuth token endpoint, either
+// with HTTP Basic credentials or client_id and client_secret form parameters
+func OAuthClientAuthentication(o oauth.OAuth) (ret func(http.Handler) http.Handler) {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientID, clientSecret, basic := r.BasicAuth()
+
+			if basic {
+				clientID, _ = url.QueryUnescape(clientID)
+				clientSecret, _ = url.QueryUnescape(clientSecret)
+			} else {
+				clientID = r.PostFormValue("client_id")
+				clientSecret = r.PostFormValue("client_secret")
+			}
+
+			client, err := o.AuthenticateClient(r.Context(), clientID, clientSecret)
+
+			if err != nil {
+				if basic {
+					w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+				}
+
+				w.WriteHeader(http.StatusUnauthorized)
+				helper.Response(w, helper.OAuthErrorMessage("invalid_client", err.Error()))
+
+				return
+			}
+
+			ctx := helper.WithClientID(r.Context(), client.ID)
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
 func JwtTfaAuthentication(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		tokenString := r.Header.Get("Authorization")
@@ -83,11 +131,12 @@ func JwtTfaAuthentication(next http.Handler) http.Handler {
 			return
 		}
 
-		r.Header.Set("xid", claims.XID)
-		r.Header.Set("token", tokenString)
-		r.Header.Set("client-id", strconv.FormatUint(claims.ClientID, 10))
+		tokenString = strings.Replace(tokenString, "Bearer ", "", 1)
+
+		ctx := helper.WithAuth(r.Context(), claims.XID, tokenString)
+		ctx = helper.WithClientID(ctx, claims.ClientID)
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
@@ -110,11 +159,12 @@ func JwtACTAuthentication(next http.Handler) http.Handler {
 			return
 		}
 
-		r.Header.Set("xid", claims.XID)
-		r.Header.Set("token", tokenString)
-		r.Header.Set("client-id", strconv.FormatUint(claims.ClientID, 10))
+		tokenString = strings.Replace(tokenString, "Bearer ", "", 1)
 
-		next.ServeHTTP(w, r)
+		ctx := helper.WithAuth(r.Context(), claims.XID, tokenString)
+		ctx = helper.WithClientID(ctx, claims.ClientID)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
@@ -139,7 +189,7 @@ func JwtAuthentication(u user.User) (ret func(http.Handler) http.Handler) {
 			}
 
 			tokenString = strings.Replace(tokenString, "Bearer ", "", 1)
-			err = u.CheckJWTIsActive(&models.UserToken{Token: tokenString})
+			err = u.CheckJWTIsActive(r.Context(), &models.UserToken{Token: tokenString})
 
 			if err != nil {
 				w.WriteHeader(http.StatusBadRequest)
@@ -147,12 +197,45 @@ func JwtAuthentication(u user.User) (ret func(http.Handler) http.Handler) {
 				return
 			}
 
-			r.Header.Set("email", claims.Email)
-			r.Header.Set("xid", claims.XID)
-			r.Header.Set("token", tokenString)
-			r.Header.Set("client-id", strconv.FormatUint(claims.ClientID, 10))
+			ctx := helper.WithAuth(r.Context(), claims.XID, tokenString)
+			ctx = helper.WithAuthTime(ctx, time.Unix(claims.IssuedAt, 0))
+			ctx = helper.WithClientID(ctx, claims.ClientID)
 
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// JwtOAuthAuthentication accepts access tokens issued to OAuth clients by /oauth/token
+func JwtOAuthAuthentication(u user.User) (ret func(http.Handler) http.Handler) {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenString := r.Header.Get("Authorization")
+
+			claims, err := VerifyToken(tokenString)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				helper.Response(w, helper.OAuthErrorMessage("invalid_token", err.Error()))
+
+				return
+			}
+
+			tokenString = strings.Replace(tokenString, "Bearer ", "", 1)
+
+			if claims.AccessType != "oauth" || u.CheckJWTIsActive(r.Context(), &models.UserToken{Token: tokenString}) != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				helper.Response(w, helper.OAuthErrorMessage("invalid_token", "Invalid auth token"))
+
+				return
+			}
+
+			ctx := helper.WithAuth(r.Context(), claims.XID, tokenString)
+			ctx = helper.WithScope(ctx, claims.Scope)
+			ctx = helper.WithClientID(ctx, claims.ClientID)
+
+			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
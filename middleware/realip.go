@@ -0,0 +1,20 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/g-graziano/user-auth-golang/helper"
+)
+
+// RealIP stores the caller's address in the request context, X-Forwarded-For
+// is only believed from the trusted proxies
+func RealIP(trusted []*net.IPNet) (ret func(http.Handler) http.Handler) {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := helper.WithIPAddress(r.Context(), helper.ClientIP(r, trusted))
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
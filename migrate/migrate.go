@@ -0,0 +1,292 @@
+// Package migrate applies versioned SQL migrations. A migration is a pair of
+// files NNNN_name.up.sql and NNNN_name.down.sql, applied versions are kept in
+// the schema_migrations table.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status of a migration, AppliedAt is zero when it is pending
+type Status struct {
+	Migration
+	AppliedAt time.Time
+}
+
+type Migrator interface {
+	// Up applies every pending migration, oldest first
+	Up() ([]Migration, error)
+	// Down reverts the last steps applied migrations, newest first
+	Down(steps int) ([]Migration, error)
+	Status() ([]Status, error)
+}
+
+// advisoryLock is the key of the Postgres advisory lock held while migrating
+const advisoryLock = 7245193
+
+type migrator struct {
+	db    *sql.DB
+	files fs.FS
+	lock  bool
+}
+
+// New reads the migrations at the root of files, each one runs in its own
+// transaction on db
+func New(db *sql.DB, files fs.FS) Migrator {
+	return &migrator{db: db, files: files}
+}
+
+// NewLocked is New for Postgres, Up and Down hold an advisory lock so
+// instances starting together apply each migration once
+func NewLocked(db *sql.DB, files fs.FS) Migrator {
+	return &migrator{db: db, files: files, lock: true}
+}
+
+func (m *migrator) Up() ([]Migration, error) {
+	conn, err := m.acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	defer m.release(conn)
+
+	statuses, err := m.status(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, status := range statuses {
+		if !status.AppliedAt.IsZero() {
+			continue
+		}
+
+		err := m.run(conn, status.Up, `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`,
+			status.Version, status.Name, time.Now())
+		if err != nil {
+			return applied, fmt.Errorf("migration %d_%s: %v", status.Version, status.Name, err)
+		}
+
+		applied = append(applied, status.Migration)
+	}
+
+	return applied, nil
+}
+
+func (m *migrator) Down(steps int) ([]Migration, error) {
+	conn, err := m.acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	defer m.release(conn)
+
+	statuses, err := m.status(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var reverted []Migration
+	for i := len(statuses) - 1; i >= 0 && len(reverted) < steps; i-- {
+		status := statuses[i]
+		if status.AppliedAt.IsZero() {
+			continue
+		}
+
+		if status.Down == "" {
+			return reverted, fmt.Errorf("migration %d_%s has no down file", status.Version, status.Name)
+		}
+
+		err := m.run(conn, status.Down, `DELETE FROM schema_migrations WHERE version = $1`, status.Version)
+		if err != nil {
+			return reverted, fmt.Errorf("migration %d_%s: %v", status.Version, status.Name, err)
+		}
+
+		reverted = append(reverted, status.Migration)
+	}
+
+	return reverted, nil
+}
+
+func (m *migrator) Status() ([]Status, error) {
+	conn, err := m.db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	return m.status(conn)
+}
+
+// acquire returns the connection Up and Down run on, holding the advisory
+// lock when there is one until release
+func (m *migrator) acquire() (*sql.Conn, error) {
+	ctx := context.Background()
+
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.lock {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, advisoryLock); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+func (m *migrator) release(conn *sql.Conn) {
+	if m.lock {
+		conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, advisoryLock)
+	}
+
+	conn.Close()
+}
+
+func (m *migrator) status(conn *sql.Conn) ([]Status, error) {
+	ctx := context.Background()
+
+	migrations, err := m.migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version BIGINT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMP NOT NULL
+		)`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	applied := map[int64]time.Time{}
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+
+		applied[version] = appliedAt
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var statuses []Status
+	for _, migration := range migrations {
+		statuses = append(statuses, Status{Migration: migration, AppliedAt: applied[migration.Version]})
+		delete(applied, migration.Version)
+	}
+
+	for version := range applied {
+		return nil, fmt.Errorf("version %d is applied but has no migration, is this binary older than the database?", version)
+	}
+
+	return statuses, nil
+}
+
+// run executes script and records it in one transaction
+func (m *migrator) run(conn *sql.Conn, script string, record string, args ...interface{}) error {
+	tx, err := conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(script); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec(record, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (m *migrator) migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(m.files, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+
+		version, _ := strconv.ParseInt(match[1], 10, 64)
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+
+		if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names, %s and %s", version, migration.Name, match[2])
+		}
+
+		content, err := fs.ReadFile(m.files, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		if match[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	var migrations []Migration
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", migration.Version, migration.Name)
+		}
+
+		migrations = append(migrations, *migration)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
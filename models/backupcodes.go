@@ -1,11 +1,25 @@
 package models
 
+import (
+	"time"
+
+	"github.com/g-graziano/user-auth-golang/helper"
+)
+
+// BackupCodes holds one backup code of a user, Codes is the sha256 of the code
 type BackupCodes struct {
-	ID     uint64 `gorm:"primary_key; AUTO_INCREMENT" json:"id"`
-	UserID uint64 `gorm:"not null" json:"user_id"`
-	Codes  string `gorm:"not null" json:"codes"`
+	ID        uint64          `json:"id"`
+	UserID    uint64          `json:"user_id"`
+	Codes     string          `json:"-"`
+	UsedAt    helper.NullTime `json:"used_at"`
+	CreatedAt time.Time       `json:"created_at"`
 }
 
 type BackupCodesResponse struct {
 	BackupCodes []string `json:"backup_codes"`
 }
+
+type BackupCodesStatus struct {
+	Remaining int `json:"remaining"`
+	Total     int `json:"total"`
+}
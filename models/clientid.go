@@ -1,7 +1,50 @@
 package models
 
+import (
+	"strings"
+
+	"github.com/g-graziano/user-auth-golang/helper"
+)
+
+// Client types, first party clients call the API with X-API-ClientID and the
+// others are OAuth clients registered by a user
+const (
+	ClientFirstParty   = "first_party"
+	ClientConfidential = "confidential"
+	ClientPublic       = "public"
+)
+
 type ClientID struct {
-	ID   uint64 `gorm:"primary_key; AUTO_INCREMENT" json:"id"`
-	API  string `gorm:"not null" json:"api"`
-	Name string `gorm:"not null" json:"name"`
+	ID           uint64            `json:"id"`
+	API          string            `json:"api"`
+	Name         string            `json:"name"`
+	Secret       helper.NullString `json:"-"`
+	Type         string            `json:"type"`
+	RedirectURIs string            `json:"redirect_uris"`
+	// OwnerID is the user who registered an OAuth client, 0 for first party clients
+	OwnerID uint64 `json:"-"`
+}
+
+// RedirectURIList returns the registered redirect URIs, they are stored newline separated
+func (c *ClientID) RedirectURIList() []string {
+	var uris []string
+
+	for _, uri := range strings.Split(c.RedirectURIs, "\n") {
+		if uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+
+	return uris
+}
+
+// AllowsRedirect reports whether uri exactly matches a registered redirect URI
+func (c *ClientID) AllowsRedirect(uri string) bool {
+	for _, registered := range c.RedirectURIList() {
+		if registered == uri {
+			return true
+		}
+	}
+
+	return false
 }
@@ -7,16 +7,19 @@ import (
 )
 
 type Event struct {
-	ID         uint64            `gorm:"primary_key; AUTO_INCREMENT" json:"-"`
-	UserID     uint64            `gorm:"not null" json:"user_id"`
-	Event      string            `gorm:"null" json:"event"`
-	UA         string            `gorm:"null" json:"ua"`
-	IPAddress  helper.NullString `gorm:"null" json:"ip_address"`
-	ClientID   uint64            `gorm:"null" json:"client_id"`
-	CreatedAt  time.Time         `gorm:"not null" json:"created_at"`
-	UpdatedAt  time.Time         `gorm:"not null" json:"-"`
-	ClientName string            `gorm:"-" json:"client_name"`
-	TotalEvent int               `gorm:"-" json:"total_event"`
+	ID         uint64            `json:"-"`
+	UserID     uint64            `json:"user_id"`
+	Event      string            `json:"event"`
+	UA         string            `json:"ua"`
+	IPAddress  helper.NullString `json:"ip_address"`
+	ClientID   uint64            `json:"client_id"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"-"`
+	ClientName string            `json:"client_name"`
+	// TotalEvent counts the events matching the filter, RemainingEvent only
+	// those from the cursor on
+	TotalEvent     int `json:"total_event"`
+	RemainingEvent int `json:"-"`
 }
 
 type ListEventResponse struct {
@@ -37,4 +40,24 @@ type Pagination struct {
 	PerPage  int `json:"per_page"`
 	Next     int `json:"next"`
 	Previous int `json:"previous"`
+	Total    int `json:"total"`
+	// NextCursor fetches the events after this page, it stays valid while
+	// new events are recorded, unlike page numbers
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// EventFilter selects the events of a user, zero values don't filter. Cursor,
+// when set, takes over from Page.
+type EventFilter struct {
+	UserID   uint64
+	XID      string
+	Page     int
+	PerPage  int
+	Event    string
+	ClientID uint64
+	From     time.Time
+	To       time.Time
+	Cursor   string
+	// BeforeID is the decoded cursor, only events older than it are listed
+	BeforeID uint64
 }
@@ -0,0 +1,130 @@
+package models
+
+import (
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+type OAuthClientRequest struct {
+	XID          string   `json:"-"`
+	Name         string   `json:"name"`
+	Type         string   `json:"type"`
+	RedirectURIs []string `json:"redirect_uris"`
+}
+
+type OAuthClientResponse struct {
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret,omitempty"`
+	Name         string   `json:"name"`
+	Type         string   `json:"type"`
+	RedirectURIs []string `json:"redirect_uris"`
+}
+
+type AuthorizeRequest struct {
+	XID                 string `json:"-"`
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+	Nonce               string `json:"nonce"`
+	// AuthTime is when the user signed in, the issue time of their login token
+	AuthTime time.Time `json:"-"`
+	// Prompt none asks the browser authorize endpoint not to send the user to
+	// the login page
+	Prompt  string `json:"prompt"`
+	Approve bool   `json:"approve"`
+}
+
+type ConsentResponse struct {
+	Client      DataClient   `json:"client"`
+	Scopes      []OAuthScope `json:"scopes"`
+	RedirectURI string       `json:"redirect_uri"`
+	State       string       `json:"state"`
+}
+
+type OAuthScope struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type AuthorizeResponse struct {
+	RedirectURI string `json:"redirect_uri"`
+}
+
+// AuthorizationCode is what an issued code refers to, it is kept in redis until exchanged
+type AuthorizationCode struct {
+	ClientID      uint64    `json:"client_id"`
+	ClientAPI     string    `json:"client_api"`
+	UserID        uint64    `json:"user_id"`
+	XID           string    `json:"xid"`
+	RedirectURI   string    `json:"redirect_uri"`
+	Scope         string    `json:"scope"`
+	CodeChallenge string    `json:"code_challenge"`
+	Nonce         string    `json:"nonce"`
+	AuthTime      time.Time `json:"auth_time"`
+}
+
+type OAuthTokenRequest struct {
+	GrantType    string
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+}
+
+type OAuthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+	IDToken     string `json:"id_token,omitempty"`
+}
+
+// IDTokenClaim is an OpenID Connect ID token, profile and email claims are only set when the scope was granted
+type IDTokenClaim struct {
+	jwt.StandardClaims
+	AuthTime      int64  `json:"auth_time"`
+	Nonce         string `json:"nonce,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+	Name          string `json:"name,omitempty"`
+	Picture       string `json:"picture,omitempty"`
+}
+
+type UserInfo struct {
+	Sub           string `json:"sub"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+	Name          string `json:"name,omitempty"`
+	Picture       string `json:"picture,omitempty"`
+}
+
+type OpenIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+}
+
+// OAuthError is an error response as defined in RFC 6749 section 5.2
+type OAuthError struct {
+	Code        string
+	Description string
+	Status      int
+}
+
+func (e *OAuthError) Error() string {
+	return e.Description
+}
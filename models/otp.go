@@ -1,6 +1,10 @@
 package models
 
-import "time"
+import (
+	"fmt"
+	"math"
+	"time"
+)
 
 type OTP struct {
 	Key    string    `json:"key"`
@@ -12,3 +16,17 @@ type OTPRequest struct {
 	Code string
 	XID  string
 }
+
+// TooManyAttemptsError is returned while an account, IP or client is locked out
+type TooManyAttemptsError struct {
+	RetryAfter time.Duration
+}
+
+func (e *TooManyAttemptsError) Error() string {
+	return fmt.Sprintf("too many attempts, try again in %d seconds", e.RetryAfterSeconds())
+}
+
+// RetryAfterSeconds rounds up so clients never retry before the lock is gone
+func (e *TooManyAttemptsError) RetryAfterSeconds() int64 {
+	return int64(math.Ceil(e.RetryAfter.Seconds()))
+}
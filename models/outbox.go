@@ -0,0 +1,48 @@
+package models
+
+import (
+	"time"
+
+	"github.com/g-graziano/user-auth-golang/helper"
+)
+
+// Outbox statuses
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+	OutboxDead    = "dead"
+)
+
+// OutboxEmail is an email waiting for the mail worker. It is written in the
+// same transaction as the change that triggered it, so a committed change
+// always gets its email and a rolled back one never does.
+type OutboxEmail struct {
+	ID             uint64            `json:"id"`
+	RecipientName  string            `json:"recipient_name"`
+	RecipientEmail string            `json:"recipient_email"`
+	Subject        string            `json:"subject"`
+	HTMLContent    string            `json:"-"`
+	PlainContent   string            `json:"-"`
+	Status         string            `json:"status"`
+	Attempts       int               `json:"attempts"`
+	NextAttemptAt  time.Time         `json:"next_attempt_at"`
+	LastError      helper.NullString `json:"last_error"`
+	SentAt         helper.NullTime   `json:"sent_at"`
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+}
+
+func (o *OutboxEmail) Email() *Email {
+	return &Email{
+		RecipientName:  o.RecipientName,
+		RecipientEmail: o.RecipientEmail,
+		Subject:        o.Subject,
+		HTMLContent:    o.HTMLContent,
+		PlainContent:   o.PlainContent,
+	}
+}
+
+type ListOutboxResponse struct {
+	Emails []*OutboxEmail `json:"emails"`
+	Total  int            `json:"total"`
+}
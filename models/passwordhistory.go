@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// PasswordHistory keeps the hashes of passwords a user had before so they can't be reused
+type PasswordHistory struct {
+	ID        uint64    `json:"id"`
+	UserID    uint64    `json:"user_id"`
+	Password  string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	"github.com/g-graziano/user-auth-golang/helper"
+)
+
+// SentEmail is the delivery log of one email, bodies aren't kept since they carry tokens
+type SentEmail struct {
+	ID        uint64            `json:"id"`
+	Recipient string            `json:"recipient"`
+	Subject   string            `json:"subject"`
+	Driver    string            `json:"driver"`
+	Status    string            `json:"status"`
+	Error     helper.NullString `json:"error"`
+	CreatedAt time.Time         `json:"created_at"`
+}
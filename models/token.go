@@ -1,25 +1,27 @@
 package models
 
 import (
-	"os"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/g-graziano/user-auth-golang/helper"
+	"github.com/g-graziano/user-auth-golang/keyset"
+	"github.com/rs/xid"
 )
 
 type UserToken struct {
-	ID           uint64            `gorm:"primary_key; AUTO_INCREMENT" json:"id"`
-	UserID       uint64            `gorm:"not null" json:"user_id"`
-	Token        string            `gorm:"not null" json:"token"`
-	TokenType    string            `gorm:"not null" json:"token_type"`
-	RefreshToken helper.NullString `gorm:"null" json:"refresh_token"`
-	Status       string            `gorm:"not null; type:varchar(255)" json:"status"`
-	IPAddress    helper.NullString `gorm:"null" json:"ip_address"`
-	ClientID     uint64            `gorm:"null" json:"client_id"`
-	ClientName   string            `gorm:"-" json:"client_name"`
-	CreatedAt    time.Time         `gorm:"not null" json:"-"`
-	UpdatedAt    time.Time         `gorm:"not null" json:"-"`
+	ID           uint64            `json:"id"`
+	UserID       uint64            `json:"user_id"`
+	Token        string            `json:"token"`
+	TokenType    string            `json:"token_type"`
+	RefreshToken helper.NullString `json:"refresh_token"`
+	Family       helper.NullString `json:"-"`
+	Status       string            `json:"status"`
+	IPAddress    helper.NullString `json:"ip_address"`
+	ClientID     uint64            `json:"client_id"`
+	ClientName   string            `json:"client_name"`
+	CreatedAt    time.Time         `json:"-"`
+	UpdatedAt    time.Time         `json:"-"`
 }
 
 type TfaResponse struct {
@@ -33,6 +35,11 @@ type AccessToken struct {
 	ExpiredAt string `json:"expired_at"`
 }
 
+type SessionToken struct {
+	AccessToken  *AccessToken `json:"access_token"`
+	RefreshToken *AccessToken `json:"refresh_token"`
+}
+
 type AccessTokenRequest struct {
 	XID          string `json:"value"`
 	RefreshToken string `json:"refresh_token"`
@@ -71,10 +78,11 @@ type TokenClaim struct {
 	Email      string        `json:"email"`
 	AccessType string        `json:"access_type"`
 	ClientID   uint64        `json:"client_id"`
+	Scope      string        `json:"scope,omitempty"`
 	ExpiredAt  time.Duration `json:"expired_at"`
 }
 
-func (e *TokenClaim) TokenGenerator() string {
+func (e *TokenClaim) TokenGenerator() (string, error) {
 	now := time.Now().UTC()
 	end := now.Add(e.ExpiredAt)
 
@@ -84,28 +92,22 @@ func (e *TokenClaim) TokenGenerator() string {
 		claim.XID = e.XID
 	}
 
+	// jti keeps tokens unique even when the same claims are signed within one second
+	claim.Id = xid.New().String()
 	claim.Email = e.Email
 	claim.AccessType = e.AccessType
 	claim.ClientID = e.ClientID
+	claim.Scope = e.Scope
 	claim.IssuedAt = now.Unix()
 	claim.ExpiresAt = end.Unix()
 
-	signKey := []byte(os.Getenv("JWT_SIGNATURE_KEY"))
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claim)
-
-	tokenString, _ := token.SignedString(signKey)
-
-	return tokenString
+	return keyset.Default().Sign(claim)
 }
 
 func VerifyToken(tokenString string) (*TokenClaim, error) {
-	signKey := []byte(os.Getenv("JWT_SIGNATURE_KEY"))
-
 	claim := new(TokenClaim)
 
-	_, err := jwt.ParseWithClaims(tokenString, claim, func(token *jwt.Token) (interface{}, error) {
-		return []byte(signKey), nil
-	})
+	err := keyset.Default().Parse(tokenString, claim)
 
 	if err != nil {
 		return nil, err
@@ -11,28 +11,31 @@ import (
 )
 
 type User struct {
-	ID       uint64 `gorm:"primary_key; AUTO_INCREMENT" json:"id"`
-	XID      string `gorm:"unique" json:"xid"`
-	Email    string `gorm:"unique; not null; type:varchar(255)" json:"email"`
-	Fullname string `gorm:"not null; type:varchar(255)" json:"fullname"`
+	ID       uint64 `json:"id"`
+	XID      string `json:"xid"`
+	Email    string `json:"email"`
+	Fullname string `json:"fullname"`
 
-	Location helper.NullString `gorm:"type:varchar(255)" json:"location"`
-	Bio      helper.NullString `gorm:"type:varchar(255)" json:"bio"`
-	Web      helper.NullString `gorm:"type:varchar(255)" json:"web"`
-	Picture  helper.NullString `gorm:"type:varchar(255)" json:"picture,omitempty"`
+	Location helper.NullString `json:"location"`
+	Bio      helper.NullString `json:"bio"`
+	Web      helper.NullString `json:"web"`
+	Picture  helper.NullString `json:"picture,omitempty"`
 
-	Password     string          `gorm:"type:varchar(255); not null" json:"password,omitempty"`
-	Status       string          `gorm:"not null; default: 'nonactive'" json:"-"`
-	TFA          bool            `gorm:"type:varchar(255); not null; default: false" json:"tfa"`
-	EnabledTfaAt helper.NullTime `gorm:"null" json:"enabled_tfa_at"`
+	Password     string          `json:"password,omitempty"`
+	Status       string          `json:"-"`
+	TFA          bool            `json:"tfa"`
+	EnabledTfaAt helper.NullTime `json:"enabled_tfa_at"`
 
-	TFASecret helper.NullTime `gorm:"-" json:"tfa_secret"`
-	TFAQr     helper.NullTime `gorm:"-" json:"tfa_qr"`
+	TFASecret helper.NullString `json:"-"`
 
-	IPAddress string `gorm:"-" json:"-"`
+	// Locale picks the language of the emails sent to the user
+	Locale string          `json:"locale"`
+	TFAQr  helper.NullTime `json:"tfa_qr"`
 
-	CreatedAt time.Time `gorm:"not null" json:"-"`
-	UpdatedAt time.Time `gorm:"not null" json:"-"`
+	IPAddress string `json:"-"`
+
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
 }
 
 type Login struct {
@@ -54,8 +57,6 @@ type UploadProfile struct {
 	UserXID     string    `json:"-"`
 	Size        int64     `json:"-"`
 	ContentType string    `json:"-"`
-	Width       int64     `json:"-"`
-	Height      int64     `json:"-"`
 	File        io.Reader `json:"-"`
 }
 
@@ -71,17 +72,21 @@ type ActivateTfaRequest struct {
 }
 
 type ProfileResponse struct {
-	ID        uint64    `json:"id"`
-	Fullname  string    `json:"fullname"`
-	Location  string    `json:"location"`
-	Bio       string    `json:"bio"`
-	Web       string    `json:"web"`
-	Picture   string    `json:"picture"`
-	CreatedAt time.Time `json:"created_at"`
+	ID       uint64 `json:"id"`
+	Fullname string `json:"fullname"`
+	Location string `json:"location"`
+	Bio      string `json:"bio"`
+	Web      string `json:"web"`
+	Picture  string `json:"picture"`
+	// Pictures maps each thumbnail size, in pixels, to its URL
+	Pictures  map[string]string `json:"pictures,omitempty"`
+	Locale    string            `json:"locale"`
+	CreatedAt time.Time         `json:"created_at"`
 }
 
 type GetEmailResponse struct {
-	Email string `json:"email"`
+	Email    string `json:"email"`
+	Verified bool   `json:"verified"`
 }
 
 type RegisterRequest struct {
@@ -90,6 +95,7 @@ type RegisterRequest struct {
 	Email           string `json:"email"`
 	Password        string `json:"password"`
 	PasswordConfirm string `json:"password_confirm"`
+	Locale          string `json:"locale"`
 }
 
 type VerificationRequest struct {
@@ -130,8 +136,8 @@ func (user *RegisterRequest) ValidateRegister() error {
 		return errors.New("Email harus valid dan terdiri dari 5 s/d 50 karakter")
 	}
 
-	if err := validate.Var(user.Password, "required,min=5,max=20"); err != nil {
-		return errors.New("Password harus terdiri dari 5 s/d 20 karakter")
+	if err := validate.Var(user.Password, "required"); err != nil {
+		return errors.New("Password harus diisi")
 	}
 
 	if err := validate.VarWithValue(user.Password, user.PasswordConfirm, "eqfield"); err != nil {
@@ -140,5 +146,11 @@ func (user *RegisterRequest) ValidateRegister() error {
 
 	user.Email = strings.ToLower(user.Email)
 
+	if user.Locale == "" {
+		user.Locale = "en"
+	}
+
+	user.Locale = strings.ToLower(user.Locale)
+
 	return nil
 }
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/g-graziano/user-auth-golang/helper"
+)
+
+// Verification token purposes
+const (
+	PurposeVerifyEmail = "verify_email"
+	PurposeChangeEmail = "change_email"
+	PurposeRevertEmail = "revert_email"
+	// reset tokens carry a fingerprint of the password hash they were issued
+	// for, so they stop working once the password changes
+	PurposeResetPassword = "reset_password"
+)
+
+var (
+	ErrTokenInvalid = errors.New("token is not valid")
+	ErrTokenExpired = errors.New("token has expired, please request a new one")
+	ErrTokenUsed    = errors.New("token has already been used")
+)
+
+// VerificationToken backs a link sent by email. Only the sha256 of the token
+// is stored, Data carries whatever the purpose needs (e.g. a new email).
+type VerificationToken struct {
+	ID        uint64            `json:"id"`
+	TokenHash string            `json:"-"`
+	UserID    uint64            `json:"user_id"`
+	Purpose   string            `json:"purpose"`
+	Data      helper.NullString `json:"-"`
+	ExpiresAt time.Time         `json:"expires_at"`
+	UsedAt    helper.NullTime   `json:"used_at"`
+	CreatedAt time.Time         `json:"created_at"`
+}
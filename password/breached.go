@@ -0,0 +1,149 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"os"
+	"strings"
+)
+
+// falsePositiveRate of the breached password filter, a false positive only
+// asks the user to pick another password
+const falsePositiveRate = 0.001
+
+// Bloom is a bloom filter over SHA-1 digests of breached passwords, it keeps
+// a multi-million entry dump in a few megabytes of memory
+type Bloom struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+func NewBloom(n int, rate float64) *Bloom {
+	if n < 1 {
+		n = 1
+	}
+
+	m := uint64(math.Ceil(-float64(n) * math.Log(rate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+
+	return &Bloom{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+// LoadBreached builds a filter from a dump with one password per line. Lines
+// may be plaintext or SHA-1 hex with an optional ":count" suffix.
+func LoadBreached(path string) (*Bloom, error) {
+	n, err := countLines(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	bloom := NewBloom(n, falsePositiveRate)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if digest, ok := parseSHA1(line); ok {
+			bloom.add(digest)
+			continue
+		}
+
+		digest := sha1.Sum([]byte(line))
+		bloom.add(digest[:])
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return bloom, nil
+}
+
+func (b *Bloom) Add(password string) {
+	digest := sha1.Sum([]byte(password))
+	b.add(digest[:])
+}
+
+func (b *Bloom) Contains(password string) bool {
+	digest := sha1.Sum([]byte(password))
+
+	for _, i := range b.indexes(digest[:]) {
+		if b.bits[i/64]&(1<<(i%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (b *Bloom) add(digest []byte) {
+	for _, i := range b.indexes(digest) {
+		b.bits[i/64] |= 1 << (i % 64)
+	}
+}
+
+// indexes derives k positions from the digest by double hashing
+func (b *Bloom) indexes(digest []byte) []uint64 {
+	h1 := binary.BigEndian.Uint64(digest[0:8])
+	h2 := binary.BigEndian.Uint64(digest[8:16]) | 1
+
+	indexes := make([]uint64, b.k)
+	for i := uint64(0); i < b.k; i++ {
+		indexes[i] = (h1 + i*h2) % b.m
+	}
+
+	return indexes
+}
+
+func parseSHA1(line string) ([]byte, bool) {
+	if i := strings.Index(line, ":"); i >= 0 {
+		line = line[:i]
+	}
+
+	if len(line) != sha1.Size*2 {
+		return nil, false
+	}
+
+	digest, err := hex.DecodeString(line)
+	if err != nil {
+		return nil, false
+	}
+
+	return digest, true
+}
+
+func countLines(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	var n int
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		n++
+	}
+
+	return n, scanner.Err()
+}
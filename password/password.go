@@ -0,0 +1,259 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Supported algorithms
+const (
+	Bcrypt   = "bcrypt"
+	Argon2id = "argon2id"
+	Scrypt   = "scrypt"
+)
+
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// Hasher hashes new passwords with the configured algorithm and verifies
+// hashes produced by any supported algorithm. Hashes use the PHC string
+// format, bcrypt keeps its own $2a$ modular crypt format.
+type Hasher interface {
+	Hash(password string) (string, error)
+	Verify(password string, encoded string) (bool, error)
+	// NeedsRehash reports whether encoded was made with another algorithm
+	// or weaker parameters than the ones currently configured
+	NeedsRehash(encoded string) bool
+}
+
+type Options struct {
+	Algorithm string
+
+	BcryptCost int
+
+	Argon2Time    uint32
+	Argon2Memory  uint32 // KiB
+	Argon2Threads uint8
+
+	ScryptLogN uint8
+	ScryptR    int
+	ScryptP    int
+}
+
+const (
+	saltLength = 16
+	keyLength  = 32
+)
+
+type hasher struct {
+	opts Options
+}
+
+func New(opts Options) (Hasher, error) {
+	if opts.Algorithm == "" {
+		opts.Algorithm = Bcrypt
+	}
+
+	if opts.BcryptCost == 0 {
+		opts.BcryptCost = bcrypt.DefaultCost
+	}
+
+	if opts.Argon2Time == 0 {
+		opts.Argon2Time = 3
+	}
+
+	if opts.Argon2Memory == 0 {
+		opts.Argon2Memory = 64 * 1024
+	}
+
+	if opts.Argon2Threads == 0 {
+		opts.Argon2Threads = 2
+	}
+
+	if opts.ScryptLogN == 0 {
+		opts.ScryptLogN = 15
+	}
+
+	if opts.ScryptR == 0 {
+		opts.ScryptR = 8
+	}
+
+	if opts.ScryptP == 0 {
+		opts.ScryptP = 1
+	}
+
+	switch opts.Algorithm {
+	case Bcrypt:
+		if opts.BcryptCost < bcrypt.MinCost || opts.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case Argon2id, Scrypt:
+	default:
+		return nil, fmt.Errorf("unsupported password hashing algorithm %q", opts.Algorithm)
+	}
+
+	return &hasher{opts: opts}, nil
+}
+
+func (h *hasher) Hash(password string) (string, error) {
+	switch h.opts.Algorithm {
+	case Argon2id:
+		salt, err := newSalt()
+		if err != nil {
+			return "", err
+		}
+
+		key := argon2.IDKey([]byte(password), salt, h.opts.Argon2Time, h.opts.Argon2Memory, h.opts.Argon2Threads, keyLength)
+
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, h.opts.Argon2Memory, h.opts.Argon2Time, h.opts.Argon2Threads, encode(salt), encode(key)), nil
+	case Scrypt:
+		salt, err := newSalt()
+		if err != nil {
+			return "", err
+		}
+
+		key, err := scrypt.Key([]byte(password), salt, 1<<h.opts.ScryptLogN, h.opts.ScryptR, h.opts.ScryptP, keyLength)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+			h.opts.ScryptLogN, h.opts.ScryptR, h.opts.ScryptP, encode(salt), encode(key)), nil
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.opts.BcryptCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hashed), nil
+}
+
+func (h *hasher) Verify(password string, encoded string) (bool, error) {
+	switch algorithm(encoded) {
+	case Bcrypt:
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+
+		return err == nil, err
+	case Argon2id:
+		var version int
+		var memory, time uint32
+		var threads uint8
+
+		params, salt, key, err := split(encoded, 6)
+		if err != nil {
+			return false, err
+		}
+
+		if _, err := fmt.Sscanf(params[0], "v=%d", &version); err != nil || version != argon2.Version {
+			return false, ErrUnknownHash
+		}
+
+		if _, err := fmt.Sscanf(params[1], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+			return false, ErrUnknownHash
+		}
+
+		computed := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+
+		return subtle.ConstantTimeCompare(computed, key) == 1, nil
+	case Scrypt:
+		var logN uint8
+		var r, p int
+
+		params, salt, key, err := split(encoded, 5)
+		if err != nil {
+			return false, err
+		}
+
+		if _, err := fmt.Sscanf(params[0], "ln=%d,r=%d,p=%d", &logN, &r, &p); err != nil {
+			return false, ErrUnknownHash
+		}
+
+		computed, err := scrypt.Key([]byte(password), salt, 1<<logN, r, p, len(key))
+		if err != nil {
+			return false, err
+		}
+
+		return subtle.ConstantTimeCompare(computed, key) == 1, nil
+	}
+
+	return false, ErrUnknownHash
+}
+
+func (h *hasher) NeedsRehash(encoded string) bool {
+	if algorithm(encoded) != h.opts.Algorithm {
+		return true
+	}
+
+	switch h.opts.Algorithm {
+	case Bcrypt:
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return err != nil || cost < h.opts.BcryptCost
+	case Argon2id:
+		current := fmt.Sprintf("$m=%d,t=%d,p=%d$", h.opts.Argon2Memory, h.opts.Argon2Time, h.opts.Argon2Threads)
+		return !strings.Contains(encoded, current)
+	case Scrypt:
+		current := fmt.Sprintf("$ln=%d,r=%d,p=%d$", h.opts.ScryptLogN, h.opts.ScryptR, h.opts.ScryptP)
+		return !strings.Contains(encoded, current)
+	}
+
+	return true
+}
+
+func algorithm(encoded string) string {
+	switch {
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		return Bcrypt
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return Argon2id
+	case strings.HasPrefix(encoded, "$scrypt$"):
+		return Scrypt
+	}
+
+	return ""
+}
+
+// split parses $id$params...$salt$hash into the parameter fields, salt and hash
+func split(encoded string, fields int) ([]string, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != fields {
+		return nil, nil, nil, ErrUnknownHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[fields-2])
+	if err != nil {
+		return nil, nil, nil, ErrUnknownHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[fields-1])
+	if err != nil {
+		return nil, nil, nil, ErrUnknownHash
+	}
+
+	return parts[2 : fields-2], salt, key, nil
+}
+
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltLength)
+
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return salt, nil
+}
+
+func encode(b []byte) string {
+	return base64.RawStdEncoding.EncodeToString(b)
+}
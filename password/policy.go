@@ -0,0 +1,167 @@
+package password
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	ErrPasswordReused   = errors.New("password was used before, please choose another one")
+	ErrPasswordBreached = errors.New("password appears in a known data breach, please choose another one")
+)
+
+// Policy decides whether a password may be set. It is applied on every
+// password change: register, reset and update.
+type Policy interface {
+	// Check validates password against the rules. personal holds values the
+	// password must not contain (email, fullname), history holds the hashes
+	// of the user's current and previous passwords.
+	Check(password string, personal []string, history []string) error
+	// HistorySize is the number of previous hashes Check wants to see
+	HistorySize() int
+}
+
+type PolicyOptions struct {
+	MinLength int
+	MaxLength int
+
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+
+	// HistorySize previous passwords can't be reused, zero allows any
+	HistorySize int
+
+	// BreachedFile is a list of breached passwords, one per line, either
+	// plaintext or SHA-1 hex as in the Have I Been Pwned dumps
+	BreachedFile string
+}
+
+type policy struct {
+	opts     PolicyOptions
+	hasher   Hasher
+	breached *Bloom
+}
+
+func NewPolicy(opts PolicyOptions, hasher Hasher) (Policy, error) {
+	if opts.MinLength == 0 {
+		opts.MinLength = 8
+	}
+
+	if opts.MaxLength == 0 {
+		opts.MaxLength = 128
+	}
+
+	if opts.MaxLength < opts.MinLength {
+		return nil, fmt.Errorf("password max length %d is below min length %d", opts.MaxLength, opts.MinLength)
+	}
+
+	p := &policy{opts: opts, hasher: hasher}
+
+	if opts.BreachedFile != "" {
+		breached, err := LoadBreached(opts.BreachedFile)
+		if err != nil {
+			return nil, err
+		}
+
+		p.breached = breached
+	}
+
+	return p, nil
+}
+
+func (p *policy) HistorySize() int {
+	return p.opts.HistorySize
+}
+
+func (p *policy) Check(password string, personal []string, history []string) error {
+	length := utf8.RuneCountInString(password)
+	if length < p.opts.MinLength || length > p.opts.MaxLength {
+		return fmt.Errorf("password must be %d to %d characters long", p.opts.MinLength, p.opts.MaxLength)
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r), unicode.IsSymbol(r), unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+
+	if p.opts.RequireUpper && !upper {
+		return errors.New("password must contain an uppercase letter")
+	}
+
+	if p.opts.RequireLower && !lower {
+		return errors.New("password must contain a lowercase letter")
+	}
+
+	if p.opts.RequireDigit && !digit {
+		return errors.New("password must contain a digit")
+	}
+
+	if p.opts.RequireSymbol && !symbol {
+		return errors.New("password must contain a symbol")
+	}
+
+	lowered := strings.ToLower(password)
+	for _, value := range personal {
+		for _, part := range personalParts(value) {
+			if strings.Contains(lowered, part) {
+				return errors.New("password must not contain your email or name")
+			}
+		}
+	}
+
+	if p.breached != nil && p.breached.Contains(password) {
+		return ErrPasswordBreached
+	}
+
+	for i, encoded := range history {
+		if i >= p.opts.HistorySize {
+			break
+		}
+
+		reused, err := p.hasher.Verify(password, encoded)
+		if err != nil && err != ErrUnknownHash {
+			return err
+		}
+
+		if reused {
+			return ErrPasswordReused
+		}
+	}
+
+	return nil
+}
+
+// personalParts splits an email or full name into the pieces worth checking,
+// pieces shorter than 3 characters would reject too many passwords
+func personalParts(value string) []string {
+	var parts []string
+
+	value = strings.ToLower(value)
+	if i := strings.Index(value, "@"); i >= 0 {
+		value = value[:i]
+	}
+
+	for _, part := range strings.FieldsFunc(value, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if utf8.RuneCountInString(part) >= 3 {
+			parts = append(parts, part)
+		}
+	}
+
+	return parts
+}
@@ -0,0 +1,60 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/g-graziano/user-auth-golang/config"
+	"github.com/g-graziano/user-auth-golang/models"
+)
+
+// file appends every email to an mbox file instead of delivering it, for
+// development and tests. Any mail client can open the file.
+type file struct {
+	cfg config.Mail
+	mu  sync.Mutex
+}
+
+func newFile(cfg config.Mail) Mailer {
+	return &file{cfg: cfg}
+}
+
+func (f *file) Send(ctx context.Context, email *models.Email) error {
+	message, err := buildMessage(f.cfg, email)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out, err := os.OpenFile(f.cfg.FilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(out)
+	fmt.Fprintf(writer, "From %s %s\n", f.cfg.FromAddress, time.Now().UTC().Format(time.ANSIC))
+
+	// mboxrd: lines starting with From get one more > so readers can split messages
+	for _, line := range strings.Split(string(bytes.ReplaceAll(message, []byte("\r\n"), []byte("\n"))), "\n") {
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			line = ">" + line
+		}
+
+		fmt.Fprintln(writer, line)
+	}
+
+	if err := writer.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
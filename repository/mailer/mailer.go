@@ -0,0 +1,73 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/g-graziano/user-auth-golang/config"
+	"github.com/g-graziano/user-auth-golang/models"
+)
+
+// Supported drivers
+const (
+	SendGrid = "sendgrid"
+	SMTP     = "smtp"
+	File     = "file"
+)
+
+// Mailer delivers an email and reports the provider's error when it couldn't
+type Mailer interface {
+	Send(ctx context.Context, email *models.Email) error
+}
+
+// Recorder keeps a log of every send attempt, see WithRecorder
+type Recorder interface {
+	CreateSentEmail(ctx context.Context, sent *models.SentEmail) error
+}
+
+func New(cfg config.Mail) (Mailer, error) {
+	switch cfg.Driver {
+	case SendGrid:
+		return newSendGrid(cfg), nil
+	case SMTP:
+		return newSMTP(cfg), nil
+	case File:
+		return newFile(cfg), nil
+	}
+
+	return nil, fmt.Errorf("unsupported mail driver %q", cfg.Driver)
+}
+
+type recording struct {
+	mailer   Mailer
+	recorder Recorder
+	driver   string
+}
+
+// WithRecorder records the outcome of every email sent through m
+func WithRecorder(m Mailer, r Recorder, driver string) Mailer {
+	return &recording{mailer: m, recorder: r, driver: driver}
+}
+
+func (r *recording) Send(ctx context.Context, email *models.Email) error {
+	err := r.mailer.Send(ctx, email)
+
+	sent := &models.SentEmail{
+		Recipient: email.RecipientEmail,
+		Subject:   email.Subject,
+		Driver:    r.driver,
+		Status:    "sent",
+	}
+
+	if err != nil {
+		sent.Status = "failed"
+		sent.Error.String = err.Error()
+		sent.Error.Valid = true
+	}
+
+	if recordErr := r.recorder.CreateSentEmail(ctx, sent); recordErr != nil && err == nil {
+		return recordErr
+	}
+
+	return err
+}
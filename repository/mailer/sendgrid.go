@@ -0,0 +1,41 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/g-graziano/user-auth-golang/config"
+	"github.com/g-graziano/user-auth-golang/models"
+	"github.com/sendgrid/sendgrid-go"
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+)
+
+type sendGrid struct {
+	cfg    config.Mail
+	client *sendgrid.Client
+}
+
+func newSendGrid(cfg config.Mail) Mailer {
+	return &sendGrid{
+		cfg:    cfg,
+		client: sendgrid.NewSendClient(cfg.SendGridAPIKey),
+	}
+}
+
+func (s *sendGrid) Send(ctx context.Context, email *models.Email) error {
+	from := mail.NewEmail(s.cfg.FromName, s.cfg.FromAddress)
+	to := mail.NewEmail(email.RecipientName, email.RecipientEmail)
+
+	message := mail.NewSingleEmail(from, email.Subject, to, email.PlainContent, email.HTMLContent)
+
+	response, err := s.client.Send(message)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("sendgrid responded %d: %s", response.StatusCode, response.Body)
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+
+	"github.com/g-graziano/user-auth-golang/config"
+	"github.com/g-graziano/user-auth-golang/models"
+)
+
+type smtpMailer struct {
+	cfg config.Mail
+}
+
+func newSMTP(cfg config.Mail) Mailer {
+	return &smtpMailer{cfg: cfg}
+}
+
+// Send uses STARTTLS whenever the server offers it
+func (s *smtpMailer) Send(ctx context.Context, email *models.Email) error {
+	message, err := buildMessage(s.cfg, email)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if s.cfg.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", s.cfg.SMTPUsername, s.cfg.SMTPPassword, s.cfg.SMTPHost)
+	}
+
+	addr := net.JoinHostPort(s.cfg.SMTPHost, strconv.Itoa(s.cfg.SMTPPort))
+
+	return smtp.SendMail(addr, auth, s.cfg.FromAddress, []string{email.RecipientEmail}, message)
+}
+
+// buildMessage renders email as a multipart/alternative RFC 5322 message
+func buildMessage(cfg config.Mail, email *models.Email) ([]byte, error) {
+	boundary, err := randomBoundary()
+	if err != nil {
+		return nil, err
+	}
+
+	from := mail.Address{Name: cfg.FromName, Address: cfg.FromAddress}
+	to := mail.Address{Name: email.RecipientName, Address: email.RecipientEmail}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from.String())
+	fmt.Fprintf(&buf, "To: %s\r\n", to.String())
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", email.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", boundary, domain(cfg.FromAddress))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", boundary)
+
+	for _, part := range []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain", email.PlainContent},
+		{"text/html", email.HTMLContent},
+	} {
+		if part.body == "" {
+			continue
+		}
+
+		fmt.Fprintf(&buf, "--%s\r\n", boundary)
+		fmt.Fprintf(&buf, "Content-Type: %s; charset=utf-8\r\n", part.contentType)
+		fmt.Fprintf(&buf, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+		writer := quotedprintable.NewWriter(&buf)
+		if _, err := writer.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+
+		fmt.Fprintf(&buf, "\r\n")
+	}
+
+	fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+
+	return buf.Bytes(), nil
+}
+
+func randomBoundary() (string, error) {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func domain(address string) string {
+	for i := len(address) - 1; i >= 0; i-- {
+		if address[i] == '@' {
+			return address[i+1:]
+		}
+	}
+
+	return "localhost"
+}
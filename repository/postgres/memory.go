@@ -0,0 +1,927 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/g-graziano/user-auth-golang/helper"
+	"github.com/g-graziano/user-auth-golang/models"
+)
+
+// memory keeps every table in process memory, for tests and running without
+// a database. Queries follow the filters and ordering of the SQL in postgres.
+type memory struct {
+	store *memoryStore
+	// tx is set on the Postgres passed to a WithTx function
+	tx bool
+}
+
+type memoryStore struct {
+	mu sync.Mutex
+	// txMu serializes transactions, a rollback restores the tables as they
+	// were when the transaction began
+	txMu sync.Mutex
+
+	tables memoryTables
+}
+
+type memoryTables struct {
+	lastID uint64
+
+	users              []models.User
+	tfaLastSteps       map[uint64]int64
+	tokens             []models.UserToken
+	backupCodes        []models.BackupCodes
+	verificationTokens []models.VerificationToken
+	sentEmails         []models.SentEmail
+	outboxEmails       []models.OutboxEmail
+	passwordHistories  []models.PasswordHistory
+	clientIDs          []models.ClientID
+	events             []models.Event
+}
+
+// NewMemory returns an empty Postgres that lives in memory
+func NewMemory() Postgres {
+	return &memory{store: &memoryStore{}}
+}
+
+func (t *memoryTables) nextID() uint64 {
+	t.lastID++
+	return t.lastID
+}
+
+func (t memoryTables) clone() memoryTables {
+	t.users = append([]models.User(nil), t.users...)
+
+	tfaLastSteps := make(map[uint64]int64, len(t.tfaLastSteps))
+	for userID, step := range t.tfaLastSteps {
+		tfaLastSteps[userID] = step
+	}
+	t.tfaLastSteps = tfaLastSteps
+
+	t.tokens = append([]models.UserToken(nil), t.tokens...)
+	t.backupCodes = append([]models.BackupCodes(nil), t.backupCodes...)
+	t.verificationTokens = append([]models.VerificationToken(nil), t.verificationTokens...)
+	t.sentEmails = append([]models.SentEmail(nil), t.sentEmails...)
+	t.outboxEmails = append([]models.OutboxEmail(nil), t.outboxEmails...)
+	t.passwordHistories = append([]models.PasswordHistory(nil), t.passwordHistories...)
+	t.clientIDs = append([]models.ClientID(nil), t.clientIDs...)
+	t.events = append([]models.Event(nil), t.events...)
+
+	return t
+}
+
+// open locks the tables for one query, the returned func unlocks them
+func (m *memory) open(ctx context.Context) (*memoryTables, func(), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	m.store.mu.Lock()
+
+	return &m.store.tables, m.store.mu.Unlock, nil
+}
+
+func duplicateKey(constraint string) error {
+	return fmt.Errorf("duplicate key value violates unique constraint %q", constraint)
+}
+
+func (m *memory) WithTx(ctx context.Context, fn func(Postgres) error) error {
+	// nested calls join the outer transaction
+	if m.tx {
+		return fn(m)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.store.txMu.Lock()
+	defer m.store.txMu.Unlock()
+
+	m.store.mu.Lock()
+	snapshot := m.store.tables.clone()
+	m.store.mu.Unlock()
+
+	rollback := func() {
+		m.store.mu.Lock()
+		m.store.tables = snapshot
+		m.store.mu.Unlock()
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			rollback()
+			panic(r)
+		}
+	}()
+
+	if err := fn(&memory{store: m.store, tx: true}); err != nil {
+		rollback()
+		return err
+	}
+
+	return nil
+}
+
+func (m *memory) Primary() Postgres {
+	return m
+}
+
+func (m *memory) CreateUser(ctx context.Context, user *models.User) error {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, each := range t.users {
+		if each.XID == user.XID {
+			return duplicateKey("users_x_id_key")
+		}
+
+		if each.Email == user.Email {
+			return duplicateKey("users_email_key")
+		}
+	}
+
+	t.users = append(t.users, models.User{
+		ID:        t.nextID(),
+		XID:       user.XID,
+		Fullname:  user.Fullname,
+		Email:     user.Email,
+		Password:  user.Password,
+		Status:    "nonactive",
+		Locale:    user.Locale,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	})
+
+	return nil
+}
+
+func (m *memory) UpdateUser(ctx context.Context, user *models.User) error {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, each := range t.users {
+		if each.ID != user.ID && each.Email == user.Email {
+			return duplicateKey("users_email_key")
+		}
+	}
+
+	for i := range t.users {
+		if t.users[i].ID != user.ID {
+			continue
+		}
+
+		row := &t.users[i]
+		row.Email = user.Email
+		row.Fullname = user.Fullname
+		row.Password = user.Password
+		row.Location = user.Location
+		row.Bio = user.Bio
+		row.Web = user.Web
+		row.Picture = user.Picture
+		row.Status = user.Status
+		row.TFA = user.TFA
+		row.EnabledTfaAt = user.EnabledTfaAt
+		row.TFASecret = user.TFASecret
+		row.Locale = user.Locale
+		row.UpdatedAt = time.Now()
+	}
+
+	return nil
+}
+
+func (m *memory) UseTOTPStep(ctx context.Context, userID uint64, step int64) (bool, error) {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	for _, each := range t.users {
+		if each.ID != userID {
+			continue
+		}
+
+		if last, ok := t.tfaLastSteps[userID]; ok && last >= step {
+			return false, nil
+		}
+
+		if t.tfaLastSteps == nil {
+			t.tfaLastSteps = map[uint64]int64{}
+		}
+
+		t.tfaLastSteps[userID] = step
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (m *memory) GetUser(ctx context.Context, user *models.User) ([]*models.User, error) {
+	var match func(models.User) bool
+
+	if user.Email != "" && user.XID != "" {
+		// Search other user
+		match = func(u models.User) bool { return u.Email == user.Email && u.XID != user.XID }
+	} else if user.Email != "" {
+		match = func(u models.User) bool { return u.Email == user.Email && u.Status != "deleted" }
+	} else if user.XID != "" {
+		match = func(u models.User) bool { return u.XID == user.XID && u.Status != "deleted" }
+	} else if user.ID != 0 {
+		match = func(u models.User) bool { return u.ID == user.ID && u.Status != "deleted" }
+	} else {
+		return nil, nil
+	}
+
+	return m.findUsers(ctx, match)
+}
+
+func (m *memory) GetActiveUser(ctx context.Context, user *models.User) ([]*models.User, error) {
+	var match func(models.User) bool
+
+	if user.Email != "" {
+		match = func(u models.User) bool { return u.Email == user.Email }
+	} else if user.XID != "" {
+		match = func(u models.User) bool { return u.XID == user.XID }
+	} else if user.ID != 0 {
+		match = func(u models.User) bool { return u.ID == user.ID }
+	} else {
+		return nil, nil
+	}
+
+	return m.findUsers(ctx, func(u models.User) bool {
+		return u.Status == "active" && match(u)
+	})
+}
+
+func (m *memory) findUsers(ctx context.Context, match func(models.User) bool) ([]*models.User, error) {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var results []*models.User
+
+	for _, each := range t.users {
+		if match(each) {
+			user := each
+			results = append(results, &user)
+		}
+	}
+
+	return results, nil
+}
+
+func (m *memory) CreateToken(ctx context.Context, token *models.UserToken) error {
+	clientID, ok := helper.ClientID(ctx)
+	if !ok {
+		return errors.New("client id not found")
+	}
+
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	t.tokens = append(t.tokens, models.UserToken{
+		ID:           t.nextID(),
+		Token:        token.Token,
+		UserID:       token.UserID,
+		Status:       "active",
+		TokenType:    token.TokenType,
+		RefreshToken: token.RefreshToken,
+		Family:       token.Family,
+		IPAddress:    helper.NullStringFunc(helper.IPAddress(ctx), true),
+		ClientID:     clientID,
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+	})
+
+	return nil
+}
+
+func (m *memory) DeleteToken(ctx context.Context, token *models.UserToken) error {
+	var match func(models.UserToken) bool
+
+	if token.Family.Valid {
+		match = func(u models.UserToken) bool { return u.Family.Valid && u.Family.String == token.Family.String }
+	} else if token.RefreshToken != helper.NullStringFunc("", false) {
+		match = func(u models.UserToken) bool {
+			return u.RefreshToken.Valid && token.RefreshToken.Valid && u.RefreshToken.String == token.RefreshToken.String
+		}
+	} else if token.Token != "" && token.UserID != 0 {
+		match = func(u models.UserToken) bool { return u.Token != token.Token && u.UserID == token.UserID }
+	} else if token.Token != "" {
+		match = func(u models.UserToken) bool { return u.Token == token.Token }
+	} else if token.UserID != 0 {
+		// every session of the user
+		match = func(u models.UserToken) bool { return u.UserID == token.UserID }
+	} else if token.ClientID != 0 {
+		// every session issued to the client
+		match = func(u models.UserToken) bool { return u.ClientID == token.ClientID }
+	} else {
+		return nil
+	}
+
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for i := range t.tokens {
+		if match(t.tokens[i]) {
+			t.tokens[i].Status = "nonactive"
+			t.tokens[i].UpdatedAt = time.Now()
+		}
+	}
+
+	return nil
+}
+
+func (m *memory) ConsumeToken(ctx context.Context, token *models.UserToken) (bool, error) {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	consumed := false
+
+	for i := range t.tokens {
+		if t.tokens[i].Token == token.Token && t.tokens[i].Status == "active" {
+			t.tokens[i].Status = "consumed"
+			t.tokens[i].UpdatedAt = time.Now()
+			consumed = true
+		}
+	}
+
+	return consumed, nil
+}
+
+func (m *memory) GetToken(ctx context.Context, token *models.UserToken) ([]*models.UserToken, error) {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var results []*models.UserToken
+
+	for _, each := range t.tokens {
+		if (token.Token != "" && each.Token == token.Token) || (token.Token == "" && token.UserID != 0 && each.UserID == token.UserID) {
+			userToken := each
+			userToken.IPAddress = helper.NullString{}
+			userToken.ClientID = 0
+			results = append(results, &userToken)
+		}
+	}
+
+	return results, nil
+}
+
+func (m *memory) GetSession(ctx context.Context, token *models.UserToken) ([]*models.UserToken, error) {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var results []*models.UserToken
+
+	if token.UserID == 0 {
+		return results, nil
+	}
+
+	for _, each := range t.tokens {
+		if each.UserID == token.UserID && each.Status == "active" {
+			userToken := each
+			userToken.ClientName = t.clientName(each.ClientID)
+			results = append(results, &userToken)
+		}
+	}
+
+	return results, nil
+}
+
+func (t *memoryTables) clientName(id uint64) string {
+	for _, client := range t.clientIDs {
+		if client.ID == id {
+			return client.Name
+		}
+	}
+
+	return ""
+}
+
+func (m *memory) CreateBackUpCode(ctx context.Context, code *models.BackupCodes) error {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	t.backupCodes = append(t.backupCodes, models.BackupCodes{
+		ID:        t.nextID(),
+		UserID:    code.UserID,
+		Codes:     code.Codes,
+		CreatedAt: time.Now(),
+	})
+
+	return nil
+}
+
+func (m *memory) UseBackUpCode(ctx context.Context, code *models.BackupCodes) (bool, error) {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	used := false
+
+	for i := range t.backupCodes {
+		each := &t.backupCodes[i]
+		if each.UserID == code.UserID && each.Codes == code.Codes && !each.UsedAt.Valid {
+			each.UsedAt = helper.NullTime{NullTime: sql.NullTime{Time: time.Now(), Valid: true}}
+			used = true
+		}
+	}
+
+	return used, nil
+}
+
+func (m *memory) CountBackUpCode(ctx context.Context, userID uint64) (*models.BackupCodesStatus, error) {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var status models.BackupCodesStatus
+
+	for _, each := range t.backupCodes {
+		if each.UserID != userID {
+			continue
+		}
+
+		status.Total++
+
+		if !each.UsedAt.Valid {
+			status.Remaining++
+		}
+	}
+
+	return &status, nil
+}
+
+func (m *memory) DeleteBackUpCode(ctx context.Context, userID uint64) error {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	kept := t.backupCodes[:0]
+
+	for _, each := range t.backupCodes {
+		if each.UserID != userID {
+			kept = append(kept, each)
+		}
+	}
+
+	t.backupCodes = kept
+
+	return nil
+}
+
+func (m *memory) CreateVerificationToken(ctx context.Context, token *models.VerificationToken) error {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, each := range t.verificationTokens {
+		if each.TokenHash == token.TokenHash {
+			return duplicateKey("verification_tokens_token_hash_key")
+		}
+	}
+
+	t.verificationTokens = append(t.verificationTokens, models.VerificationToken{
+		ID:        t.nextID(),
+		TokenHash: token.TokenHash,
+		UserID:    token.UserID,
+		Purpose:   token.Purpose,
+		Data:      token.Data,
+		ExpiresAt: token.ExpiresAt,
+		CreatedAt: time.Now(),
+	})
+
+	return nil
+}
+
+func (m *memory) GetVerificationToken(ctx context.Context, tokenHash string) ([]*models.VerificationToken, error) {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var results []*models.VerificationToken
+
+	for _, each := range t.verificationTokens {
+		if each.TokenHash == tokenHash {
+			token := each
+			results = append(results, &token)
+		}
+	}
+
+	return results, nil
+}
+
+func (m *memory) UseVerificationToken(ctx context.Context, token *models.VerificationToken) (bool, error) {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	now := time.Now()
+	used := false
+
+	for i := range t.verificationTokens {
+		each := &t.verificationTokens[i]
+		if each.ID == token.ID && !each.UsedAt.Valid && each.ExpiresAt.After(now) {
+			each.UsedAt = helper.NullTime{NullTime: sql.NullTime{Time: now, Valid: true}}
+			used = true
+		}
+	}
+
+	return used, nil
+}
+
+func (m *memory) RevokeVerificationToken(ctx context.Context, userID uint64, purpose string) error {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for i := range t.verificationTokens {
+		each := &t.verificationTokens[i]
+		if each.UserID == userID && each.Purpose == purpose && !each.UsedAt.Valid {
+			each.UsedAt = helper.NullTime{NullTime: sql.NullTime{Time: time.Now(), Valid: true}}
+		}
+	}
+
+	return nil
+}
+
+func (m *memory) CreateSentEmail(ctx context.Context, sent *models.SentEmail) error {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	t.sentEmails = append(t.sentEmails, models.SentEmail{
+		ID:        t.nextID(),
+		Recipient: sent.Recipient,
+		Subject:   sent.Subject,
+		Driver:    sent.Driver,
+		Status:    sent.Status,
+		Error:     sent.Error,
+		CreatedAt: time.Now(),
+	})
+
+	return nil
+}
+
+func (m *memory) CreateOutboxEmail(ctx context.Context, email *models.OutboxEmail) error {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	t.outboxEmails = append(t.outboxEmails, models.OutboxEmail{
+		ID:             t.nextID(),
+		RecipientName:  email.RecipientName,
+		RecipientEmail: email.RecipientEmail,
+		Subject:        email.Subject,
+		HTMLContent:    email.HTMLContent,
+		PlainContent:   email.PlainContent,
+		Status:         models.OutboxPending,
+		NextAttemptAt:  time.Now(),
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	})
+
+	return nil
+}
+
+func (m *memory) ClaimOutboxEmails(ctx context.Context, limit int, lease time.Duration) ([]*models.OutboxEmail, error) {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	now := time.Now()
+
+	var due []*models.OutboxEmail
+
+	for i := range t.outboxEmails {
+		each := &t.outboxEmails[i]
+		if each.Status == models.OutboxPending && !each.NextAttemptAt.After(now) {
+			due = append(due, each)
+		}
+	}
+
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].NextAttemptAt.Before(due[j].NextAttemptAt)
+	})
+
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	var results []*models.OutboxEmail
+
+	for _, each := range due {
+		each.NextAttemptAt = now.Add(lease)
+
+		email := *each
+		results = append(results, &email)
+	}
+
+	return results, nil
+}
+
+func (m *memory) UpdateOutboxEmail(ctx context.Context, email *models.OutboxEmail) error {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for i := range t.outboxEmails {
+		each := &t.outboxEmails[i]
+		if each.ID == email.ID {
+			each.Status = email.Status
+			each.Attempts = email.Attempts
+			each.NextAttemptAt = email.NextAttemptAt
+			each.LastError = email.LastError
+			each.SentAt = email.SentAt
+			each.UpdatedAt = time.Now()
+		}
+	}
+
+	return nil
+}
+
+func (m *memory) GetOutboxEmails(ctx context.Context, status string, limit int, offset int) ([]*models.OutboxEmail, int, error) {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer unlock()
+
+	var matched []*models.OutboxEmail
+
+	// newest first
+	for i := len(t.outboxEmails) - 1; i >= 0; i-- {
+		if t.outboxEmails[i].Status == status {
+			email := t.outboxEmails[i]
+			email.HTMLContent = ""
+			email.PlainContent = ""
+			matched = append(matched, &email)
+		}
+	}
+
+	start, end := bounds(len(matched), limit, offset)
+
+	return matched[start:end], len(matched), nil
+}
+
+func (m *memory) RetryOutboxEmail(ctx context.Context, id uint64) (bool, error) {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	for i := range t.outboxEmails {
+		each := &t.outboxEmails[i]
+		if each.ID == id && each.Status == models.OutboxDead {
+			each.Status = models.OutboxPending
+			each.Attempts = 0
+			each.NextAttemptAt = time.Now()
+			each.UpdatedAt = each.NextAttemptAt
+
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (m *memory) CreatePasswordHistory(ctx context.Context, history *models.PasswordHistory) error {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	t.passwordHistories = append(t.passwordHistories, models.PasswordHistory{
+		ID:        t.nextID(),
+		UserID:    history.UserID,
+		Password:  history.Password,
+		CreatedAt: time.Now(),
+	})
+
+	return nil
+}
+
+func (m *memory) GetPasswordHistory(ctx context.Context, userID uint64, limit int) ([]*models.PasswordHistory, error) {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var results []*models.PasswordHistory
+
+	// rows are in insertion order, so newest first is the reverse
+	for i := len(t.passwordHistories) - 1; i >= 0; i-- {
+		if t.passwordHistories[i].UserID == userID {
+			history := t.passwordHistories[i]
+			results = append(results, &history)
+		}
+	}
+
+	start, end := bounds(len(results), limit, 0)
+
+	return results[start:end], nil
+}
+
+func (m *memory) CreateClientID(ctx context.Context, client *models.ClientID) error {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	t.clientIDs = append(t.clientIDs, models.ClientID{
+		ID:           t.nextID(),
+		API:          client.API,
+		Name:         client.Name,
+		Secret:       client.Secret,
+		Type:         client.Type,
+		RedirectURIs: client.RedirectURIs,
+		OwnerID:      client.OwnerID,
+	})
+
+	return nil
+}
+
+func (m *memory) GetClientID(ctx context.Context, client *models.ClientID) ([]*models.ClientID, error) {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var results []*models.ClientID
+
+	if client.API == "" && client.OwnerID == 0 {
+		return results, nil
+	}
+
+	for _, each := range t.clientIDs {
+		if client.API != "" && each.API == client.API || client.API == "" && each.OwnerID == client.OwnerID {
+			clientID := each
+			results = append(results, &clientID)
+		}
+	}
+
+	return results, nil
+}
+
+func (m *memory) DeleteClientID(ctx context.Context, client *models.ClientID) error {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for i := range t.clientIDs {
+		if t.clientIDs[i].ID == client.ID {
+			t.clientIDs = append(t.clientIDs[:i], t.clientIDs[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (m *memory) CreateEvent(ctx context.Context, event string, userID uint64) error {
+	// events caused by following an emailed link carry no API client
+	clientID, _ := helper.ClientID(ctx)
+
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	t.events = append(t.events, models.Event{
+		ID:        t.nextID(),
+		UserID:    userID,
+		Event:     event,
+		UA:        helper.UserAgent(ctx),
+		IPAddress: helper.NullStringFunc(helper.IPAddress(ctx), true),
+		ClientID:  clientID,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	})
+
+	return nil
+}
+
+func (m *memory) GetEvent(ctx context.Context, filter *models.EventFilter) ([]*models.Event, error) {
+	t, unlock, err := m.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var matched []*models.Event
+	total := 0
+
+	// newest first
+	for i := len(t.events) - 1; i >= 0; i-- {
+		each := t.events[i]
+
+		if each.UserID != filter.UserID ||
+			(filter.Event != "" && each.Event != filter.Event) ||
+			(filter.ClientID != 0 && each.ClientID != filter.ClientID) ||
+			(!filter.From.IsZero() && each.CreatedAt.Before(filter.From)) ||
+			(!filter.To.IsZero() && !each.CreatedAt.Before(filter.To)) {
+			continue
+		}
+
+		total++
+
+		if filter.BeforeID != 0 && each.ID >= filter.BeforeID {
+			continue
+		}
+
+		each.ClientName = t.clientName(each.ClientID)
+		matched = append(matched, &each)
+	}
+
+	offset := 0
+	if filter.BeforeID == 0 && filter.Page > 1 {
+		offset = (filter.Page - 1) * filter.PerPage
+	}
+
+	start, end := bounds(len(matched), filter.PerPage, offset)
+	results := matched[start:end]
+
+	for _, each := range results {
+		each.TotalEvent = total
+		each.RemainingEvent = len(matched)
+	}
+
+	return results, nil
+}
+
+// bounds applies LIMIT and OFFSET to n rows
+func bounds(n int, limit int, offset int) (int, int) {
+	if offset > n {
+		offset = n
+	}
+
+	if limit < 0 || offset+limit > n {
+		return offset, n
+	}
+
+	return offset, offset + limit
+}
@@ -0,0 +1,97 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/g-graziano/user-auth-golang/models"
+)
+
+func TestMemoryWithTx(t *testing.T) {
+	errRollback := errors.New("rollback")
+
+	tests := []struct {
+		name      string
+		fn        func(ctx context.Context, pg Postgres) error
+		wantErr   error
+		wantUsers int
+	}{
+		{
+			name: "commit",
+			fn: func(ctx context.Context, pg Postgres) error {
+				return pg.CreateUser(ctx, &models.User{XID: "b", Email: "b@example.com"})
+			},
+			wantUsers: 2,
+		},
+		{
+			name: "rollback on error",
+			fn: func(ctx context.Context, pg Postgres) error {
+				if err := pg.CreateUser(ctx, &models.User{XID: "b", Email: "b@example.com"}); err != nil {
+					return err
+				}
+
+				return errRollback
+			},
+			wantErr:   errRollback,
+			wantUsers: 1,
+		},
+		{
+			name: "nested joins the outer transaction",
+			fn: func(ctx context.Context, pg Postgres) error {
+				err := pg.WithTx(ctx, func(pg Postgres) error {
+					return pg.CreateUser(ctx, &models.User{XID: "b", Email: "b@example.com"})
+				})
+				if err != nil {
+					return err
+				}
+
+				return errRollback
+			},
+			wantErr:   errRollback,
+			wantUsers: 1,
+		},
+		{
+			name: "unique email",
+			fn: func(ctx context.Context, pg Postgres) error {
+				return pg.CreateUser(ctx, &models.User{XID: "b", Email: "a@example.com"})
+			},
+			wantErr:   duplicateKey("users_email_key"),
+			wantUsers: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			pg := NewMemory()
+
+			if err := pg.CreateUser(ctx, &models.User{XID: "a", Email: "a@example.com"}); err != nil {
+				t.Fatal(err)
+			}
+
+			err := pg.WithTx(ctx, func(tx Postgres) error {
+				return tt.fn(ctx, tx)
+			})
+
+			if (err == nil) != (tt.wantErr == nil) || (err != nil && err.Error() != tt.wantErr.Error()) {
+				t.Fatalf("WithTx() = %v, want %v", err, tt.wantErr)
+			}
+
+			users := 0
+
+			for _, xid := range []string{"a", "b"} {
+				found, err := pg.GetUser(ctx, &models.User{XID: xid})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				users += len(found)
+			}
+
+			if users != tt.wantUsers {
+				t.Fatalf("%d users after WithTx, want %d", users, tt.wantUsers)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package postgres
+
+import (
+	"database/sql"
+	"embed"
+	"io/fs"
+	"sort"
+
+	"github.com/g-graziano/user-auth-golang/migrate"
+)
+
+//go:embed migrations/*.sql migrations/sqlite/*.sql
+var migrations embed.FS
+
+// NewMigrator migrates the database at conn with the migrations embedded in
+// the binary. Close the returned database when done.
+func NewMigrator(conn string) (migrate.Migrator, *sql.DB, error) {
+	db, err := sql.Open("postgres", conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files, err := fs.Sub(migrations, "migrations")
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	return migrate.NewLocked(db, files), db, nil
+}
+
+// NewSQLiteMigrator is NewMigrator for the SQLite database file at path. The
+// migrations are shared, except those in migrations/sqlite rewriting the ones
+// with SQL specific to Postgres.
+func NewSQLiteMigrator(path string) (migrate.Migrator, *sql.DB, error) {
+	db, err := sql.Open("sqlite3", sqliteDSN(path))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	shared, err := fs.Sub(migrations, "migrations")
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	dialect, err := fs.Sub(migrations, "migrations/sqlite")
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	return migrate.New(db, overlayFS{shared: shared, dialect: dialect}), db, nil
+}
+
+// overlayFS lists the files of shared, replaced by the file of the same name
+// in dialect when there is one
+type overlayFS struct {
+	shared  fs.FS
+	dialect fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if f, err := o.dialect.Open(name); err == nil {
+		return f, nil
+	}
+
+	return o.shared.Open(name)
+}
+
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	byName := map[string]fs.DirEntry{}
+
+	for _, fsys := range []fs.FS{o.shared, o.dialect} {
+		entries, err := fs.ReadDir(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				byName[entry.Name()] = entry
+			}
+		}
+	}
+
+	var entries []fs.DirEntry
+	for _, entry := range byName {
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, nil
+}
@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS events;
+DROP TABLE IF EXISTS client_ids;
+DROP TABLE IF EXISTS outbox_emails;
+DROP TABLE IF EXISTS sent_emails;
+DROP TABLE IF EXISTS verification_tokens;
+DROP TABLE IF EXISTS password_histories;
+DROP TABLE IF EXISTS backup_codes;
+DROP TABLE IF EXISTS user_tokens;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,118 @@
+-- The schema GORM AutoMigrate used to create. IF NOT EXISTS lets databases
+-- created that way adopt the migrations as is.
+
+CREATE TABLE IF NOT EXISTS users (
+	id bigserial PRIMARY KEY,
+	x_id text UNIQUE,
+	email varchar(255) NOT NULL UNIQUE,
+	fullname varchar(255) NOT NULL,
+	location varchar(255),
+	bio varchar(255),
+	web varchar(255),
+	picture varchar(255),
+	password varchar(255) NOT NULL,
+	status text NOT NULL DEFAULT 'nonactive',
+	tfa varchar(255) NOT NULL DEFAULT false,
+	enabled_tfa_at timestamp with time zone,
+	tfa_secret varchar(255),
+	locale varchar(8) NOT NULL DEFAULT 'en',
+	created_at timestamp with time zone NOT NULL,
+	updated_at timestamp with time zone NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_tokens (
+	id bigserial PRIMARY KEY,
+	user_id bigint NOT NULL,
+	token text NOT NULL,
+	token_type text NOT NULL,
+	refresh_token text,
+	family varchar(255),
+	status varchar(255) NOT NULL,
+	ip_address text,
+	client_id bigint,
+	created_at timestamp with time zone NOT NULL,
+	updated_at timestamp with time zone NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS backup_codes (
+	id bigserial PRIMARY KEY,
+	user_id bigint NOT NULL,
+	codes text NOT NULL,
+	used_at timestamp with time zone,
+	created_at timestamp with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_backup_codes_user_id ON backup_codes (user_id);
+
+CREATE TABLE IF NOT EXISTS password_histories (
+	id bigserial PRIMARY KEY,
+	user_id bigint NOT NULL,
+	password varchar(255) NOT NULL,
+	created_at timestamp with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_password_histories_user_id ON password_histories (user_id);
+
+CREATE TABLE IF NOT EXISTS verification_tokens (
+	id bigserial PRIMARY KEY,
+	token_hash varchar(64) NOT NULL UNIQUE,
+	user_id bigint NOT NULL,
+	purpose varchar(32) NOT NULL,
+	data varchar(255),
+	expires_at timestamp with time zone NOT NULL,
+	used_at timestamp with time zone,
+	created_at timestamp with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_verification_tokens_user_id ON verification_tokens (user_id);
+
+CREATE TABLE IF NOT EXISTS sent_emails (
+	id bigserial PRIMARY KEY,
+	recipient varchar(255) NOT NULL,
+	subject varchar(255) NOT NULL,
+	driver varchar(32) NOT NULL,
+	status varchar(32) NOT NULL,
+	error text,
+	created_at timestamp with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_sent_emails_recipient ON sent_emails (recipient);
+
+CREATE TABLE IF NOT EXISTS outbox_emails (
+	id bigserial PRIMARY KEY,
+	recipient_name varchar(255) NOT NULL,
+	recipient_email varchar(255) NOT NULL,
+	subject varchar(255) NOT NULL,
+	html_content text NOT NULL,
+	plain_content text NOT NULL,
+	status varchar(16) NOT NULL DEFAULT 'pending',
+	attempts integer NOT NULL DEFAULT 0,
+	next_attempt_at timestamp with time zone NOT NULL,
+	last_error text,
+	sent_at timestamp with time zone,
+	created_at timestamp with time zone NOT NULL,
+	updated_at timestamp with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_outbox_emails_status ON outbox_emails (status);
+CREATE INDEX IF NOT EXISTS idx_outbox_emails_next_attempt_at ON outbox_emails (next_attempt_at);
+
+CREATE TABLE IF NOT EXISTS client_ids (
+	id bigserial PRIMARY KEY,
+	api text NOT NULL,
+	name text NOT NULL,
+	secret varchar(255),
+	type text NOT NULL DEFAULT 'confidential',
+	redirect_uris text NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS events (
+	id bigserial PRIMARY KEY,
+	user_id bigint NOT NULL,
+	event text,
+	ua text,
+	ip_address text,
+	client_id bigint,
+	created_at timestamp with time zone NOT NULL,
+	updated_at timestamp with time zone NOT NULL
+);
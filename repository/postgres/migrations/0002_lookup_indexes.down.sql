@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_client_ids_api;
+DROP INDEX IF EXISTS idx_events_user_id_created_at;
+DROP INDEX IF EXISTS idx_events_user_id_id;
+DROP INDEX IF EXISTS idx_user_tokens_user_id_status;
+DROP INDEX IF EXISTS idx_user_tokens_family;
+DROP INDEX IF EXISTS idx_user_tokens_refresh_token;
+DROP INDEX IF EXISTS idx_user_tokens_token;
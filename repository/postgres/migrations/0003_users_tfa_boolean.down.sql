@@ -0,0 +1,3 @@
+ALTER TABLE users ALTER COLUMN tfa DROP DEFAULT;
+ALTER TABLE users ALTER COLUMN tfa TYPE varchar(255) USING tfa::text;
+ALTER TABLE users ALTER COLUMN tfa SET DEFAULT false;
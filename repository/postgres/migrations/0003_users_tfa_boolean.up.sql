@@ -0,0 +1,4 @@
+-- AutoMigrate created tfa as varchar holding 'true' or 'false'
+ALTER TABLE users ALTER COLUMN tfa DROP DEFAULT;
+ALTER TABLE users ALTER COLUMN tfa TYPE boolean USING tfa::boolean;
+ALTER TABLE users ALTER COLUMN tfa SET DEFAULT false;
@@ -0,0 +1 @@
+ALTER TABLE users DROP COLUMN tfa_last_step;
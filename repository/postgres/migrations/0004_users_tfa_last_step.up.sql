@@ -0,0 +1,2 @@
+-- the time step of the last accepted TOTP code, a code is only accepted once
+ALTER TABLE users ADD COLUMN tfa_last_step bigint;
@@ -0,0 +1,3 @@
+DROP INDEX idx_client_ids_owner_id;
+
+ALTER TABLE client_ids DROP COLUMN owner_id;
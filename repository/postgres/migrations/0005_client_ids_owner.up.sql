@@ -0,0 +1,10 @@
+-- databases created by AutoMigrate before OAuth have neither column
+ALTER TABLE client_ids ADD COLUMN IF NOT EXISTS type text NOT NULL DEFAULT 'confidential';
+ALTER TABLE client_ids ADD COLUMN IF NOT EXISTS redirect_uris text NOT NULL DEFAULT '';
+
+-- OAuth clients record the user who registered them. Clients without redirect
+-- uri are the first party API clients, the only ones X-API-ClientID accepts.
+ALTER TABLE client_ids ADD COLUMN owner_id bigint;
+UPDATE client_ids SET type = 'first_party' WHERE redirect_uris = '';
+
+CREATE INDEX idx_client_ids_owner_id ON client_ids (owner_id);
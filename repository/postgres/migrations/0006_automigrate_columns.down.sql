@@ -0,0 +1 @@
+-- the columns are part of 0001_init on databases it created, they are kept
@@ -0,0 +1,11 @@
+-- CREATE TABLE IF NOT EXISTS in 0001_init skipped the tables of databases
+-- created by AutoMigrate, add the columns they miss. Existing rows get the
+-- column default, created_at keeps no default afterwards.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tfa_secret varchar(255);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locale varchar(8) NOT NULL DEFAULT 'en';
+
+ALTER TABLE backup_codes ADD COLUMN IF NOT EXISTS used_at timestamp with time zone;
+ALTER TABLE backup_codes ADD COLUMN IF NOT EXISTS created_at timestamp with time zone NOT NULL DEFAULT now();
+ALTER TABLE backup_codes ALTER COLUMN created_at DROP DEFAULT;
+
+ALTER TABLE client_ids ADD COLUMN IF NOT EXISTS secret varchar(255);
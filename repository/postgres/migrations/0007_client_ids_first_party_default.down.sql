@@ -0,0 +1 @@
+ALTER TABLE client_ids ALTER COLUMN type SET DEFAULT 'confidential';
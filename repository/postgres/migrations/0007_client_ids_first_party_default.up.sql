@@ -0,0 +1,3 @@
+-- rows inserted by hand are first party API clients, OAuth clients are
+-- registered with their type
+ALTER TABLE client_ids ALTER COLUMN type SET DEFAULT 'first_party';
@@ -0,0 +1,118 @@
+-- 0001_init for SQLite. Times are declared timestamp and stored as UTC text,
+-- which the driver scans back into time.Time.
+
+CREATE TABLE IF NOT EXISTS users (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	x_id text UNIQUE,
+	email text NOT NULL UNIQUE,
+	fullname text NOT NULL,
+	location text,
+	bio text,
+	web text,
+	picture text,
+	password text NOT NULL,
+	status text NOT NULL DEFAULT 'nonactive',
+	tfa boolean NOT NULL DEFAULT false,
+	enabled_tfa_at timestamp,
+	tfa_secret text,
+	locale text NOT NULL DEFAULT 'en',
+	created_at timestamp NOT NULL,
+	updated_at timestamp NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_tokens (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	user_id integer NOT NULL,
+	token text NOT NULL,
+	token_type text NOT NULL,
+	refresh_token text,
+	family text,
+	status text NOT NULL,
+	ip_address text,
+	client_id integer,
+	created_at timestamp NOT NULL,
+	updated_at timestamp NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS backup_codes (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	user_id integer NOT NULL,
+	codes text NOT NULL,
+	used_at timestamp,
+	created_at timestamp NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_backup_codes_user_id ON backup_codes (user_id);
+
+CREATE TABLE IF NOT EXISTS password_histories (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	user_id integer NOT NULL,
+	password text NOT NULL,
+	created_at timestamp NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_password_histories_user_id ON password_histories (user_id);
+
+CREATE TABLE IF NOT EXISTS verification_tokens (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	token_hash text NOT NULL UNIQUE,
+	user_id integer NOT NULL,
+	purpose text NOT NULL,
+	data text,
+	expires_at timestamp NOT NULL,
+	used_at timestamp,
+	created_at timestamp NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_verification_tokens_user_id ON verification_tokens (user_id);
+
+CREATE TABLE IF NOT EXISTS sent_emails (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	recipient text NOT NULL,
+	subject text NOT NULL,
+	driver text NOT NULL,
+	status text NOT NULL,
+	error text,
+	created_at timestamp NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_sent_emails_recipient ON sent_emails (recipient);
+
+CREATE TABLE IF NOT EXISTS outbox_emails (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	recipient_name text NOT NULL,
+	recipient_email text NOT NULL,
+	subject text NOT NULL,
+	html_content text NOT NULL,
+	plain_content text NOT NULL,
+	status text NOT NULL DEFAULT 'pending',
+	attempts integer NOT NULL DEFAULT 0,
+	next_attempt_at timestamp NOT NULL,
+	last_error text,
+	sent_at timestamp,
+	created_at timestamp NOT NULL,
+	updated_at timestamp NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_outbox_emails_status ON outbox_emails (status);
+CREATE INDEX IF NOT EXISTS idx_outbox_emails_next_attempt_at ON outbox_emails (next_attempt_at);
+
+CREATE TABLE IF NOT EXISTS client_ids (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	api text NOT NULL,
+	name text NOT NULL,
+	secret text,
+	type text NOT NULL DEFAULT 'confidential',
+	redirect_uris text NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS events (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	user_id integer NOT NULL,
+	event text,
+	ua text,
+	ip_address text,
+	client_id integer,
+	created_at timestamp NOT NULL,
+	updated_at timestamp NOT NULL
+);
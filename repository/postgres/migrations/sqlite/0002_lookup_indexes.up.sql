@@ -0,0 +1,12 @@
+-- sessions are looked up by access token, refresh token, family and user
+CREATE INDEX IF NOT EXISTS idx_user_tokens_token ON user_tokens (token);
+CREATE INDEX IF NOT EXISTS idx_user_tokens_refresh_token ON user_tokens (refresh_token);
+CREATE INDEX IF NOT EXISTS idx_user_tokens_family ON user_tokens (family);
+CREATE INDEX IF NOT EXISTS idx_user_tokens_user_id_status ON user_tokens (user_id, status);
+
+-- the activity list pages by id and filters by date
+CREATE INDEX IF NOT EXISTS idx_events_user_id_id ON events (user_id, id);
+CREATE INDEX IF NOT EXISTS idx_events_user_id_created_at ON events (user_id, created_at);
+
+-- every API request resolves its client id
+CREATE INDEX IF NOT EXISTS idx_client_ids_api ON client_ids (api);
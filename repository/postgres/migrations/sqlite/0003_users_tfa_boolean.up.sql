@@ -0,0 +1 @@
+-- users.tfa is created boolean by 0001_init on SQLite
@@ -0,0 +1 @@
+-- SQLite databases are always created by 0001_init, which has the columns
@@ -0,0 +1,19 @@
+-- SQLite can't change a column default, the table is copied into a new one
+CREATE TABLE client_ids_new (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	api text NOT NULL,
+	name text NOT NULL,
+	secret text,
+	type text NOT NULL DEFAULT 'confidential',
+	redirect_uris text NOT NULL DEFAULT '',
+	owner_id bigint
+);
+
+INSERT INTO client_ids_new (id, api, name, secret, type, redirect_uris, owner_id)
+	SELECT id, api, name, secret, type, redirect_uris, owner_id FROM client_ids;
+
+DROP TABLE client_ids;
+ALTER TABLE client_ids_new RENAME TO client_ids;
+
+CREATE INDEX idx_client_ids_api ON client_ids (api);
+CREATE INDEX idx_client_ids_owner_id ON client_ids (owner_id);
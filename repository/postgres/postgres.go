@@ -3,115 +3,195 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/g-graziano/user-auth-golang/helper"
 	"github.com/g-graziano/user-auth-golang/models"
-	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/lib/pq"
 )
 
 type postgres struct {
-	// gorms []*gorm.DB
 	DB []*sql.DB
+	tx *sql.Tx
+
+	// replicas serve the reads that tolerate lag, nil without replicas
+	replicas *replicas
+	// primary sends every read to the primary, see Primary
+	primary bool
+	// sqlite runs the queries on SQLite instead, see NewSQLite
+	sqlite bool
+}
+
+// executor is what queries run on, the connection pool or a transaction
+type executor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
 }
 
 type Postgres interface {
+	// WithTx runs fn in a transaction, every call on the Postgres passed to fn
+	// is part of it. It commits when fn returns nil and rolls back otherwise.
+	WithTx(ctx context.Context, fn func(Postgres) error) error
+
+	// Primary reads from the primary only, for reads that must see the
+	// latest writes, such as a read before an update or a uniqueness check.
+	// GetUser, GetSession, GetEvent and GetClientID otherwise go to a replica.
+	Primary() Postgres
+
 	// User
-	CreateUser(user *models.User) error
-	UpdateUser(user *models.User) error
-	GetUser(user *models.User) ([]*models.User, error)
-	GetActiveUser(user *models.User) ([]*models.User, error)
+	CreateUser(ctx context.Context, user *models.User) error
+	UpdateUser(ctx context.Context, user *models.User) error
+	GetUser(ctx context.Context, user *models.User) ([]*models.User, error)
+	GetActiveUser(ctx context.Context, user *models.User) ([]*models.User, error)
+	UseTOTPStep(ctx context.Context, userID uint64, step int64) (bool, error)
 
 	// Token
 	CreateToken(ctx context.Context, token *models.UserToken) error
-	DeleteToken(token *models.UserToken) error
-	GetToken(token *models.UserToken) ([]*models.UserToken, error)
+	DeleteToken(ctx context.Context, token *models.UserToken) error
+	ConsumeToken(ctx context.Context, token *models.UserToken) (bool, error)
+	GetToken(ctx context.Context, token *models.UserToken) ([]*models.UserToken, error)
 
-	GetSession(token *models.UserToken) ([]*models.UserToken, error)
+	GetSession(ctx context.Context, token *models.UserToken) ([]*models.UserToken, error)
 
 	//BackupCode
-	CreateBackUpCode(code *models.BackupCodes) error
-	GetBackUpCode(code *models.BackupCodes) ([]*models.BackupCodes, error)
+	CreateBackUpCode(ctx context.Context, code *models.BackupCodes) error
+	UseBackUpCode(ctx context.Context, code *models.BackupCodes) (bool, error)
+	CountBackUpCode(ctx context.Context, userID uint64) (*models.BackupCodesStatus, error)
+	DeleteBackUpCode(ctx context.Context, userID uint64) error
+
+	//VerificationToken
+	CreateVerificationToken(ctx context.Context, token *models.VerificationToken) error
+	GetVerificationToken(ctx context.Context, tokenHash string) ([]*models.VerificationToken, error)
+	UseVerificationToken(ctx context.Context, token *models.VerificationToken) (bool, error)
+	RevokeVerificationToken(ctx context.Context, userID uint64, purpose string) error
+
+	//SentEmail
+	CreateSentEmail(ctx context.Context, sent *models.SentEmail) error
+
+	//Outbox
+	CreateOutboxEmail(ctx context.Context, email *models.OutboxEmail) error
+	ClaimOutboxEmails(ctx context.Context, limit int, lease time.Duration) ([]*models.OutboxEmail, error)
+	UpdateOutboxEmail(ctx context.Context, email *models.OutboxEmail) error
+	GetOutboxEmails(ctx context.Context, status string, limit int, offset int) ([]*models.OutboxEmail, int, error)
+	RetryOutboxEmail(ctx context.Context, id uint64) (bool, error)
+
+	//PasswordHistory
+	CreatePasswordHistory(ctx context.Context, history *models.PasswordHistory) error
+	GetPasswordHistory(ctx context.Context, userID uint64, limit int) ([]*models.PasswordHistory, error)
 
 	//ClientID
-	GetClientID(code *models.ClientID) ([]*models.ClientID, error)
+	CreateClientID(ctx context.Context, client *models.ClientID) error
+	GetClientID(ctx context.Context, code *models.ClientID) ([]*models.ClientID, error)
+	DeleteClientID(ctx context.Context, client *models.ClientID) error
 
 	//Event
 	CreateEvent(ctx context.Context, event string, userID uint64) error
-	GetEvent(user *models.User, limit int, offset int) ([]*models.Event, error)
+	GetEvent(ctx context.Context, filter *models.EventFilter) ([]*models.Event, error)
 }
 
+// New connects to the primary, the first conn, and the read replicas after it
 func New(conn ...string) Postgres {
-	// var gorms []*gorm.DB
 	var DBS []*sql.DB
-	for _, eachConn := range conn {
+	for i, eachConn := range conn {
 		DB, err := sql.Open("postgres", eachConn)
 
-		defer func() {
-			if r := recover(); r != nil {
-				fmt.Println("msg:", r)
-				defer DB.Close()
-			}
-		}()
-
 		if err != nil {
 			panic(err)
 		}
 
-		err = DB.Ping()
+		// a replica that is down is only skipped until it comes back
+		if i == 0 {
+			if err := DB.Ping(); err != nil {
+				panic(err)
+			}
 
-		if err != nil {
-			panic(err)
+			fmt.Println("Database connected!")
 		}
 
-		fmt.Println("Database connected!")
 		DBS = append(DBS, DB)
+	}
 
-		// GORM for auto migrate database
-		dbConn, err := gorm.Open("postgres", eachConn)
-		if err != nil && dbConn == nil {
-			fmt.Println(1, err, eachConn)
-			continue
-		}
-		err = dbConn.DB().Ping()
-		if err != nil {
-			fmt.Println(2, err)
-			continue
-		}
+	p := &postgres{DB: DBS}
+	if len(DBS) > 1 {
+		p.replicas = newReplicas(DBS[1:])
+	}
 
-		dbConn.Debug().AutoMigrate(
-			&models.User{},
-			&models.UserToken{},
-			&models.BackupCodes{},
-			&models.ClientID{},
-			&models.Event{},
-		)
+	return p
+}
+
+func (p *postgres) Primary() Postgres {
+	if p.primary || p.tx != nil {
+		return p
+	}
+
+	primary := *p
+	primary.primary = true
+
+	return &primary
+}
+
+func (p *postgres) db() executor {
+	var db executor = p.DB[0]
+	if p.tx != nil {
+		db = p.tx
+	}
+
+	if p.sqlite {
+		return sqliteExecutor{db}
+	}
+
+	return db
+}
 
-		// gorms = append(gorms, dbConn)
+func (p *postgres) WithTx(ctx context.Context, fn func(Postgres) error) error {
+	// nested calls join the outer transaction
+	if p.tx != nil {
+		return fn(p)
 	}
-	// return &postgres{gorms: gorms, DB: DBS}
-	return &postgres{DB: DBS}
+
+	tx, err := p.DB[0].BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			panic(r)
+		}
+	}()
+
+	if err := fn(&postgres{DB: p.DB, tx: tx, sqlite: p.sqlite}); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (p *postgres) CreateUser(user *models.User) error {
-	_, err := p.DB[0].Exec(`
+func (p *postgres) CreateUser(ctx context.Context, user *models.User) error {
+	_, err := p.db().ExecContext(ctx, `
 		INSERT INTO USERS (
 			x_id,
 			fullname, 
 			email, 
 			password,
 			status,
+			locale,
 			created_at,
 			updated_at
-		) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
 		user.XID,
 		user.Fullname,
 		user.Email,
 		user.Password,
 		"nonactive",
+		user.Locale,
 		time.Now(),
 		time.Now(),
 	)
@@ -123,10 +203,10 @@ func (p *postgres) CreateUser(user *models.User) error {
 	return nil
 }
 
-func (p *postgres) UpdateUser(user *models.User) error {
+func (p *postgres) UpdateUser(ctx context.Context, user *models.User) error {
 	updatedAt := time.Now()
 
-	_, err := p.DB[0].Exec(`
+	_, err := p.db().ExecContext(ctx, `
 		UPDATE USERS SET 
 			email = $1, 
 			fullname = $2,
@@ -138,8 +218,10 @@ func (p *postgres) UpdateUser(user *models.User) error {
 			status = $8,
 			tfa = $9,
 			enabled_tfa_at = $10,
-			updated_at = $11
-		WHERE id=$12`,
+			tfa_secret = $11,
+			locale = $12,
+			updated_at = $13
+		WHERE id=$14`,
 		user.Email,
 		user.Fullname,
 		user.Password,
@@ -150,6 +232,8 @@ func (p *postgres) UpdateUser(user *models.User) error {
 		user.Status,
 		user.TFA,
 		user.EnabledTfaAt,
+		user.TFASecret,
+		user.Locale,
 		updatedAt,
 		user.ID,
 	)
@@ -161,14 +245,38 @@ func (p *postgres) UpdateUser(user *models.User) error {
 	return nil
 }
 
-func (p *postgres) GetUser(user *models.User) ([]*models.User, error) {
+// UseTOTPStep records step as the time step of the last accepted TOTP code, it
+// reports false when a code of the same or a later step was accepted before so
+// a code can't be replayed
+func (p *postgres) UseTOTPStep(ctx context.Context, userID uint64, step int64) (bool, error) {
+	result, err := p.db().ExecContext(ctx, `
+		UPDATE USERS SET
+			tfa_last_step = $1
+		WHERE id = $2 and (tfa_last_step IS NULL or tfa_last_step < $1)`,
+		step,
+		userID,
+	)
+
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+func (p *postgres) GetUser(ctx context.Context, user *models.User) ([]*models.User, error) {
 	var allUser []*models.User
 	var rows *sql.Rows
 	var err error
 
 	if user.Email != "" && user.XID != "" {
 		// Search other user
-		rows, err = p.DB[0].Query(`
+		rows, err = p.readQuery(ctx, `
 			SELECT 
 				id, 
 				x_id,
@@ -182,12 +290,14 @@ func (p *postgres) GetUser(user *models.User) ([]*models.User, error) {
 				status,
 				tfa,
 				enabled_tfa_at,
+				tfa_secret,
+				locale,
 				created_at,
 				updated_at 
 			FROM USERS WHERE email = $1 and x_id != $2`, user.Email, user.XID)
 	} else if user.Email != "" {
 		// Search user by email status != deleted
-		rows, err = p.DB[0].Query(`
+		rows, err = p.readQuery(ctx, `
 			SELECT 
 				id, 
 				x_id,
@@ -201,11 +311,13 @@ func (p *postgres) GetUser(user *models.User) ([]*models.User, error) {
 				status,
 				tfa,
 				enabled_tfa_at,
+				tfa_secret,
+				locale,
 				created_at,
 				updated_at 
 			FROM USERS WHERE email = $1 and status != 'deleted'`, user.Email)
 	} else if user.XID != "" {
-		rows, err = p.DB[0].Query(`
+		rows, err = p.readQuery(ctx, `
 			SELECT 
 				id, 
 				x_id,
@@ -219,9 +331,33 @@ func (p *postgres) GetUser(user *models.User) ([]*models.User, error) {
 				status,
 				tfa,
 				enabled_tfa_at,
+				tfa_secret,
+				locale,
 				created_at,
 				updated_at 
 			FROM USERS WHERE x_id = $1 and status != 'deleted'`, user.XID)
+	} else if user.ID != 0 {
+		rows, err = p.readQuery(ctx, `
+			SELECT 
+				id, 
+				x_id,
+				fullname,
+				email,
+				password,
+				location,
+				bio,
+				web,
+				picture,
+				status,
+				tfa,
+				enabled_tfa_at,
+				tfa_secret,
+				locale,
+				created_at,
+				updated_at 
+			FROM USERS WHERE id = $1 and status != 'deleted'`, user.ID)
+	} else {
+		return allUser, nil
 	}
 
 	if err != nil {
@@ -245,6 +381,8 @@ func (p *postgres) GetUser(user *models.User) ([]*models.User, error) {
 			&user.Status,
 			&user.TFA,
 			&user.EnabledTfaAt,
+			&user.TFASecret,
+			&user.Locale,
 			&user.CreatedAt,
 			&user.UpdatedAt,
 		); err != nil {
@@ -257,13 +395,13 @@ func (p *postgres) GetUser(user *models.User) ([]*models.User, error) {
 	return allUser, nil
 }
 
-func (p *postgres) GetActiveUser(user *models.User) ([]*models.User, error) {
+func (p *postgres) GetActiveUser(ctx context.Context, user *models.User) ([]*models.User, error) {
 	var allUser []*models.User
 	var rows *sql.Rows
 	var err error
 
 	if user.Email != "" {
-		rows, err = p.DB[0].Query(`
+		rows, err = p.db().QueryContext(ctx, `
 			SELECT 
 				id, 
 				x_id,
@@ -277,11 +415,13 @@ func (p *postgres) GetActiveUser(user *models.User) ([]*models.User, error) {
 				status,
 				tfa,
 				enabled_tfa_at,
+				tfa_secret,
+				locale,
 				created_at,
 				updated_at 
 			FROM USERS WHERE email = $1 and status = 'active'`, user.Email)
 	} else if user.XID != "" {
-		rows, err = p.DB[0].Query(`
+		rows, err = p.db().QueryContext(ctx, `
 			SELECT 
 				id, 
 				x_id,
@@ -295,9 +435,33 @@ func (p *postgres) GetActiveUser(user *models.User) ([]*models.User, error) {
 				status,
 				tfa,
 				enabled_tfa_at,
+				tfa_secret,
+				locale,
 				created_at,
 				updated_at 
 			FROM USERS WHERE x_id = $1 and status = 'active'`, user.XID)
+	} else if user.ID != 0 {
+		rows, err = p.db().QueryContext(ctx, `
+			SELECT 
+				id, 
+				x_id,
+				fullname,
+				email,
+				password,
+				location,
+				bio,
+				web,
+				picture,
+				status,
+				tfa,
+				enabled_tfa_at,
+				tfa_secret,
+				locale,
+				created_at,
+				updated_at 
+			FROM USERS WHERE id = $1 and status = 'active'`, user.ID)
+	} else {
+		return allUser, nil
 	}
 
 	if err != nil {
@@ -321,6 +485,8 @@ func (p *postgres) GetActiveUser(user *models.User) ([]*models.User, error) {
 			&user.Status,
 			&user.TFA,
 			&user.EnabledTfaAt,
+			&user.TFASecret,
+			&user.Locale,
 			&user.CreatedAt,
 			&user.UpdatedAt,
 		); err != nil {
@@ -334,31 +500,31 @@ func (p *postgres) GetActiveUser(user *models.User) ([]*models.User, error) {
 }
 
 func (p *postgres) CreateToken(ctx context.Context, token *models.UserToken) error {
-	ipAddress := fmt.Sprintf("%v", ctx.Value(helper.StringToInterface("ip-address")))
-	clientID, err := strconv.ParseUint(fmt.Sprintf("%v", ctx.Value(helper.StringToInterface("client-id"))), 0, 64)
-
-	if err != nil {
-		return err
+	clientID, ok := helper.ClientID(ctx)
+	if !ok {
+		return errors.New("client id not found")
 	}
 
-	_, err = p.DB[0].Exec(`
+	_, err := p.db().ExecContext(ctx, `
 		INSERT INTO USER_TOKENS (
 			token,
 			user_id,
 			status,
 			token_type,
 			refresh_token,
+			family,
 			ip_address,
 			client_id,
 			created_at,
 			updated_at
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
 		token.Token,
 		token.UserID,
 		"active",
 		token.TokenType,
 		token.RefreshToken,
-		ipAddress,
+		token.Family,
+		helper.IPAddress(ctx),
 		clientID,
 		time.Now(),
 		time.Now(),
@@ -371,11 +537,21 @@ func (p *postgres) CreateToken(ctx context.Context, token *models.UserToken) err
 	return nil
 }
 
-func (p *postgres) DeleteToken(token *models.UserToken) error {
+func (p *postgres) DeleteToken(ctx context.Context, token *models.UserToken) error {
 	var err error
 	updatedAt := time.Now()
-	if token.RefreshToken != helper.NullStringFunc("", false) {
-		_, err = p.DB[0].Exec(`
+	if token.Family.Valid {
+		_, err = p.db().ExecContext(ctx, `
+			UPDATE USER_TOKENS SET
+				status = $1,
+				updated_at = $2
+			WHERE family = $3`,
+			"nonactive",
+			updatedAt,
+			token.Family,
+		)
+	} else if token.RefreshToken != helper.NullStringFunc("", false) {
+		_, err = p.db().ExecContext(ctx, `
 			UPDATE USER_TOKENS SET 
 				status = $1,
 				updated_at = $2
@@ -385,7 +561,7 @@ func (p *postgres) DeleteToken(token *models.UserToken) error {
 			token.RefreshToken,
 		)
 	} else if token.Token != "" && token.UserID != 0 {
-		_, err = p.DB[0].Exec(`
+		_, err = p.db().ExecContext(ctx, `
 			UPDATE USER_TOKENS SET
 				status = $1,
 				updated_at = $2
@@ -396,7 +572,7 @@ func (p *postgres) DeleteToken(token *models.UserToken) error {
 			token.UserID,
 		)
 	} else if token.Token != "" {
-		_, err = p.DB[0].Exec(`
+		_, err = p.db().ExecContext(ctx, `
 			UPDATE USER_TOKENS SET
 				status = $1,
 				updated_at = $2
@@ -405,6 +581,28 @@ func (p *postgres) DeleteToken(token *models.UserToken) error {
 			updatedAt,
 			token.Token,
 		)
+	} else if token.UserID != 0 {
+		// every session of the user
+		_, err = p.db().ExecContext(ctx, `
+			UPDATE USER_TOKENS SET
+				status = $1,
+				updated_at = $2
+			WHERE user_id = $3`,
+			"nonactive",
+			updatedAt,
+			token.UserID,
+		)
+	} else if token.ClientID != 0 {
+		// every session issued to the client
+		_, err = p.db().ExecContext(ctx, `
+			UPDATE USER_TOKENS SET
+				status = $1,
+				updated_at = $2
+			WHERE client_id = $3`,
+			"nonactive",
+			updatedAt,
+			token.ClientID,
+		)
 	}
 
 	if err != nil {
@@ -414,30 +612,57 @@ func (p *postgres) DeleteToken(token *models.UserToken) error {
 	return nil
 }
 
-func (p *postgres) GetToken(token *models.UserToken) ([]*models.UserToken, error) {
+// ConsumeToken marks an active refresh token as used, it reports false when the
+// token was not active anymore, e.g. because a concurrent request consumed it first
+func (p *postgres) ConsumeToken(ctx context.Context, token *models.UserToken) (bool, error) {
+	result, err := p.db().ExecContext(ctx, `
+		UPDATE USER_TOKENS SET
+			status = $1,
+			updated_at = $2
+		WHERE token = $3 and status = 'active'`,
+		"consumed",
+		time.Now(),
+		token.Token,
+	)
+
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+func (p *postgres) GetToken(ctx context.Context, token *models.UserToken) ([]*models.UserToken, error) {
 	var results []*models.UserToken
 	var rows *sql.Rows
 	var err error
 
 	if token.Token != "" {
-		rows, err = p.DB[0].Query(`
+		rows, err = p.db().QueryContext(ctx, `
 				SELECT
 					user_id,
 					token,
 					token_type,
 					refresh_token,
+					family,
 					status,
 					created_at,
 					updated_at
 				FROM USER_TOKENS WHERE 
 					token = $1`, token.Token)
 	} else if token.UserID != 0 {
-		rows, err = p.DB[0].Query(`
+		rows, err = p.db().QueryContext(ctx, `
 				SELECT
 					user_id,
 					token,
 					token_type,
 					refresh_token,
+					family,
 					status,
 					created_at,
 					updated_at
@@ -458,6 +683,7 @@ func (p *postgres) GetToken(token *models.UserToken) ([]*models.UserToken, error
 			&userToken.Token,
 			&userToken.TokenType,
 			&userToken.RefreshToken,
+			&userToken.Family,
 			&userToken.Status,
 			&userToken.CreatedAt,
 			&userToken.UpdatedAt,
@@ -471,11 +697,11 @@ func (p *postgres) GetToken(token *models.UserToken) ([]*models.UserToken, error
 	return results, nil
 }
 
-func (p *postgres) GetSession(token *models.UserToken) ([]*models.UserToken, error) {
+func (p *postgres) GetSession(ctx context.Context, token *models.UserToken) ([]*models.UserToken, error) {
 	var results []*models.UserToken
 
 	if token.UserID != 0 {
-		rows, err := p.DB[0].Query(`
+		rows, err := p.readQuery(ctx, `
 				SELECT
 					u.user_id,
 					u.token,
@@ -522,14 +748,16 @@ func (p *postgres) GetSession(token *models.UserToken) ([]*models.UserToken, err
 	return results, nil
 }
 
-func (p *postgres) CreateBackUpCode(code *models.BackupCodes) error {
-	_, err := p.DB[0].Exec(`
+func (p *postgres) CreateBackUpCode(ctx context.Context, code *models.BackupCodes) error {
+	_, err := p.db().ExecContext(ctx, `
 		INSERT INTO BACKUP_CODES (
 			user_id,
-			codes
-		) VALUES ($1, $2)`,
+			codes,
+			created_at
+		) VALUES ($1, $2, $3)`,
 		code.UserID,
 		code.Codes,
+		time.Now(),
 	)
 
 	if err != nil {
@@ -539,88 +767,591 @@ func (p *postgres) CreateBackUpCode(code *models.BackupCodes) error {
 	return nil
 }
 
-func (p *postgres) GetBackUpCode(codes *models.BackupCodes) ([]*models.BackupCodes, error) {
-	var results []*models.BackupCodes
+// UseBackUpCode marks an unused code as used, it reports false when the code
+// doesn't exist or was already used so a code can't be redeemed twice
+func (p *postgres) UseBackUpCode(ctx context.Context, code *models.BackupCodes) (bool, error) {
+	result, err := p.db().ExecContext(ctx, `
+		UPDATE BACKUP_CODES SET
+			used_at = $1
+		WHERE user_id = $2 and codes = $3 and used_at IS NULL`,
+		time.Now(),
+		code.UserID,
+		code.Codes,
+	)
+
+	if err != nil {
+		return false, err
+	}
 
-	if codes.UserID != 0 && codes.Codes != "" {
-		rows, err := p.DB[0].Query(`
-				SELECT
-					user_id,
-					codes
-				FROM BACKUP_CODES WHERE 
-					user_id = $1 and codes = $2`, codes.UserID, codes.Codes)
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+func (p *postgres) CountBackUpCode(ctx context.Context, userID uint64) (*models.BackupCodesStatus, error) {
+	var status models.BackupCodesStatus
+
+	err := p.db().QueryRowContext(ctx, `
+		SELECT
+			COUNT(*) FILTER (WHERE used_at IS NULL),
+			COUNT(*)
+		FROM BACKUP_CODES WHERE
+			user_id = $1`, userID).Scan(
+		&status.Remaining,
+		&status.Total,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+func (p *postgres) DeleteBackUpCode(ctx context.Context, userID uint64) error {
+	_, err := p.db().ExecContext(ctx, `
+		DELETE FROM BACKUP_CODES WHERE user_id = $1`,
+		userID,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p *postgres) CreateVerificationToken(ctx context.Context, token *models.VerificationToken) error {
+	_, err := p.db().ExecContext(ctx, `
+		INSERT INTO VERIFICATION_TOKENS (
+			token_hash,
+			user_id,
+			purpose,
+			data,
+			expires_at,
+			created_at
+		) VALUES ($1, $2, $3, $4, $5, $6)`,
+		token.TokenHash,
+		token.UserID,
+		token.Purpose,
+		token.Data,
+		token.ExpiresAt,
+		time.Now(),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p *postgres) GetVerificationToken(ctx context.Context, tokenHash string) ([]*models.VerificationToken, error) {
+	var results []*models.VerificationToken
+
+	rows, err := p.db().QueryContext(ctx, `
+		SELECT
+			id,
+			token_hash,
+			user_id,
+			purpose,
+			data,
+			expires_at,
+			used_at,
+			created_at
+		FROM VERIFICATION_TOKENS WHERE
+			token_hash = $1`, tokenHash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var token = &models.VerificationToken{}
+		if err := rows.Scan(
+			&token.ID,
+			&token.TokenHash,
+			&token.UserID,
+			&token.Purpose,
+			&token.Data,
+			&token.ExpiresAt,
+			&token.UsedAt,
+			&token.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		results = append(results, token)
+	}
+
+	return results, nil
+}
+
+// UseVerificationToken marks an unused, unexpired token as used, it reports false
+// when another request consumed it first
+func (p *postgres) UseVerificationToken(ctx context.Context, token *models.VerificationToken) (bool, error) {
+	now := time.Now()
+
+	result, err := p.db().ExecContext(ctx, `
+		UPDATE VERIFICATION_TOKENS SET
+			used_at = $1
+		WHERE id = $2 and used_at IS NULL and expires_at > $1`,
+		now,
+		token.ID,
+	)
+
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+// RevokeVerificationToken invalidates every unused token of a user for purpose
+func (p *postgres) RevokeVerificationToken(ctx context.Context, userID uint64, purpose string) error {
+	_, err := p.db().ExecContext(ctx, `
+		UPDATE VERIFICATION_TOKENS SET
+			used_at = $1
+		WHERE user_id = $2 and purpose = $3 and used_at IS NULL`,
+		time.Now(),
+		userID,
+		purpose,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p *postgres) CreateSentEmail(ctx context.Context, sent *models.SentEmail) error {
+	_, err := p.db().ExecContext(ctx, `
+		INSERT INTO SENT_EMAILS (
+			recipient,
+			subject,
+			driver,
+			status,
+			error,
+			created_at
+		) VALUES ($1, $2, $3, $4, $5, $6)`,
+		sent.Recipient,
+		sent.Subject,
+		sent.Driver,
+		sent.Status,
+		sent.Error,
+		time.Now(),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p *postgres) CreateOutboxEmail(ctx context.Context, email *models.OutboxEmail) error {
+	_, err := p.db().ExecContext(ctx, `
+		INSERT INTO OUTBOX_EMAILS (
+			recipient_name,
+			recipient_email,
+			subject,
+			html_content,
+			plain_content,
+			status,
+			attempts,
+			next_attempt_at,
+			created_at,
+			updated_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		email.RecipientName,
+		email.RecipientEmail,
+		email.Subject,
+		email.HTMLContent,
+		email.PlainContent,
+		models.OutboxPending,
+		0,
+		time.Now(),
+		time.Now(),
+		time.Now(),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ClaimOutboxEmails takes up to limit due emails and pushes their next attempt
+// lease into the future, so concurrent workers never send the same email and
+// a worker that dies mid-send only delays it
+func (p *postgres) ClaimOutboxEmails(ctx context.Context, limit int, lease time.Duration) ([]*models.OutboxEmail, error) {
+	if p.sqlite {
+		return p.claimOutboxEmailsSQLite(ctx, limit, lease)
+	}
+
+	var results []*models.OutboxEmail
+
+	rows, err := p.db().QueryContext(ctx, `
+		UPDATE OUTBOX_EMAILS SET
+			next_attempt_at = $1
+		WHERE id IN (
+			SELECT id FROM OUTBOX_EMAILS
+			WHERE status = $2 and next_attempt_at <= $3
+			ORDER BY next_attempt_at
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING
+			id,
+			recipient_name,
+			recipient_email,
+			subject,
+			html_content,
+			plain_content,
+			status,
+			attempts,
+			next_attempt_at,
+			last_error,
+			sent_at,
+			created_at,
+			updated_at`,
+		time.Now().Add(lease),
+		models.OutboxPending,
+		time.Now(),
+		limit,
+	)
 
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		email, err := scanOutboxEmail(rows, true)
 		if err != nil {
 			return nil, err
 		}
 
-		defer rows.Close()
+		results = append(results, email)
+	}
 
-		for rows.Next() {
-			var userCode = &models.BackupCodes{}
-			if err := rows.Scan(
-				&userCode.UserID,
-				&userCode.Codes,
-			); err != nil {
-				return nil, err
-			}
+	return results, rows.Err()
+}
+
+func (p *postgres) UpdateOutboxEmail(ctx context.Context, email *models.OutboxEmail) error {
+	_, err := p.db().ExecContext(ctx, `
+		UPDATE OUTBOX_EMAILS SET
+			status = $1,
+			attempts = $2,
+			next_attempt_at = $3,
+			last_error = $4,
+			sent_at = $5,
+			updated_at = $6
+		WHERE id = $7`,
+		email.Status,
+		email.Attempts,
+		email.NextAttemptAt,
+		email.LastError,
+		email.SentAt,
+		time.Now(),
+		email.ID,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetOutboxEmails lists emails with status, newest first, without their bodies
+func (p *postgres) GetOutboxEmails(ctx context.Context, status string, limit int, offset int) ([]*models.OutboxEmail, int, error) {
+	var results []*models.OutboxEmail
+	var total int
+
+	err := p.db().QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM OUTBOX_EMAILS WHERE status = $1`, status).Scan(&total)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := p.db().QueryContext(ctx, `
+		SELECT
+			id,
+			recipient_name,
+			recipient_email,
+			subject,
+			status,
+			attempts,
+			next_attempt_at,
+			last_error,
+			sent_at,
+			created_at,
+			updated_at
+		FROM OUTBOX_EMAILS WHERE
+			status = $1
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3`, status, limit, offset)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		email, err := scanOutboxEmail(rows, false)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		results = append(results, email)
+	}
+
+	return results, total, rows.Err()
+}
+
+// RetryOutboxEmail queues a dead email again with a fresh attempt count
+func (p *postgres) RetryOutboxEmail(ctx context.Context, id uint64) (bool, error) {
+	result, err := p.db().ExecContext(ctx, `
+		UPDATE OUTBOX_EMAILS SET
+			status = $1,
+			attempts = 0,
+			next_attempt_at = $2,
+			updated_at = $2
+		WHERE id = $3 and status = $4`,
+		models.OutboxPending,
+		time.Now(),
+		id,
+		models.OutboxDead,
+	)
+
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+func scanOutboxEmail(rows *sql.Rows, withContent bool) (*models.OutboxEmail, error) {
+	var email = &models.OutboxEmail{}
+
+	dest := []interface{}{
+		&email.ID,
+		&email.RecipientName,
+		&email.RecipientEmail,
+		&email.Subject,
+	}
+
+	if withContent {
+		dest = append(dest, &email.HTMLContent, &email.PlainContent)
+	}
+
+	dest = append(dest,
+		&email.Status,
+		&email.Attempts,
+		&email.NextAttemptAt,
+		&email.LastError,
+		&email.SentAt,
+		&email.CreatedAt,
+		&email.UpdatedAt,
+	)
+
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	return email, nil
+}
+
+func (p *postgres) CreatePasswordHistory(ctx context.Context, history *models.PasswordHistory) error {
+	_, err := p.db().ExecContext(ctx, `
+		INSERT INTO PASSWORD_HISTORIES (
+			user_id,
+			password,
+			created_at
+		) VALUES ($1, $2, $3)`,
+		history.UserID,
+		history.Password,
+		time.Now(),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p *postgres) GetPasswordHistory(ctx context.Context, userID uint64, limit int) ([]*models.PasswordHistory, error) {
+	var results []*models.PasswordHistory
+
+	rows, err := p.db().QueryContext(ctx, `
+		SELECT
+			id,
+			user_id,
+			password,
+			created_at
+		FROM PASSWORD_HISTORIES WHERE
+			user_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2`, userID, limit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
 
-			results = append(results, userCode)
+	for rows.Next() {
+		var history = &models.PasswordHistory{}
+		if err := rows.Scan(
+			&history.ID,
+			&history.UserID,
+			&history.Password,
+			&history.CreatedAt,
+		); err != nil {
+			return nil, err
 		}
+
+		results = append(results, history)
 	}
 
 	return results, nil
 }
 
-func (p *postgres) GetClientID(client *models.ClientID) ([]*models.ClientID, error) {
+func (p *postgres) CreateClientID(ctx context.Context, client *models.ClientID) error {
+	var ownerID sql.NullInt64
+	if client.OwnerID != 0 {
+		ownerID = sql.NullInt64{Int64: int64(client.OwnerID), Valid: true}
+	}
+
+	_, err := p.db().ExecContext(ctx, `
+		INSERT INTO CLIENT_IDS (
+			api,
+			name,
+			secret,
+			type,
+			redirect_uris,
+			owner_id
+		) VALUES ($1, $2, $3, $4, $5, $6)`,
+		client.API,
+		client.Name,
+		client.Secret,
+		client.Type,
+		client.RedirectURIs,
+		ownerID,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetClientID finds the client by api, or lists the OAuth clients of OwnerID
+func (p *postgres) GetClientID(ctx context.Context, client *models.ClientID) ([]*models.ClientID, error) {
 	var results []*models.ClientID
+	var rows *sql.Rows
+	var err error
 
 	if client.API != "" {
-		rows, err := p.DB[0].Query(`
+		rows, err = p.readQuery(ctx, `
 				SELECT
 					id,
 					api,
-					name
+					name,
+					secret,
+					type,
+					redirect_uris,
+					owner_id
 				FROM CLIENT_IDS WHERE 
 					api = $1`, client.API)
+	} else if client.OwnerID != 0 {
+		rows, err = p.readQuery(ctx, `
+				SELECT
+					id,
+					api,
+					name,
+					secret,
+					type,
+					redirect_uris,
+					owner_id
+				FROM CLIENT_IDS WHERE
+					owner_id = $1
+				ORDER BY id`, client.OwnerID)
+	} else {
+		return results, nil
+	}
 
-		if err != nil {
-			return nil, err
-		}
+	if err != nil {
+		return nil, err
+	}
 
-		defer rows.Close()
+	defer rows.Close()
 
-		for rows.Next() {
-			var clienIDRow = &models.ClientID{}
-			if err := rows.Scan(
-				&clienIDRow.ID,
-				&clienIDRow.API,
-				&clienIDRow.Name,
-			); err != nil {
-				return nil, err
-			}
+	for rows.Next() {
+		var clienIDRow = &models.ClientID{}
+		var ownerID sql.NullInt64
 
-			results = append(results, clienIDRow)
+		if err := rows.Scan(
+			&clienIDRow.ID,
+			&clienIDRow.API,
+			&clienIDRow.Name,
+			&clienIDRow.Secret,
+			&clienIDRow.Type,
+			&clienIDRow.RedirectURIs,
+			&ownerID,
+		); err != nil {
+			return nil, err
 		}
+
+		clienIDRow.OwnerID = uint64(ownerID.Int64)
+
+		results = append(results, clienIDRow)
 	}
 
-	return results, nil
+	return results, rows.Err()
 }
 
-func (p *postgres) CreateEvent(ctx context.Context, event string, userID uint64) error {
-	ipAddress := fmt.Sprintf("%v", ctx.Value(helper.StringToInterface("ip-address")))
-	userAgent := fmt.Sprintf("%v", ctx.Value(helper.StringToInterface("user-agent")))
-	clientID, err := strconv.ParseUint(
-		fmt.Sprintf("%v", ctx.Value(helper.StringToInterface("client-id"))),
-		0,
-		64,
+func (p *postgres) DeleteClientID(ctx context.Context, client *models.ClientID) error {
+	_, err := p.db().ExecContext(ctx, `
+		DELETE FROM CLIENT_IDS WHERE id = $1`,
+		client.ID,
 	)
 
 	if err != nil {
 		return err
 	}
 
-	_, err = p.DB[0].Exec(`
+	return nil
+}
+
+func (p *postgres) CreateEvent(ctx context.Context, event string, userID uint64) error {
+	// events caused by following an emailed link carry no API client
+	clientID, _ := helper.ClientID(ctx)
+
+	_, err := p.db().ExecContext(ctx, `
 		INSERT INTO EVENTS (
 			user_id,
 			event, 
@@ -632,8 +1363,8 @@ func (p *postgres) CreateEvent(ctx context.Context, event string, userID uint64)
 		) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
 		userID,
 		event,
-		userAgent,
-		ipAddress,
+		helper.UserAgent(ctx),
+		helper.IPAddress(ctx),
 		clientID,
 		time.Now(),
 		time.Now(),
@@ -646,51 +1377,94 @@ func (p *postgres) CreateEvent(ctx context.Context, event string, userID uint64)
 	return nil
 }
 
-func (p *postgres) GetEvent(user *models.User, limit int, offset int) ([]*models.Event, error) {
+// GetEvent lists the events matching filter, newest first. Each event carries
+// the number of events matching the filter in TotalEvent.
+func (p *postgres) GetEvent(ctx context.Context, filter *models.EventFilter) ([]*models.Event, error) {
 	var results []*models.Event
 
-	if user.ID != 0 {
-		rows, err := p.DB[0].Query(`
-				SELECT
-					u.user_id,
-					u.event,
-					u.ua,
-					u.client_id,
-					c.name,
-					u.ip_address,
-					u.created_at,
-					count(u.*) OVER() AS total
-				FROM EVENTS as u
-				LEFT JOIN CLIENT_IDS AS c ON u.client_id = c.id
-				WHERE 
-					u.user_id = $1
-				LIMIT $2
-				OFFSET $3`, user.ID, limit, offset)
+	conditions := []string{"u.user_id = $1"}
+	args := []interface{}{filter.UserID}
 
-		if err != nil {
-			return nil, err
-		}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
 
-		defer rows.Close()
+	if filter.Event != "" {
+		where("u.event = $%d", filter.Event)
+	}
 
-		for rows.Next() {
-			var event = &models.Event{}
-			if err := rows.Scan(
-				&event.UserID,
-				&event.Event,
-				&event.UA,
-				&event.ClientID,
-				&event.ClientName,
-				&event.IPAddress,
-				&event.CreatedAt,
-				&event.TotalEvent,
-			); err != nil {
-				return nil, err
-			}
+	if filter.ClientID != 0 {
+		where("u.client_id = $%d", filter.ClientID)
+	}
+
+	if !filter.From.IsZero() {
+		where("u.created_at >= $%d", filter.From)
+	}
+
+	if !filter.To.IsZero() {
+		where("u.created_at < $%d", filter.To)
+	}
+
+	// the total counts the whole filter, also for pages after a cursor
+	total := "count(*) OVER()"
+
+	offset := 0
+	if filter.BeforeID != 0 {
+		total = "(SELECT count(*) FROM EVENTS AS u WHERE " + strings.Join(conditions, " AND ") + ")"
+
+		where("u.id < $%d", filter.BeforeID)
+	} else if filter.Page > 1 {
+		offset = (filter.Page - 1) * filter.PerPage
+	}
 
-			results = append(results, event)
+	args = append(args, filter.PerPage, offset)
+
+	rows, err := p.readQuery(ctx, `
+		SELECT
+			u.id,
+			u.user_id,
+			u.event,
+			u.ua,
+			u.client_id,
+			COALESCE(c.name, ''),
+			u.ip_address,
+			u.created_at,
+			`+total+` AS total,
+			count(*) OVER() AS remaining
+		FROM EVENTS as u
+		LEFT JOIN CLIENT_IDS AS c ON u.client_id = c.id
+		WHERE
+			`+strings.Join(conditions, " AND ")+`
+		ORDER BY u.id DESC
+		LIMIT $`+strconv.Itoa(len(args)-1)+`
+		OFFSET $`+strconv.Itoa(len(args)), args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var event = &models.Event{}
+		if err := rows.Scan(
+			&event.ID,
+			&event.UserID,
+			&event.Event,
+			&event.UA,
+			&event.ClientID,
+			&event.ClientName,
+			&event.IPAddress,
+			&event.CreatedAt,
+			&event.TotalEvent,
+			&event.RemainingEvent,
+		); err != nil {
+			return nil, err
 		}
+
+		results = append(results, event)
 	}
 
-	return results, nil
+	return results, rows.Err()
 }
@@ -0,0 +1,115 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	replicaCheckInterval = 5 * time.Second
+	replicaCheckTimeout  = 2 * time.Second
+)
+
+// replicas spreads reads over the healthy read replicas. A replica failing a
+// health check or a query is skipped until a later check finds it back.
+type replicas struct {
+	dbs     []*sql.DB
+	healthy []int32
+	next    uint32
+}
+
+func newReplicas(dbs []*sql.DB) *replicas {
+	r := &replicas{
+		dbs:     dbs,
+		healthy: make([]int32, len(dbs)),
+	}
+
+	r.check()
+	go r.watch()
+
+	return r
+}
+
+// pick returns the next healthy replica round robin, -1 when there is none
+func (r *replicas) pick() int {
+	start := atomic.AddUint32(&r.next, 1)
+
+	for i := 0; i < len(r.dbs); i++ {
+		n := int((start + uint32(i)) % uint32(len(r.dbs)))
+		if atomic.LoadInt32(&r.healthy[n]) == 1 {
+			return n
+		}
+	}
+
+	return -1
+}
+
+func (r *replicas) markDown(n int, err error) {
+	if atomic.SwapInt32(&r.healthy[n], 0) == 1 {
+		log.Printf("postgres replica %d is down: %v", n+1, err)
+	}
+}
+
+func (r *replicas) watch() {
+	ticker := time.NewTicker(replicaCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.check()
+	}
+}
+
+func (r *replicas) check() {
+	for n, db := range r.dbs {
+		ctx, cancel := context.WithTimeout(context.Background(), replicaCheckTimeout)
+		err := db.PingContext(ctx)
+		cancel()
+
+		if err != nil {
+			r.markDown(n, err)
+			continue
+		}
+
+		if atomic.SwapInt32(&r.healthy[n], 1) == 0 {
+			log.Printf("postgres replica %d is up", n+1)
+		}
+	}
+}
+
+// readQuery runs a read that tolerates replication lag on a replica, falling
+// back to the primary when there is no healthy replica or the replica fails
+func (p *postgres) readQuery(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	if p.tx != nil || p.primary || p.replicas == nil {
+		return p.db().QueryContext(ctx, query, args...)
+	}
+
+	n := p.replicas.pick()
+	if n < 0 {
+		return p.DB[0].QueryContext(ctx, query, args...)
+	}
+
+	rows, err := p.replicas.dbs[n].QueryContext(ctx, query, args...)
+	if err == nil {
+		return rows, nil
+	}
+
+	// a postgres error would fail the same on the primary, anything else
+	// means the replica is unreachable
+	if _, ok := err.(*pq.Error); ok {
+		return nil, err
+	}
+
+	// nor does a cancelled request say anything about the replica
+	if ctx.Err() != nil {
+		return nil, err
+	}
+
+	p.replicas.markDown(n, err)
+
+	return p.DB[0].QueryContext(ctx, query, args...)
+}
@@ -0,0 +1,165 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/g-graziano/user-auth-golang/models"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// NewSQLite runs the Postgres queries on the SQLite database file at path, for
+// single node and development deployments. There are no read replicas.
+func NewSQLite(path string) Postgres {
+	db, err := sql.Open("sqlite3", sqliteDSN(path))
+	if err != nil {
+		panic(err)
+	}
+
+	if err := db.Ping(); err != nil {
+		panic(err)
+	}
+
+	log.Printf("sqlite database %s opened", path)
+
+	return &postgres{DB: []*sql.DB{db}, sqlite: true}
+}
+
+// sqliteDSN opens path in WAL mode so reads don't wait for writes. Transactions
+// take the write lock when they begin, a writer waits for the lock instead of
+// failing with SQLITE_BUSY.
+func sqliteDSN(path string) string {
+	params := url.Values{}
+	params.Set("_journal_mode", "WAL")
+	params.Set("_busy_timeout", "5000")
+	params.Set("_txlock", "immediate")
+	params.Set("_foreign_keys", "true")
+
+	return "file:" + path + "?" + params.Encode()
+}
+
+// sqliteExecutor passes times in UTC. SQLite stores them as text and compares
+// them as strings, which only orders correctly within one time zone.
+type sqliteExecutor struct {
+	executor
+}
+
+func (e sqliteExecutor) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return e.executor.ExecContext(ctx, query, utcArgs(args)...)
+}
+
+func (e sqliteExecutor) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return e.executor.QueryContext(ctx, query, utcArgs(args)...)
+}
+
+func (e sqliteExecutor) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return e.executor.QueryRowContext(ctx, query, utcArgs(args)...)
+}
+
+func utcArgs(args []interface{}) []interface{} {
+	converted := make([]interface{}, len(args))
+
+	for i, arg := range args {
+		// nullable times such as helper.NullTime
+		if valuer, ok := arg.(driver.Valuer); ok {
+			if value, err := valuer.Value(); err == nil && value != nil {
+				if _, ok := value.(time.Time); ok {
+					arg = value
+				}
+			}
+		}
+
+		if t, ok := arg.(time.Time); ok {
+			arg = t.UTC()
+		}
+
+		converted[i] = arg
+	}
+
+	return converted
+}
+
+// claimOutboxEmailsSQLite is ClaimOutboxEmails for SQLite, which has neither
+// SKIP LOCKED nor RETURNING. Its transaction holds the write lock from the
+// start, so no other worker can claim the same emails in between.
+func (p *postgres) claimOutboxEmailsSQLite(ctx context.Context, limit int, lease time.Duration) ([]*models.OutboxEmail, error) {
+	var results []*models.OutboxEmail
+
+	err := p.WithTx(ctx, func(pg Postgres) error {
+		tx := pg.(*postgres)
+
+		rows, err := tx.db().QueryContext(ctx, `
+			SELECT
+				id,
+				recipient_name,
+				recipient_email,
+				subject,
+				html_content,
+				plain_content,
+				status,
+				attempts,
+				next_attempt_at,
+				last_error,
+				sent_at,
+				created_at,
+				updated_at
+			FROM OUTBOX_EMAILS
+			WHERE status = $1 and next_attempt_at <= $2
+			ORDER BY next_attempt_at
+			LIMIT $3`,
+			models.OutboxPending,
+			time.Now(),
+			limit,
+		)
+
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			email, err := scanOutboxEmail(rows, true)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+
+			results = append(results, email)
+		}
+
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		nextAttemptAt := time.Now().Add(lease)
+
+		for _, email := range results {
+			_, err := tx.db().ExecContext(ctx, `
+				UPDATE OUTBOX_EMAILS SET
+					next_attempt_at = $1
+				WHERE id = $2`,
+				nextAttemptAt,
+				email.ID,
+			)
+
+			if err != nil {
+				return err
+			}
+
+			email.NextAttemptAt = nextAttemptAt
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
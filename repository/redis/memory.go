@@ -0,0 +1,163 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/g-graziano/user-auth-golang/models"
+	rds "github.com/go-redis/redis/v8"
+)
+
+// memory keeps keys in process memory for tests and running without a redis
+// server. Keys expire like they do with EXPIREAT and missing keys return
+// rds.Nil, so callers can not tell it apart from the real client.
+type memory struct {
+	mu   sync.Mutex
+	keys map[string]entry
+	now  func() time.Time
+}
+
+type entry struct {
+	value  string
+	expire time.Time
+}
+
+// NewMemory returns an empty Redis that lives in memory
+func NewMemory() Redis {
+	return &memory{keys: make(map[string]entry), now: time.Now}
+}
+
+// lookup returns the live entry at key, dropping it once it has expired
+func (m *memory) lookup(key string) (entry, bool) {
+	e, ok := m.keys[key]
+	if !ok {
+		return entry{}, false
+	}
+
+	if !e.expire.IsZero() && !e.expire.After(m.now()) {
+		delete(m.keys, key)
+		return entry{}, false
+	}
+
+	return e, true
+}
+
+// expireAt sets the expiry of key, a time that is not in the future deletes it
+func (m *memory) expireAt(key string, e entry, at time.Time) {
+	if !at.After(m.now()) {
+		delete(m.keys, key)
+		return
+	}
+
+	e.expire = at
+	m.keys[key] = e
+}
+
+func (m *memory) Create(ctx context.Context, otp *models.OTP) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.expireAt(otp.Key, entry{value: otp.Value}, otp.Expire)
+
+	return nil
+}
+
+func (m *memory) Get(ctx context.Context, otp *models.OTP) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.lookup(otp.Key)
+	if !ok {
+		return "", rds.Nil
+	}
+
+	return e.value, nil
+}
+
+func (m *memory) GetAndDelete(ctx context.Context, otp *models.OTP) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.lookup(otp.Key)
+	if !ok {
+		return "", rds.Nil
+	}
+
+	delete(m.keys, otp.Key)
+
+	return e.value, nil
+}
+
+func (m *memory) Increment(ctx context.Context, otp *models.OTP) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, _ := m.lookup(otp.Key)
+
+	count := int64(0)
+	if e.value != "" {
+		var err error
+		if count, err = strconv.ParseInt(e.value, 10, 64); err != nil {
+			return 0, err
+		}
+	}
+
+	count++
+	e.value = strconv.FormatInt(count, 10)
+
+	if count == 1 {
+		m.expireAt(otp.Key, e, otp.Expire)
+	} else {
+		m.keys[otp.Key] = e
+	}
+
+	return count, nil
+}
+
+func (m *memory) TTL(ctx context.Context, otp *models.OTP) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.lookup(otp.Key)
+	if !ok || e.expire.IsZero() {
+		return 0, nil
+	}
+
+	// redis reports whole seconds
+	return e.expire.Sub(m.now()).Truncate(time.Second), nil
+}
+
+func (m *memory) Delete(ctx context.Context, otp *models.OTP) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.keys, otp.Key)
+
+	return nil
+}
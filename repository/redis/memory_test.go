@@ -0,0 +1,91 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/g-graziano/user-auth-golang/models"
+	rds "github.com/go-redis/redis/v8"
+)
+
+func TestMemoryExpiry(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		expire  time.Duration
+		elapsed time.Duration
+		want    string
+		wantErr error
+		wantTTL time.Duration
+	}{
+		{name: "live", expire: time.Minute, elapsed: time.Second, want: "1", wantTTL: 59 * time.Second},
+		{name: "expired", expire: time.Minute, elapsed: time.Minute, wantErr: rds.Nil},
+		{name: "expiry in the past", expire: -time.Second, wantErr: rds.Nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			now := start
+
+			m := NewMemory().(*memory)
+			m.now = func() time.Time { return now }
+
+			otp := &models.OTP{Key: "key", Value: "1", Expire: start.Add(tt.expire)}
+
+			if err := m.Create(ctx, otp); err != nil {
+				t.Fatal(err)
+			}
+
+			now = now.Add(tt.elapsed)
+
+			got, err := m.Get(ctx, otp)
+			if err != tt.wantErr || got != tt.want {
+				t.Fatalf("Get() = %q, %v, want %q, %v", got, err, tt.want, tt.wantErr)
+			}
+
+			ttl, err := m.TTL(ctx, otp)
+			if err != nil || ttl != tt.wantTTL {
+				t.Fatalf("TTL() = %v, %v, want %v", ttl, err, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestMemoryIncrement(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	m := NewMemory().(*memory)
+	m.now = func() time.Time { return now }
+
+	for want := int64(1); want <= 3; want++ {
+		// later increments must not extend the window set by the first
+		otp := &models.OTP{Key: "count", Expire: now.Add(time.Minute)}
+
+		got, err := m.Increment(ctx, otp)
+		if err != nil || got != want {
+			t.Fatalf("Increment() = %d, %v, want %d", got, err, want)
+		}
+
+		now = now.Add(20 * time.Second)
+	}
+
+	if _, err := m.Get(ctx, &models.OTP{Key: "count"}); err != rds.Nil {
+		t.Fatalf("counter outlived its window: %v", err)
+	}
+
+	if got, _ := m.Increment(ctx, &models.OTP{Key: "count", Expire: now.Add(time.Minute)}); got != 1 {
+		t.Fatalf("Increment() after expiry = %d, want 1", got)
+	}
+
+	if _, err := m.GetAndDelete(ctx, &models.OTP{Key: "count"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.GetAndDelete(ctx, &models.OTP{Key: "count"}); err != rds.Nil {
+		t.Fatalf("GetAndDelete() twice = %v, want rds.Nil", err)
+	}
+}
@@ -1,10 +1,12 @@
 package redis
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/g-graziano/user-auth-golang/models"
-	rds "github.com/go-redis/redis"
+	rds "github.com/go-redis/redis/v8"
 )
 
 type redis struct {
@@ -12,18 +14,22 @@ type redis struct {
 }
 
 type Redis interface {
-	Create(otp *models.OTP) error
-	Get(otp *models.OTP) (string, error)
+	Create(ctx context.Context, otp *models.OTP) error
+	Get(ctx context.Context, otp *models.OTP) (string, error)
+	GetAndDelete(ctx context.Context, otp *models.OTP) (string, error)
+	Increment(ctx context.Context, otp *models.OTP) (int64, error)
+	TTL(ctx context.Context, otp *models.OTP) (time.Duration, error)
+	Delete(ctx context.Context, otp *models.OTP) error
 }
 
-func New(conn ...string) Redis {
+func New(addr string, password string, db int) Redis {
 	client := rds.NewClient(&rds.Options{
-		Addr:     "localhost:6379",
-		Password: "", // no password set
-		DB:       0,  // use default DB
+		Addr:     addr,
+		Password: password,
+		DB:       db,
 	})
 
-	_, err := client.Ping().Result()
+	_, err := client.Ping(context.Background()).Result()
 
 	if err != nil {
 		panic(err)
@@ -34,10 +40,10 @@ func New(conn ...string) Redis {
 	return &redis{Redis: client}
 }
 
-func (r *redis) Create(otp *models.OTP) error {
-	err := r.Redis.Set(otp.Key, otp.Value, 0).Err()
+func (r *redis) Create(ctx context.Context, otp *models.OTP) error {
+	err := r.Redis.Set(ctx, otp.Key, otp.Value, 0).Err()
 
-	r.Redis.ExpireAt(otp.Key, otp.Expire)
+	r.Redis.ExpireAt(ctx, otp.Key, otp.Expire)
 
 	if err != nil {
 		return err
@@ -46,11 +52,68 @@ func (r *redis) Create(otp *models.OTP) error {
 	return nil
 }
 
-func (r *redis) Get(otp *models.OTP) (string, error) {
-	res, err := r.Redis.Get(otp.Key).Result()
+func (r *redis) Get(ctx context.Context, otp *models.OTP) (string, error) {
+	res, err := r.Redis.Get(ctx, otp.Key).Result()
 	if err != nil {
 		return "", err
 	}
 
 	return res, nil
 }
+
+// GetAndDelete reads and removes the key in one transaction so the value can only be consumed once
+func (r *redis) GetAndDelete(ctx context.Context, otp *models.OTP) (string, error) {
+	var get *rds.StringCmd
+
+	_, err := r.Redis.TxPipelined(ctx, func(pipe rds.Pipeliner) error {
+		get = pipe.Get(ctx, otp.Key)
+		pipe.Del(ctx, otp.Key)
+
+		return nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return get.Val(), nil
+}
+
+// Increment adds one to the counter at otp.Key, the expiry is only set when the
+// counter is created so the window is not extended by later increments
+func (r *redis) Increment(ctx context.Context, otp *models.OTP) (int64, error) {
+	count, err := r.Redis.Incr(ctx, otp.Key).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	if count == 1 {
+		r.Redis.ExpireAt(ctx, otp.Key, otp.Expire)
+	}
+
+	return count, nil
+}
+
+// TTL returns the remaining lifetime of otp.Key, or zero when it does not exist
+func (r *redis) TTL(ctx context.Context, otp *models.OTP) (time.Duration, error) {
+	ttl, err := r.Redis.TTL(ctx, otp.Key).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	if ttl < 0 {
+		return 0, nil
+	}
+
+	return ttl, nil
+}
+
+func (r *redis) Delete(ctx context.Context, otp *models.OTP) error {
+	err := r.Redis.Del(ctx, otp.Key).Err()
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
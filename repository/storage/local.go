@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/g-graziano/user-auth-golang/config"
+)
+
+// local keeps objects as files under a directory, the service serves them
+// itself on /media
+type local struct {
+	dir     string
+	baseURL string
+}
+
+func newLocal(cfg config.Storage, baseURL string) Storage {
+	return &local{
+		dir:     cfg.LocalDir,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+func (l *local) path(key string) (string, error) {
+	if !validKey(key) {
+		return "", errors.New("invalid storage key")
+	}
+
+	return filepath.Join(l.dir, filepath.FromSlash(key)), nil
+}
+
+func (l *local) Put(key string, contentType string, content []byte) error {
+	name, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	// write aside and rename so readers never see a partial file
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".upload-")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), name)
+}
+
+func (l *local) Get(key string) (io.ReadCloser, string, error) {
+	name, err := l.path(key)
+	if err != nil {
+		return nil, "", ErrNotFound
+	}
+
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, "", ErrNotFound
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	return file, contentType, nil
+}
+
+func (l *local) Delete(key string) error {
+	name, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (l *local) URL(key string) string {
+	if External(key) {
+		return key
+	}
+
+	return l.baseURL + "/media/" + key
+}
@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/g-graziano/user-auth-golang/config"
+)
+
+// s3 keeps objects in a bucket of any S3 compatible service (AWS, MinIO,
+// R2...) and signs its requests with AWS Signature Version 4. The bucket must
+// be publicly readable, or S3PublicURL point to something that serves it.
+type s3 struct {
+	cfg    config.Storage
+	client *http.Client
+}
+
+func newS3(cfg config.Storage) Storage {
+	cfg.S3Endpoint = strings.TrimSuffix(cfg.S3Endpoint, "/")
+	cfg.S3PublicURL = strings.TrimSuffix(cfg.S3PublicURL, "/")
+
+	return &s3{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// objectURL is the API URL of key, path style puts the bucket in the path
+// rather than the host name, which MinIO and most self hosted services expect
+func (s *s3) objectURL(key string) string {
+	endpoint, err := url.Parse(s.cfg.S3Endpoint)
+	if err != nil || s.cfg.S3PathStyle {
+		return s.cfg.S3Endpoint + "/" + s.cfg.S3Bucket + "/" + escapePath(key)
+	}
+
+	return endpoint.Scheme + "://" + s.cfg.S3Bucket + "." + endpoint.Host + "/" + escapePath(key)
+}
+
+func (s *s3) do(method string, key string, contentType string, content []byte) (*http.Response, error) {
+	if !validKey(key) {
+		return nil, fmt.Errorf("invalid storage key %q", key)
+	}
+
+	req, err := http.NewRequest(method, s.objectURL(key), bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	sum := sha256.Sum256(content)
+	s.sign(req, hex.EncodeToString(sum[:]), time.Now())
+
+	return s.client.Do(req)
+}
+
+func (s *s3) Put(key string, contentType string, content []byte) error {
+	res, err := s.do(http.MethodPut, key, contentType, content)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	return s3Error(res)
+}
+
+func (s *s3) Get(key string) (io.ReadCloser, string, error) {
+	res, err := s.do(http.MethodGet, key, "", nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, "", ErrNotFound
+	}
+
+	if err := s3Error(res); err != nil {
+		res.Body.Close()
+		return nil, "", err
+	}
+
+	return res.Body, res.Header.Get("Content-Type"), nil
+}
+
+func (s *s3) Delete(key string) error {
+	res, err := s.do(http.MethodDelete, key, "", nil)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil
+	}
+
+	return s3Error(res)
+}
+
+func (s *s3) URL(key string) string {
+	if External(key) {
+		return key
+	}
+
+	if s.cfg.S3PublicURL != "" {
+		return s.cfg.S3PublicURL + "/" + escapePath(key)
+	}
+
+	return s.objectURL(key)
+}
+
+func s3Error(res *http.Response) error {
+	if res.StatusCode < 300 {
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+
+	return fmt.Errorf("s3 %s %s: %s %s", res.Request.Method, res.Request.URL.Path, res.Status, strings.TrimSpace(string(body)))
+}
+
+// sign adds the AWS Signature Version 4 headers to req, payloadHash is the
+// hex SHA-256 of the body
+func (s *s3) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.cfg.S3Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.S3SecretKey), date)
+	key = hmacSHA256(key, s.cfg.S3Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.cfg.S3AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, escape(name)+"="+escape(value))
+		}
+	}
+
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, "&")
+}
+
+// escapePath escapes every segment of key the way SigV4 expects
+func escapePath(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = escape(part)
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// escape percent-encodes everything but the unreserved characters of RFC 3986
+func escape(s string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+
+	return b.String()
+}
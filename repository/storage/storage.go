@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/g-graziano/user-auth-golang/config"
+)
+
+// Supported drivers
+const (
+	Local = "local"
+	S3    = "s3"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+// Storage keeps uploaded files, such as profile pictures, under a key
+type Storage interface {
+	Put(key string, contentType string, content []byte) error
+	// Get returns the object and its content type, ErrNotFound if it doesn't exist
+	Get(key string) (io.ReadCloser, string, error)
+	// Delete removes the object, deleting a missing object is not an error
+	Delete(key string) error
+	// URL is where clients download the object from
+	URL(key string) string
+}
+
+// New builds the storage for cfg, baseURL is the service's public URL the
+// local driver serves files under
+func New(cfg config.Storage, baseURL string) (Storage, error) {
+	switch cfg.Driver {
+	case Local:
+		return newLocal(cfg, baseURL), nil
+	case S3:
+		return newS3(cfg), nil
+	}
+
+	return nil, fmt.Errorf("unsupported storage driver %q", cfg.Driver)
+}
+
+// ContentKey names content by its SHA-256 under prefix, so uploading the same
+// file twice reuses one object and a key never changes content
+func ContentKey(prefix string, content []byte, ext string) string {
+	sum := sha256.Sum256(content)
+
+	return path.Join(prefix, hex.EncodeToString(sum[:])+ext)
+}
+
+// External reports whether key is a full URL stored before pictures moved to
+// this storage, those are served as is and never deleted
+func External(key string) bool {
+	return strings.HasPrefix(key, "http://") || strings.HasPrefix(key, "https://")
+}
+
+// validKey rejects keys that could escape the storage root
+func validKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+
+	return true
+}
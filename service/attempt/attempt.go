@@ -0,0 +1,207 @@
+package attempt
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/g-graziano/user-auth-golang/helper"
+	"github.com/g-graziano/user-auth-golang/models"
+	"github.com/g-graziano/user-auth-golang/repository/postgres"
+	"github.com/g-graziano/user-auth-golang/repository/redis"
+)
+
+// Attempt tracks failed authentication attempts per account, IP address and
+// API client and locks a subject out once it crosses its threshold
+type Attempt interface {
+	Check(ctx context.Context, scope string, account string) error
+	Fail(ctx context.Context, scope string, account string, userID uint64) error
+	Succeed(ctx context.Context, scope string, account string, userID uint64) error
+}
+
+type Options struct {
+	// failures allowed within Window before a lockout, zero disables the subject
+	MaxAccountFailures int
+	MaxIPFailures      int
+	MaxClientFailures  int
+
+	Window time.Duration
+	// Lockout is the first lock duration, it doubles for every further lock
+	// of the same subject within a day, up to MaxLockout
+	Lockout    time.Duration
+	MaxLockout time.Duration
+}
+
+type subject struct {
+	kind  string
+	value string
+	max   int
+}
+
+type attempt struct {
+	postgres postgres.Postgres
+	redis    redis.Redis
+	opts     Options
+}
+
+func New(pg postgres.Postgres, rd redis.Redis, opts Options) Attempt {
+	return &attempt{
+		postgres: pg,
+		redis:    rd,
+		opts:     opts,
+	}
+}
+
+func (a *attempt) Check(ctx context.Context, scope string, account string) error {
+	var retryAfter time.Duration
+
+	for _, s := range a.subjects(ctx, account) {
+		ttl, err := a.redis.TTL(ctx, &models.OTP{Key: lockKey(scope, s)})
+		if err != nil {
+			return err
+		}
+
+		if ttl > retryAfter {
+			retryAfter = ttl
+		}
+	}
+
+	if retryAfter > 0 {
+		return &models.TooManyAttemptsError{RetryAfter: retryAfter}
+	}
+
+	return nil
+}
+
+func (a *attempt) Fail(ctx context.Context, scope string, account string, userID uint64) error {
+	var retryAfter time.Duration
+
+	for _, s := range a.subjects(ctx, account) {
+		count, err := a.redis.Increment(ctx, &models.OTP{Key: counterKey(scope, s), Expire: time.Now().Add(a.opts.Window)})
+		if err != nil {
+			return err
+		}
+
+		if count < int64(s.max) {
+			continue
+		}
+
+		lockout, err := a.lock(ctx, scope, s)
+		if err != nil {
+			return err
+		}
+
+		if s.kind == "account" && userID != 0 {
+			if err := a.postgres.CreateEvent(ctx, "account locked", userID); err != nil {
+				return err
+			}
+		}
+
+		if lockout > retryAfter {
+			retryAfter = lockout
+		}
+	}
+
+	if retryAfter > 0 {
+		return &models.TooManyAttemptsError{RetryAfter: retryAfter}
+	}
+
+	return nil
+}
+
+// Succeed clears the failure count of the account, IP and client counters keep
+// running so one address can't probe many accounts by mixing in valid logins
+func (a *attempt) Succeed(ctx context.Context, scope string, account string, userID uint64) error {
+	s := subject{kind: "account", value: account}
+
+	if err := a.redis.Delete(ctx, &models.OTP{Key: counterKey(scope, s)}); err != nil {
+		return err
+	}
+
+	if _, err := a.redis.Get(ctx, &models.OTP{Key: locksKey(scope, s)}); err != nil {
+		// never locked
+		return nil
+	}
+
+	if err := a.redis.Delete(ctx, &models.OTP{Key: locksKey(scope, s)}); err != nil {
+		return err
+	}
+
+	if userID != 0 {
+		return a.postgres.CreateEvent(ctx, "account unlocked", userID)
+	}
+
+	return nil
+}
+
+// lock locks s out for an exponentially growing duration and resets its counter
+func (a *attempt) lock(ctx context.Context, scope string, s subject) (time.Duration, error) {
+	locks, err := a.redis.Increment(ctx, &models.OTP{Key: locksKey(scope, s), Expire: time.Now().Add(time.Hour * 24)})
+	if err != nil {
+		return 0, err
+	}
+
+	lockout := a.opts.Lockout
+	for i := int64(1); i < locks && lockout < a.opts.MaxLockout; i++ {
+		lockout *= 2
+	}
+
+	if a.opts.MaxLockout > 0 && lockout > a.opts.MaxLockout {
+		lockout = a.opts.MaxLockout
+	}
+
+	err = a.redis.Create(ctx, &models.OTP{Key: lockKey(scope, s), Value: "1", Expire: time.Now().Add(lockout)})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := a.redis.Delete(ctx, &models.OTP{Key: counterKey(scope, s)}); err != nil {
+		return 0, err
+	}
+
+	return lockout, nil
+}
+
+func (a *attempt) subjects(ctx context.Context, account string) []subject {
+	var subjects []subject
+
+	if a.opts.MaxAccountFailures > 0 && account != "" {
+		subjects = append(subjects, subject{kind: "account", value: account, max: a.opts.MaxAccountFailures})
+	}
+
+	if ip := remoteIP(ctx); a.opts.MaxIPFailures > 0 && ip != "" {
+		subjects = append(subjects, subject{kind: "ip", value: ip, max: a.opts.MaxIPFailures})
+	}
+
+	if clientID, ok := helper.ClientID(ctx); a.opts.MaxClientFailures > 0 && ok {
+		subjects = append(subjects, subject{kind: "client", value: strconv.FormatUint(clientID, 10), max: a.opts.MaxClientFailures})
+	}
+
+	return subjects
+}
+
+// remoteIP drops the port from RemoteAddr style addresses so every connection of
+// a host shares a counter. The address was resolved by helper.ClientIP, which
+// only believes X-Forwarded-For from a trusted proxy.
+func remoteIP(ctx context.Context) string {
+	ip := helper.IPAddress(ctx)
+
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		return host
+	}
+
+	return ip
+}
+
+func counterKey(scope string, s subject) string {
+	return "attempt-" + scope + "-" + s.kind + "-" + s.value
+}
+
+func lockKey(scope string, s subject) string {
+	return "attempt-lock-" + scope + "-" + s.kind + "-" + s.value
+}
+
+func locksKey(scope string, s subject) string {
+	return "attempt-locks-" + scope + "-" + s.kind + "-" + s.value
+}
@@ -0,0 +1,694 @@
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/g-graziano/user-auth-golang/avatar"
+	"github.com/g-graziano/user-auth-golang/config"
+	"github.com/g-graziano/user-auth-golang/helper"
+	"github.com/g-graziano/user-auth-golang/keyset"
+	"github.com/g-graziano/user-auth-golang/models"
+	"github.com/g-graziano/user-auth-golang/repository/postgres"
+	"github.com/g-graziano/user-auth-golang/repository/redis"
+	"github.com/g-graziano/user-auth-golang/repository/storage"
+	"github.com/rs/xid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type OAuth interface {
+	RegisterClient(ctx context.Context, client *models.OAuthClientRequest) (*models.OAuthClientResponse, error)
+	ListClients(ctx context.Context, xid string) ([]*models.OAuthClientResponse, error)
+	RevokeClient(ctx context.Context, xid string, clientID string) error
+	AuthenticateClient(ctx context.Context, clientID string, clientSecret string) (*models.ClientID, error)
+
+	GetConsent(ctx context.Context, req *models.AuthorizeRequest) (*models.ConsentResponse, error)
+	Authorize(ctx context.Context, req *models.AuthorizeRequest) (*models.AuthorizeResponse, error)
+	BrowserAuthorize(ctx context.Context, req *models.AuthorizeRequest, rawQuery string) (string, error)
+	Exchange(ctx context.Context, req *models.OAuthTokenRequest) (*models.OAuthTokenResponse, error)
+
+	Discovery() (*models.OpenIDConfiguration, error)
+}
+
+var supportedScopes = []models.OAuthScope{
+	{Name: "openid", Description: "Sign you in with your account"},
+	{Name: "profile", Description: "Read your name, picture and profile details"},
+	{Name: "email", Description: "Read your email address"},
+}
+
+type oauth struct {
+	postgres postgres.Postgres
+	redis    redis.Redis
+	storage  storage.Storage
+	issuer   string
+	loginURL string
+
+	codeExpiry        time.Duration
+	accessTokenExpiry time.Duration
+	consentExpiry     time.Duration
+}
+
+// New builds the authorization server, the public base URL is used as the
+// iss claim of ID tokens and to build the discovery document
+func New(pg postgres.Postgres, rd redis.Redis, st storage.Storage, cfg *config.Config) OAuth {
+	return &oauth{
+		postgres: pg,
+		redis:    rd,
+		storage:  st,
+		issuer:   strings.TrimRight(cfg.Server.PublicBaseURL, "/"),
+		loginURL: cfg.Server.LoginURL,
+
+		codeExpiry:        cfg.Token.OAuthCode,
+		accessTokenExpiry: cfg.Token.OAuthAccess,
+		consentExpiry:     cfg.Token.OAuthConsent,
+	}
+}
+
+func (o *oauth) RegisterClient(ctx context.Context, client *models.OAuthClientRequest) (*models.OAuthClientResponse, error) {
+	if strings.TrimSpace(client.Name) == "" {
+		return nil, invalidRequest("client name is required")
+	}
+
+	if client.Type == "" {
+		client.Type = models.ClientConfidential
+	}
+
+	if client.Type != models.ClientConfidential && client.Type != models.ClientPublic {
+		return nil, invalidRequest("client type must be confidential or public")
+	}
+
+	if len(client.RedirectURIs) < 1 {
+		return nil, invalidRequest("at least one redirect uri is required")
+	}
+
+	for _, uri := range client.RedirectURIs {
+		parsed, err := url.Parse(uri)
+		if err != nil || !parsed.IsAbs() || parsed.Fragment != "" || strings.ContainsAny(uri, " \n") {
+			return nil, invalidRequest("redirect uri " + uri + " must be an absolute uri without fragment")
+		}
+	}
+
+	owner, err := o.postgres.GetUser(ctx, &models.User{XID: client.XID})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(owner) < 1 {
+		return nil, errors.New("user not found")
+	}
+
+	newClient := &models.ClientID{
+		API:          xid.New().String(),
+		Name:         client.Name,
+		Type:         client.Type,
+		RedirectURIs: strings.Join(client.RedirectURIs, "\n"),
+		OwnerID:      owner[0].ID,
+	}
+
+	var secret string
+
+	if client.Type == models.ClientConfidential {
+		secret, err = helper.GenerateURLToken()
+		if err != nil {
+			return nil, err
+		}
+
+		hashedSecret, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+
+		newClient.Secret = helper.NullStringFunc(string(hashedSecret), true)
+	}
+
+	if err := o.postgres.CreateClientID(ctx, newClient); err != nil {
+		return nil, err
+	}
+
+	response := clientResponse(newClient)
+	response.ClientSecret = secret
+
+	return response, nil
+}
+
+// ListClients returns the OAuth clients the user registered, without secrets
+func (o *oauth) ListClients(ctx context.Context, xid string) ([]*models.OAuthClientResponse, error) {
+	owner, err := o.postgres.GetUser(ctx, &models.User{XID: xid})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(owner) < 1 {
+		return nil, errors.New("user not found")
+	}
+
+	clients, err := o.postgres.GetClientID(ctx, &models.ClientID{OwnerID: owner[0].ID})
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*models.OAuthClientResponse{}
+	for _, client := range clients {
+		results = append(results, clientResponse(client))
+	}
+
+	return results, nil
+}
+
+// RevokeClient deletes an OAuth client of the user and ends every session
+// issued to it, its pending authorization codes fail client authentication
+func (o *oauth) RevokeClient(ctx context.Context, xid string, clientID string) error {
+	owner, err := o.postgres.Primary().GetUser(ctx, &models.User{XID: xid})
+	if err != nil {
+		return err
+	}
+
+	if len(owner) < 1 {
+		return errors.New("user not found")
+	}
+
+	clients, err := o.postgres.Primary().GetClientID(ctx, &models.ClientID{API: clientID})
+	if err != nil {
+		return err
+	}
+
+	// someone else's client is reported the same as a missing one
+	if len(clients) < 1 || clients[0].OwnerID != owner[0].ID {
+		return &models.OAuthError{Code: "invalid_request", Description: "client not found", Status: http.StatusNotFound}
+	}
+
+	return o.postgres.WithTx(ctx, func(pg postgres.Postgres) error {
+		if err := pg.DeleteToken(ctx, &models.UserToken{ClientID: clients[0].ID}); err != nil {
+			return err
+		}
+
+		return pg.DeleteClientID(ctx, clients[0])
+	})
+}
+
+func clientResponse(client *models.ClientID) *models.OAuthClientResponse {
+	return &models.OAuthClientResponse{
+		ClientID:     client.API,
+		Name:         client.Name,
+		Type:         client.Type,
+		RedirectURIs: client.RedirectURIList(),
+	}
+}
+
+func (o *oauth) AuthenticateClient(ctx context.Context, clientID string, clientSecret string) (*models.ClientID, error) {
+	invalidClient := &models.OAuthError{Code: "invalid_client", Description: "client authentication failed", Status: http.StatusUnauthorized}
+
+	if clientID == "" {
+		return nil, invalidClient
+	}
+
+	clients, err := o.postgres.GetClientID(ctx, &models.ClientID{API: clientID})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(clients) < 1 || clients[0].Type == models.ClientFirstParty {
+		return nil, invalidClient
+	}
+
+	if clients[0].Type == models.ClientPublic {
+		return clients[0], nil
+	}
+
+	if !clients[0].Secret.Valid || bcrypt.CompareHashAndPassword([]byte(clients[0].Secret.String), []byte(clientSecret)) != nil {
+		return nil, invalidClient
+	}
+
+	return clients[0], nil
+}
+
+func (o *oauth) GetConsent(ctx context.Context, req *models.AuthorizeRequest) (*models.ConsentResponse, error) {
+	client, redirectURI, scopes, err := o.validateAuthorizeRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.ConsentResponse{
+		Client:      models.DataClient{ID: client.ID, Name: client.Name},
+		Scopes:      scopes,
+		RedirectURI: redirectURI,
+		State:       req.State,
+	}, nil
+}
+
+func (o *oauth) Authorize(ctx context.Context, req *models.AuthorizeRequest) (*models.AuthorizeResponse, error) {
+	client, redirectURI, _, err := o.validateAuthorizeRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+
+	if !req.Approve {
+		params.Set("error", "access_denied")
+		params.Set("error_description", "the user denied the request")
+
+		return &models.AuthorizeResponse{RedirectURI: appendQuery(redirectURI, params)}, nil
+	}
+
+	currentUser, err := o.postgres.GetActiveUser(ctx, &models.User{XID: req.XID})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(currentUser) < 1 {
+		return nil, invalidRequest("user not found")
+	}
+
+	code, err := o.issueCode(ctx, client, currentUser[0], req)
+	if err != nil {
+		return nil, err
+	}
+
+	// the browser endpoint authorizes the same scopes again without asking
+	err = o.redis.Create(ctx, &models.OTP{Key: consentKey(currentUser[0].ID, client), Value: req.Scope, Expire: time.Now().Add(o.consentExpiry)})
+	if err != nil {
+		return nil, err
+	}
+
+	params.Set("code", code)
+
+	return &models.AuthorizeResponse{RedirectURI: appendQuery(redirectURI, params)}, nil
+}
+
+// BrowserAuthorize answers an authorization request the client sent a browser
+// with, req.XID is the user of the session cookie and empty without one. It
+// returns where to redirect the browser: redirect_uri with a code when the user
+// already approved the scopes, redirect_uri with an error, or the login page,
+// which sends the browser back to the same request once the user signed in and
+// approved. Only an unknown client or redirect uri is an error, the browser
+// must not be redirected to those.
+func (o *oauth) BrowserAuthorize(ctx context.Context, req *models.AuthorizeRequest, rawQuery string) (string, error) {
+	client, redirectURI, err := o.validateClient(ctx, req)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+
+	redirectError := func(code string, description string) string {
+		params.Set("error", code)
+		params.Set("error_description", description)
+
+		return appendQuery(redirectURI, params)
+	}
+
+	if _, err := validateParams(req); err != nil {
+		var oauthErr *models.OAuthError
+		if errors.As(err, &oauthErr) {
+			return redirectError(oauthErr.Code, oauthErr.Description), nil
+		}
+
+		return "", err
+	}
+
+	var currentUser []*models.User
+
+	if req.XID != "" {
+		currentUser, err = o.postgres.GetActiveUser(ctx, &models.User{XID: req.XID})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if len(currentUser) > 0 && o.hasConsent(ctx, currentUser[0].ID, client, req.Scope) {
+		code, err := o.issueCode(ctx, client, currentUser[0], req)
+		if err != nil {
+			return "", err
+		}
+
+		params.Set("code", code)
+
+		return appendQuery(redirectURI, params), nil
+	}
+
+	if req.Prompt == "none" || o.loginURL == "" {
+		if len(currentUser) < 1 {
+			return redirectError("login_required", "the user is not signed in"), nil
+		}
+
+		return redirectError("consent_required", "the user has not approved the client"), nil
+	}
+
+	returnTo := o.issuer + "/oauth/authorize/browser?" + rawQuery
+
+	return appendQuery(o.loginURL, url.Values{"return_to": {returnTo}}), nil
+}
+
+// issueCode stores a single use authorization code for the user, it is
+// exchanged at the token endpoint
+func (o *oauth) issueCode(ctx context.Context, client *models.ClientID, user *models.User, req *models.AuthorizeRequest) (string, error) {
+	code, err := helper.GenerateURLToken()
+	if err != nil {
+		return "", err
+	}
+
+	value, err := json.Marshal(&models.AuthorizationCode{
+		ClientID:      client.ID,
+		ClientAPI:     client.API,
+		UserID:        user.ID,
+		XID:           user.XID,
+		RedirectURI:   req.RedirectURI,
+		Scope:         req.Scope,
+		CodeChallenge: req.CodeChallenge,
+		Nonce:         req.Nonce,
+		AuthTime:      req.AuthTime,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = o.redis.Create(ctx, &models.OTP{Key: "oauth-code-" + code, Value: string(value), Expire: time.Now().Add(o.codeExpiry)})
+	if err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+// hasConsent reports whether the user approved every scope of scope for the
+// client before
+func (o *oauth) hasConsent(ctx context.Context, userID uint64, client *models.ClientID, scope string) bool {
+	approved, err := o.redis.Get(ctx, &models.OTP{Key: consentKey(userID, client)})
+	if err != nil {
+		return false
+	}
+
+	for _, name := range strings.Fields(scope) {
+		if !hasScope(approved, name) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func consentKey(userID uint64, client *models.ClientID) string {
+	return "oauth-consent-" + strconv.FormatUint(userID, 10) + "-" + client.API
+}
+
+func (o *oauth) Exchange(ctx context.Context, req *models.OAuthTokenRequest) (*models.OAuthTokenResponse, error) {
+	if req.GrantType != "authorization_code" {
+		return nil, &models.OAuthError{Code: "unsupported_grant_type", Description: "only authorization_code is supported", Status: http.StatusBadRequest}
+	}
+
+	if req.Code == "" || req.CodeVerifier == "" {
+		return nil, invalidRequest("code and code_verifier are required")
+	}
+
+	clientID, ok := helper.ClientID(ctx)
+	if !ok {
+		return nil, errors.New("client id not found")
+	}
+
+	// codes are single use, a second exchange of the same code always fails
+	value, err := o.redis.GetAndDelete(ctx, &models.OTP{Key: "oauth-code-" + req.Code})
+	if err != nil {
+		return nil, invalidGrant("authorization code is invalid or expired")
+	}
+
+	var code models.AuthorizationCode
+	if err := json.Unmarshal([]byte(value), &code); err != nil {
+		return nil, err
+	}
+
+	if code.ClientID != clientID {
+		return nil, invalidGrant("authorization code was issued to another client")
+	}
+
+	if code.RedirectURI != req.RedirectURI {
+		return nil, invalidGrant("redirect uri does not match the authorization request")
+	}
+
+	if !verifyCodeChallenge(req.CodeVerifier, code.CodeChallenge) {
+		return nil, invalidGrant("code verifier does not match the code challenge")
+	}
+
+	currentUser, err := o.postgres.GetActiveUser(ctx, &models.User{XID: code.XID})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(currentUser) < 1 {
+		return nil, invalidGrant("user not found")
+	}
+
+	tokenClaim := &models.TokenClaim{
+		XID:        currentUser[0].XID,
+		Email:      currentUser[0].Email,
+		AccessType: "oauth",
+		ClientID:   code.ClientID,
+		Scope:      code.Scope,
+		ExpiredAt:  o.accessTokenExpiry,
+	}
+
+	tokenString, err := tokenClaim.TokenGenerator()
+	if err != nil {
+		return nil, err
+	}
+
+	err = o.postgres.WithTx(ctx, func(pg postgres.Postgres) error {
+		err := pg.CreateToken(ctx, &models.UserToken{
+			Token:     tokenString,
+			UserID:    currentUser[0].ID,
+			TokenType: "Bearer",
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return pg.CreateEvent(ctx, "oauth authorization", currentUser[0].ID)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	response := &models.OAuthTokenResponse{
+		AccessToken: tokenString,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(o.accessTokenExpiry.Seconds()),
+		Scope:       code.Scope,
+	}
+
+	if hasScope(code.Scope, "openid") {
+		response.IDToken, err = o.idToken(&code, currentUser[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return response, nil
+}
+
+func (o *oauth) Discovery() (*models.OpenIDConfiguration, error) {
+	key, err := keyset.Default().SigningKey()
+	if err != nil {
+		return nil, err
+	}
+
+	var scopes []string
+	for _, scope := range supportedScopes {
+		scopes = append(scopes, scope.Name)
+	}
+
+	return &models.OpenIDConfiguration{
+		Issuer:                            o.issuer,
+		AuthorizationEndpoint:             o.issuer + "/oauth/authorize/browser",
+		TokenEndpoint:                     o.issuer + "/oauth/token",
+		UserInfoEndpoint:                  o.issuer + "/userinfo",
+		JWKSURI:                           o.issuer + "/.well-known/jwks.json",
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{key.Algorithm},
+		ScopesSupported:                   scopes,
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		ClaimsSupported:                   []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "email", "email_verified", "name", "picture"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+	}, nil
+}
+
+func (o *oauth) idToken(code *models.AuthorizationCode, user *models.User) (string, error) {
+	now := time.Now()
+
+	claim := &models.IDTokenClaim{
+		AuthTime: code.AuthTime.Unix(),
+		Nonce:    code.Nonce,
+	}
+	claim.Issuer = o.issuer
+	claim.Subject = user.XID
+	claim.Audience = code.ClientAPI
+	claim.IssuedAt = now.Unix()
+	claim.ExpiresAt = now.Add(o.accessTokenExpiry).Unix()
+
+	if hasScope(code.Scope, "email") {
+		verified := user.Status == "active"
+
+		claim.Email = user.Email
+		claim.EmailVerified = &verified
+	}
+
+	if hasScope(code.Scope, "profile") {
+		claim.Name = user.Fullname
+		if user.Picture.Valid {
+			claim.Picture = o.storage.URL(avatar.Key(user.Picture.String, avatar.Large))
+		}
+	}
+
+	return keyset.Default().Sign(claim)
+}
+
+func (o *oauth) validateAuthorizeRequest(ctx context.Context, req *models.AuthorizeRequest) (*models.ClientID, string, []models.OAuthScope, error) {
+	if req.ResponseType != "code" {
+		return nil, "", nil, unsupportedResponseType()
+	}
+
+	client, redirectURI, err := o.validateClient(ctx, req)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	scopes, err := validateParams(req)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	return client, redirectURI, scopes, nil
+}
+
+// validateClient finds the client and the redirect uri to answer to, errors
+// here must not be sent to the redirect uri
+func (o *oauth) validateClient(ctx context.Context, req *models.AuthorizeRequest) (*models.ClientID, string, error) {
+	clients, err := o.postgres.GetClientID(ctx, &models.ClientID{API: req.ClientID})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(clients) < 1 || clients[0].Type == models.ClientFirstParty {
+		return nil, "", invalidRequest("unknown client")
+	}
+
+	client := clients[0]
+	redirectURI := req.RedirectURI
+
+	if redirectURI == "" {
+		if registered := client.RedirectURIList(); len(registered) == 1 {
+			redirectURI = registered[0]
+		}
+	}
+
+	if !client.AllowsRedirect(redirectURI) {
+		return nil, "", invalidRequest("redirect uri is not registered for this client")
+	}
+
+	return client, redirectURI, nil
+}
+
+// validateParams checks the rest of the request, errors here are sent to the
+// redirect uri
+func validateParams(req *models.AuthorizeRequest) ([]models.OAuthScope, error) {
+	if req.ResponseType != "code" {
+		return nil, unsupportedResponseType()
+	}
+
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		return nil, invalidRequest("a code_challenge with code_challenge_method S256 is required")
+	}
+
+	return parseScope(req.Scope)
+}
+
+func parseScope(scope string) ([]models.OAuthScope, error) {
+	var scopes []models.OAuthScope
+
+	for _, name := range strings.Fields(scope) {
+		found := false
+
+		for _, supported := range supportedScopes {
+			if supported.Name == name {
+				scopes = append(scopes, supported)
+				found = true
+			}
+		}
+
+		if !found {
+			return nil, &models.OAuthError{Code: "invalid_scope", Description: "unknown scope " + name, Status: http.StatusBadRequest}
+		}
+	}
+
+	return scopes, nil
+}
+
+// verifyCodeChallenge implements the S256 transformation of RFC 7636
+func verifyCodeChallenge(verifier string, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+func hasScope(scope string, name string) bool {
+	for _, granted := range strings.Fields(scope) {
+		if granted == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func appendQuery(uri string, params url.Values) string {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+
+	query := parsed.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+
+	parsed.RawQuery = query.Encode()
+
+	return parsed.String()
+}
+
+func invalidRequest(description string) error {
+	return &models.OAuthError{Code: "invalid_request", Description: description, Status: http.StatusBadRequest}
+}
+
+func unsupportedResponseType() error {
+	return &models.OAuthError{Code: "unsupported_response_type", Description: "only the code response type is supported", Status: http.StatusBadRequest}
+}
+
+func invalidGrant(description string) error {
+	return &models.OAuthError{Code: "invalid_grant", Description: description, Status: http.StatusBadRequest}
+}
@@ -0,0 +1,163 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/g-graziano/user-auth-golang/config"
+	"github.com/g-graziano/user-auth-golang/helper"
+	"github.com/g-graziano/user-auth-golang/models"
+	"github.com/g-graziano/user-auth-golang/repository/mailer"
+	"github.com/g-graziano/user-auth-golang/repository/postgres"
+)
+
+var ErrNotDead = errors.New("email not found or not dead")
+
+// Outbox delivers the emails queued in the OUTBOX_EMAILS table and lets an
+// admin inspect and requeue them
+type Outbox interface {
+	// Run polls the queue until ctx is done
+	Run(ctx context.Context)
+	// Deliver sends one batch of due emails and returns how many it claimed
+	Deliver(ctx context.Context) (int, error)
+	List(ctx context.Context, status string, limit int, offset int) (*models.ListOutboxResponse, error)
+	Retry(ctx context.Context, id uint64) error
+}
+
+type outbox struct {
+	postgres postgres.Postgres
+	mailer   mailer.Mailer
+	config   config.Outbox
+}
+
+func New(pg postgres.Postgres, ml mailer.Mailer, cfg config.Outbox) Outbox {
+	return &outbox{
+		postgres: pg,
+		mailer:   ml,
+		config:   cfg,
+	}
+}
+
+func (o *outbox) Run(ctx context.Context) {
+	ticker := time.NewTicker(o.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		// keep going while full batches come back, there is more waiting
+		for {
+			claimed, err := o.Deliver(ctx)
+			if err != nil {
+				log.Printf("outbox: %v", err)
+			}
+
+			if err != nil || claimed < o.config.BatchSize || ctx.Err() != nil {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (o *outbox) Deliver(ctx context.Context) (int, error) {
+	emails, err := o.postgres.ClaimOutboxEmails(ctx, o.config.BatchSize, o.config.Lease)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, email := range emails {
+		o.deliver(ctx, email)
+
+		if err := o.postgres.UpdateOutboxEmail(ctx, email); err != nil {
+			return len(emails), err
+		}
+	}
+
+	return len(emails), nil
+}
+
+// deliver sends email and records the outcome on it
+func (o *outbox) deliver(ctx context.Context, email *models.OutboxEmail) {
+	email.Attempts++
+
+	err := o.mailer.Send(ctx, email.Email())
+	if err == nil {
+		email.Status = models.OutboxSent
+		email.LastError = helper.NullString{}
+		email.SentAt = helper.NullTime{NullTime: sql.NullTime{Time: time.Now(), Valid: true}}
+		return
+	}
+
+	email.LastError = helper.NullStringFunc(err.Error(), true)
+
+	if email.Attempts >= o.config.MaxAttempts {
+		log.Printf("outbox: email %d to %s is dead after %d attempts: %v", email.ID, email.RecipientEmail, email.Attempts, err)
+		email.Status = models.OutboxDead
+		return
+	}
+
+	email.NextAttemptAt = time.Now().Add(o.backoff(email.Attempts))
+}
+
+// backoff doubles the wait after every failed attempt, capped at RetryMax
+func (o *outbox) backoff(attempts int) time.Duration {
+	wait := o.config.RetryBase
+	for i := 1; i < attempts && wait < o.config.RetryMax; i++ {
+		wait *= 2
+	}
+
+	if wait > o.config.RetryMax {
+		wait = o.config.RetryMax
+	}
+
+	return wait
+}
+
+func (o *outbox) List(ctx context.Context, status string, limit int, offset int) (*models.ListOutboxResponse, error) {
+	switch status {
+	case "":
+		status = models.OutboxPending
+	case models.OutboxPending, models.OutboxSent, models.OutboxDead:
+	default:
+		return nil, errors.New("status must be pending, sent or dead")
+	}
+
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	emails, total, err := o.postgres.GetOutboxEmails(ctx, status, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	if emails == nil {
+		emails = []*models.OutboxEmail{}
+	}
+
+	return &models.ListOutboxResponse{Emails: emails, Total: total}, nil
+}
+
+func (o *outbox) Retry(ctx context.Context, id uint64) error {
+	retried, err := o.postgres.RetryOutboxEmail(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if !retried {
+		return ErrNotDead
+	}
+
+	return nil
+}
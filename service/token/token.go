@@ -3,16 +3,18 @@ package token
 import (
 	"context"
 	"errors"
-	"os"
-	"strconv"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/g-graziano/user-auth-golang/config"
+	"github.com/g-graziano/user-auth-golang/helper"
 	"github.com/g-graziano/user-auth-golang/models"
 	"github.com/g-graziano/user-auth-golang/repository/postgres"
 	"github.com/g-graziano/user-auth-golang/repository/redis"
+	"github.com/g-graziano/user-auth-golang/service/attempt"
 )
 
+var errOTPNotValid = errors.New("OTP tidak berlaku")
+
 type Token interface {
 	VerifyTfa(ctx context.Context, otp *models.OTPRequest) (*models.AccessToken, error)
 }
@@ -20,52 +22,105 @@ type Token interface {
 type token struct {
 	postgres postgres.Postgres
 	redis    redis.Redis
+	attempt  attempt.Attempt
+	config   *config.Config
 }
 
-func New(pg postgres.Postgres, rd redis.Redis) Token {
+func New(pg postgres.Postgres, rd redis.Redis, at attempt.Attempt, cfg *config.Config) Token {
 	return &token{
 		postgres: pg,
 		redis:    rd,
+		attempt:  at,
+		config:   cfg,
 	}
 }
 
 func (t *token) VerifyTfa(ctx context.Context, otp *models.OTPRequest) (*models.AccessToken, error) {
-	verifyUser, err := t.postgres.GetUser(&models.User{XID: otp.XID})
+	verifyUser, err := t.postgres.Primary().GetUser(ctx, &models.User{XID: otp.XID})
 
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = t.redis.Get(&models.OTP{Key: strconv.FormatUint(verifyUser[0].ID, 10) + "-login"})
+	if len(verifyUser) < 1 || !verifyUser[0].TFA || !verifyUser[0].TFASecret.Valid {
+		return nil, errors.New("user not found")
+	}
+
+	if err := t.attempt.Check(ctx, "tfa", verifyUser[0].XID); err != nil {
+		return nil, err
+	}
+
+	secret, err := helper.DecryptString(t.config.TFA.SecretKey, verifyUser[0].TFASecret.String)
 
 	if err != nil {
-		return nil, errors.New("OTP tidak berlaku")
+		return nil, err
+	}
+
+	clientID, ok := helper.ClientID(ctx)
+	if !ok {
+		return nil, errors.New("client id not found")
 	}
 
-	now := time.Now().UTC()
-	end := now.Add(time.Hour * 24)
+	step, valid := helper.MatchTOTPCode(secret, otp.Code, time.Now(), t.config.TFA.TOTPSkew)
+
 	claim := models.TokenClaim{
 		XID:        verifyUser[0].XID,
 		Email:      verifyUser[0].Email,
 		AccessType: "login",
+		ExpiredAt:  t.config.Token.Access,
+		ClientID:   clientID,
 	}
-	claim.IssuedAt = now.Unix()
-	claim.ExpiresAt = end.Unix()
 
-	signKey := []byte(os.Getenv("JWT_SIGNATURE_KEY"))
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claim)
+	tokenString, err := claim.TokenGenerator()
+	if err != nil {
+		return nil, err
+	}
+
+	// the time step is only spent if the session it was used for is created
+	if valid {
+		err = t.postgres.WithTx(ctx, func(pg postgres.Postgres) error {
+			used, err := pg.UseTOTPStep(ctx, verifyUser[0].ID, step)
+			if err != nil {
+				return err
+			}
+
+			if !used {
+				return errOTPNotValid
+			}
 
-	tokenString, _ := token.SignedString(signKey)
+			err = pg.CreateToken(ctx, &models.UserToken{
+				Token:     tokenString,
+				UserID:    verifyUser[0].ID,
+				TokenType: "Bearer",
+			})
+
+			if err != nil {
+				return err
+			}
+
+			return pg.CreateEvent(ctx, "verify tfa", verifyUser[0].ID)
+		})
+	}
 
-	err = t.postgres.CreateToken(ctx, &models.UserToken{Token: tokenString, UserID: verifyUser[0].ID, TokenType: "login"})
+	if !valid || err == errOTPNotValid {
+		if err := t.attempt.Fail(ctx, "tfa", verifyUser[0].XID, verifyUser[0].ID); err != nil {
+			return nil, err
+		}
+
+		return nil, errOTPNotValid
+	}
 
 	if err != nil {
 		return nil, err
 	}
 
+	if err := t.attempt.Succeed(ctx, "tfa", verifyUser[0].XID, verifyUser[0].ID); err != nil {
+		return nil, err
+	}
+
 	return &models.AccessToken{
 		Value:     tokenString,
 		Type:      "Bearer",
-		ExpiredAt: end.String(),
+		ExpiredAt: time.Now().Add(claim.ExpiredAt).String(),
 	}, nil
 }
@@ -1,82 +1,113 @@
 package user
 
 import (
-	"bytes"
 	"context"
+	"database/sql"
 	"encoding/base64"
-	"encoding/json"
 	"errors"
-	"fmt"
-	"io"
 	"io/ioutil"
-	"mime/multipart"
-	"net/http"
+	"log"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/g-graziano/user-auth-golang/avatar"
+	"github.com/g-graziano/user-auth-golang/config"
+	"github.com/g-graziano/user-auth-golang/emails"
 	"github.com/g-graziano/user-auth-golang/helper"
 	"github.com/g-graziano/user-auth-golang/models"
+	"github.com/g-graziano/user-auth-golang/password"
 	"github.com/g-graziano/user-auth-golang/repository/postgres"
 	"github.com/g-graziano/user-auth-golang/repository/redis"
-	sdg "github.com/g-graziano/user-auth-golang/repository/sendgrid"
+	"github.com/g-graziano/user-auth-golang/repository/storage"
+	"github.com/g-graziano/user-auth-golang/service/attempt"
 	"github.com/go-playground/validator"
 	"github.com/rs/xid"
 	"github.com/skip2/go-qrcode"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type User interface {
-	GetAPIClientID(client *models.ClientID) (*models.ClientID, error)
+	GetAPIClientID(ctx context.Context, client *models.ClientID) (*models.ClientID, error)
 	Login(ctx context.Context, user *models.Login) (*models.AccessToken, error)
 	ByPassTfa(ctx context.Context, code *models.OTPRequest) (*models.AccessToken, error)
-	GetNewAccessToken(ctx context.Context, token *models.AccessTokenRequest) (*models.AccessToken, error)
+	GetNewAccessToken(ctx context.Context, token *models.AccessTokenRequest) (*models.SessionToken, error)
 	RefreshToken(ctx context.Context, user *models.User) (*models.AccessToken, error)
 
-	Logout(user *models.User) error
-	Register(user *models.RegisterRequest) error
-
-	VerifyEmail(user *models.User) error
-	SendEmailValidation(user *models.User) error
-	ResendEmailValidation(user *models.User) error
-
-	ForgotPassword(user *models.User) error
-	ResetPassword(resetPass *models.ResetPass) error
-
-	GetUserProfile(user *models.User) (*models.ProfileResponse, error)
-	UpdateUserPicture(picture *models.UploadProfile) error
-	GetUserTfaStatus(user *models.User) (*models.TFAStatus, error)
-	EnrollTfa(user *models.User) (*models.EnrollTfa, error)
-	GetUserEmail(user *models.User) (*models.GetEmailResponse, error)
-	UpdateUserProfile(user *models.User) error
-	DeleteProfilePicture(user *models.User) error
-	UpdateUserPassword(user *models.ChangePassword) error
-	RequestChangePassword(user *models.User) error
-	DeleteUser(user *models.User) error
-	DeleteOtherSession(token *models.AccessTokenRequest) error
-	DeleteCurrentSession(token *models.UserToken) error
-	RemoveTfa(user *models.User) error
-	CheckJWTIsActive(token *models.UserToken) error
-	ActivateTfa(secret *models.ActivateTfaRequest) (*models.BackupCodesResponse, error)
-
-	GetListEvent(user *models.User) (*models.ListEventResponse, error)
-	GetListSession(session *models.ListSessionRequest) (*models.ListSessionResponse, error)
+	Logout(ctx context.Context, user *models.User) error
+	Register(ctx context.Context, user *models.RegisterRequest) error
+
+	VerifyEmail(ctx context.Context, token string) error
+	SendEmailValidation(ctx context.Context, user *models.User) error
+	ResendEmailValidation(ctx context.Context, user *models.User) error
+
+	ForgotPassword(ctx context.Context, user *models.User) error
+	ResetPassword(ctx context.Context, resetPass *models.ResetPass) error
+
+	GetUserProfile(ctx context.Context, user *models.User) (*models.ProfileResponse, error)
+	UpdateUserPicture(ctx context.Context, picture *models.UploadProfile) error
+	GetUserTfaStatus(ctx context.Context, user *models.User) (*models.TFAStatus, error)
+	EnrollTfa(ctx context.Context, user *models.User) (*models.EnrollTfa, error)
+	GetUserEmail(ctx context.Context, user *models.User) (*models.GetEmailResponse, error)
+	UpdateUserProfile(ctx context.Context, user *models.User) error
+	DeleteProfilePicture(ctx context.Context, user *models.User) error
+	UpdateUserPassword(ctx context.Context, user *models.ChangePassword) error
+	RequestChangeEmail(ctx context.Context, user *models.User) error
+	CheckVerificationToken(ctx context.Context, token string, purpose string) error
+	ConfirmChangeEmail(ctx context.Context, token string) error
+	RevertEmail(ctx context.Context, token string) error
+	DeleteUser(ctx context.Context, user *models.User) error
+	DeleteOtherSession(ctx context.Context, token *models.AccessTokenRequest) error
+	DeleteCurrentSession(ctx context.Context, token *models.UserToken) error
+	RemoveTfa(ctx context.Context, user *models.User) error
+	CheckJWTIsActive(ctx context.Context, token *models.UserToken) error
+	ActivateTfa(ctx context.Context, secret *models.ActivateTfaRequest) (*models.BackupCodesResponse, error)
+	GetBackupCodesStatus(ctx context.Context, user *models.User) (*models.BackupCodesStatus, error)
+	RegenerateBackupCodes(ctx context.Context, user *models.User) (*models.BackupCodesResponse, error)
+
+	GetListEvent(ctx context.Context, filter *models.EventFilter) (*models.ListEventResponse, error)
+	GetListSession(ctx context.Context, session *models.ListSessionRequest) (*models.ListSessionResponse, error)
 }
 
+const tfaIssuer = "User Land"
+
+var (
+	errTokenReused  = errors.New("refresh token has already been used, all sessions from it were revoked")
+	errCodeNotValid = errors.New("code not valid")
+
+	errClientIDNotFound = errors.New("client id not found")
+)
+
+const (
+	defaultEventsPerPage = 10
+	maxEventsPerPage     = 100
+)
+
 type user struct {
 	postgres postgres.Postgres
 	redis    redis.Redis
+	storage  storage.Storage
+	emails   emails.Renderer
+	attempt  attempt.Attempt
+	hasher   password.Hasher
+	policy   password.Policy
+	config   *config.Config
 }
 
-func New(pg postgres.Postgres, rd redis.Redis) User {
+func New(pg postgres.Postgres, rd redis.Redis, st storage.Storage, er emails.Renderer, at attempt.Attempt, hs password.Hasher, pp password.Policy, cfg *config.Config) User {
 	return &user{
 		postgres: pg,
 		redis:    rd,
+		storage:  st,
+		emails:   er,
+		attempt:  at,
+		hasher:   hs,
+		policy:   pp,
+		config:   cfg,
 	}
 }
 
-func (u *user) GetListEvent(user *models.User) (*models.ListEventResponse, error) {
-	currentUser, err := u.postgres.GetUser(user)
+func (u *user) GetListEvent(ctx context.Context, filter *models.EventFilter) (*models.ListEventResponse, error) {
+	currentUser, err := u.postgres.GetUser(ctx, &models.User{XID: filter.XID})
 
 	if err != nil {
 		return nil, err
@@ -86,14 +117,24 @@ func (u *user) GetListEvent(user *models.User) (*models.ListEventResponse, error
 		return nil, errors.New("Invalid auth token")
 	}
 
-	limit := 3
-	offset := 0
+	filter.UserID = currentUser[0].ID
 
-	eventResult, err := u.postgres.GetEvent(
-		&models.User{ID: currentUser[0].ID},
-		limit,
-		offset,
-	)
+	if filter.PerPage < 1 || filter.PerPage > maxEventsPerPage {
+		filter.PerPage = defaultEventsPerPage
+	}
+
+	if filter.Page < 1 {
+		filter.Page = 1
+	}
+
+	if filter.Cursor != "" {
+		filter.BeforeID, err = decodeEventCursor(filter.Cursor)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	eventResult, err := u.postgres.GetEvent(ctx, filter)
 
 	if err != nil {
 		return nil, err
@@ -102,25 +143,90 @@ func (u *user) GetListEvent(user *models.User) (*models.ListEventResponse, error
 	var listEvent models.ListEventResponse
 	var listEventData models.ListEventResponseData
 
-	listEvent.Pagination.Page = 0
-	listEvent.Pagination.PerPage = limit
+	listEvent.Data = []models.ListEventResponseData{}
+	listEvent.Pagination.PerPage = filter.PerPage
 
 	for _, v := range eventResult {
 		listEventData.IP = v.IPAddress
 		listEventData.Event = v.Event
 		listEventData.UA = v.UA
 		listEventData.CreatedAt = v.CreatedAt
-		listEventData.Client.ID = v.UserID
+		listEventData.Client.ID = v.ClientID
 		listEventData.Client.Name = v.ClientName
 
 		listEvent.Data = append(listEvent.Data, listEventData)
 	}
 
+	remaining := 0
+
+	if len(eventResult) > 0 {
+		listEvent.Pagination.Total = eventResult[0].TotalEvent
+		remaining = eventResult[0].RemainingEvent
+	} else if filter.Page > 1 || filter.BeforeID != 0 {
+		// past the last page the count has no row to ride on
+		first, err := u.postgres.GetEvent(ctx, &models.EventFilter{
+			UserID:   filter.UserID,
+			PerPage:  1,
+			Event:    filter.Event,
+			ClientID: filter.ClientID,
+			From:     filter.From,
+			To:       filter.To,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if len(first) > 0 {
+			listEvent.Pagination.Total = first[0].TotalEvent
+		}
+	}
+
+	// with a cursor there is no offset and remaining counts the events from
+	// the cursor on, without one it is the total
+	offset := 0
+	if filter.BeforeID == 0 {
+		offset = (filter.Page - 1) * filter.PerPage
+	}
+
+	if len(eventResult) > 0 && offset+len(eventResult) < remaining {
+		listEvent.Pagination.NextCursor = encodeEventCursor(eventResult[len(eventResult)-1].ID)
+	}
+
+	if filter.BeforeID == 0 {
+		listEvent.Pagination.Page = filter.Page
+
+		if filter.Page*filter.PerPage < listEvent.Pagination.Total {
+			listEvent.Pagination.Next = filter.Page + 1
+		}
+
+		if filter.Page > 1 {
+			listEvent.Pagination.Previous = filter.Page - 1
+		}
+	}
+
 	return &listEvent, nil
 }
 
-func (u *user) GetListSession(session *models.ListSessionRequest) (*models.ListSessionResponse, error) {
-	currentUser, err := u.postgres.GetUser(&models.User{XID: session.XID})
+func encodeEventCursor(id uint64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(id, 10)))
+}
+
+func decodeEventCursor(cursor string) (uint64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errors.New("cursor not valid")
+	}
+
+	id, err := strconv.ParseUint(string(raw), 10, 64)
+	if err != nil || id == 0 {
+		return 0, errors.New("cursor not valid")
+	}
+
+	return id, nil
+}
+
+func (u *user) GetListSession(ctx context.Context, session *models.ListSessionRequest) (*models.ListSessionResponse, error) {
+	currentUser, err := u.postgres.GetUser(ctx, &models.User{XID: session.XID})
 
 	if err != nil {
 		return nil, err
@@ -130,7 +236,7 @@ func (u *user) GetListSession(session *models.ListSessionRequest) (*models.ListS
 		return nil, errors.New("Invalid auth token")
 	}
 
-	sessionResult, err := u.postgres.GetSession(&models.UserToken{UserID: currentUser[0].ID})
+	sessionResult, err := u.postgres.GetSession(ctx, &models.UserToken{UserID: currentUser[0].ID})
 
 	if err != nil {
 		return nil, err
@@ -159,8 +265,8 @@ func (u *user) GetListSession(session *models.ListSessionRequest) (*models.ListS
 	return &listSession, nil
 }
 
-func (u *user) CheckJWTIsActive(token *models.UserToken) error {
-	currentToken, err := u.postgres.GetToken(token)
+func (u *user) CheckJWTIsActive(ctx context.Context, token *models.UserToken) error {
+	currentToken, err := u.postgres.GetToken(ctx, token)
 
 	if err != nil {
 		return err
@@ -170,16 +276,16 @@ func (u *user) CheckJWTIsActive(token *models.UserToken) error {
 		return errors.New("Invalid auth token")
 	}
 
-	if currentToken[0].Status == "nonactive" {
+	if currentToken[0].Status != "active" {
 		return errors.New("Invalid auth token")
 	}
 
 	return nil
 }
 
-func (u *user) SendEmailValidation(user *models.User) error {
+func (u *user) SendEmailValidation(ctx context.Context, user *models.User) error {
 	if user.Fullname == "" && user.Email != "" {
-		newUser, err := u.postgres.GetUser(user)
+		newUser, err := u.postgres.Primary().GetUser(ctx, user)
 		if err != nil {
 			return err
 		}
@@ -191,62 +297,37 @@ func (u *user) SendEmailValidation(user *models.User) error {
 		user = newUser[0]
 	}
 
-	var email models.Email
-	email.Subject = "Please verify your email address"
-	email.RecipientName = user.Fullname
-	email.RecipientEmail = user.Email
-	email.PlainContent = "Hi " + user.Fullname + ", Please click link below to verify your email address so we know that it's really you!"
-	email.HTMLContent = `<p>Hi ` + user.Fullname + `,</p>
-		<p>Please click link below to verify your email address so we know that it's really you!</p>
-		<p><a href="http://0.0.0.0:8080/auth/verification/` + user.XID + `" style="box-sizing: border-box;
-		border-color: #ED3237;font-weight: 400;text-decoration: none;display: inline-block;margin: 0;color: #ffffff;background-color: #ED3237;
-		border: solid 1px #ED3237;border-radius: 2px;font-size: 14px;padding: 12px 45px;">Confirm Email Address<a></p>`
-
-	err := sdg.SendEmail(&email)
-
-	if err != nil {
+	if err := u.throttleEmail(ctx, models.PurposeVerifyEmail, user.ID); err != nil {
 		return err
 	}
 
-	return nil
-}
-
-func (u *user) SendEmailOTP(user *models.User) error {
-	OTP := helper.GenerateNumericCode(1000, 9999)
+	return u.postgres.WithTx(ctx, func(pg postgres.Postgres) error {
+		tx := u.withPostgres(pg)
 
-	err := u.redis.Create(&models.OTP{Value: OTP, Key: strconv.FormatUint(user.ID, 10) + "-login", Expire: time.Now().Add(time.Minute * 5)})
-	if err != nil {
-		return err
-	}
-
-	var email models.Email
-	email.Subject = "User land OTP"
-	email.RecipientName = user.Fullname
-	email.RecipientEmail = user.Email
-	email.PlainContent = "Hi " + user.Fullname + ", Please input OTP below"
-	email.HTMLContent = `<p>Hi ` + user.Fullname + `,</p>
-		<p>Please input OTP below, so we know that it's really you!</p>
-		<p style="box-sizing: border-box;
-		border-color: #ED3237;font-weight: 400;text-decoration: none;display: inline-block;margin: 0;color: #ffffff;background-color: #ED3237;
-		border: solid 1px #ED3237;border-radius: 2px;font-size: 14px;padding: 12px 45px;">` + OTP + `</p>`
-
-	err = sdg.SendEmail(&email)
+		return tx.sendEmailValidation(ctx, user)
+	})
+}
 
+func (u *user) sendEmailValidation(ctx context.Context, user *models.User) error {
+	token, err := u.issueVerificationToken(ctx, user.ID, models.PurposeVerifyEmail, "", u.config.Token.VerifyEmail)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return u.sendEmail(ctx, user, user.Email, emails.VerifyEmail, &emails.Data{
+		URL: u.config.Server.PublicBaseURL + "/auth/verification/" + token,
+	})
 }
 
-func (u *user) GetAPIClientID(client *models.ClientID) (*models.ClientID, error) {
-	result, err := u.postgres.GetClientID(client)
+func (u *user) GetAPIClientID(ctx context.Context, client *models.ClientID) (*models.ClientID, error) {
+	result, err := u.postgres.GetClientID(ctx, client)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if len(result) < 1 {
+	// OAuth clients registered by users only get tokens through /oauth
+	if len(result) < 1 || result[0].Type != models.ClientFirstParty {
 		return nil, errors.New("Client API not valid")
 	}
 
@@ -258,25 +339,58 @@ func (u *user) Login(ctx context.Context, user *models.Login) (*models.AccessTok
 
 	user.Email = strings.ToLower(user.Email)
 
-	loginUser, err := u.postgres.GetActiveUser(&models.User{Email: user.Email})
+	if err := u.attempt.Check(ctx, "login", user.Email); err != nil {
+		return nil, err
+	}
+
+	loginUser, err := u.postgres.GetActiveUser(ctx, &models.User{Email: user.Email})
 
 	if err != nil {
 		return nil, err
 	}
 
 	if len(loginUser) < 1 {
+		if err := u.attempt.Fail(ctx, "login", user.Email, 0); err != nil {
+			return nil, err
+		}
+
 		return nil, errors.New("user not found")
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(loginUser[0].Password), []byte(user.Password)); err != nil && err == bcrypt.ErrMismatchedHashAndPassword {
+	valid, err := u.hasher.Verify(user.Password, loginUser[0].Password)
+	if err != nil {
+		return nil, err
+	}
+
+	if !valid {
+		if err := u.attempt.Fail(ctx, "login", user.Email, loginUser[0].ID); err != nil {
+			return nil, err
+		}
+
 		return nil, errors.New("invalid login credentials, please try again")
 	}
 
+	if err := u.attempt.Succeed(ctx, "login", user.Email, loginUser[0].ID); err != nil {
+		return nil, err
+	}
+
+	// upgrade hashes made with an older algorithm or weaker parameters while
+	// the plaintext password is at hand
+	rehash := u.hasher.NeedsRehash(loginUser[0].Password)
+	if rehash {
+		hashedPassword, err := u.hasher.Hash(user.Password)
+		if err != nil {
+			return nil, err
+		}
+
+		loginUser[0].Password = hashedPassword
+	}
+
 	var token models.TokenClaim
 
-	clientID, err := strconv.ParseUint(fmt.Sprintf("%v", ctx.Value(helper.StringToInterface("client-id"))), 0, 64)
-	if err != nil {
-		return nil, err
+	clientID, ok := helper.ClientID(ctx)
+	if !ok {
+		return nil, errClientIDNotFound
 	}
 
 	token.ClientID = clientID
@@ -284,14 +398,17 @@ func (u *user) Login(ctx context.Context, user *models.Login) (*models.AccessTok
 
 	if loginUser[0].TFA {
 		token.AccessType = "tfa"
-		token.ExpiredAt = time.Minute * 5
+		token.ExpiredAt = u.config.Token.TFA
 	} else {
 		token.Email = loginUser[0].Email
 		token.AccessType = "login"
-		token.ExpiredAt = time.Hour * 24
+		token.ExpiredAt = u.config.Token.Access
 	}
 
-	tokenString := token.TokenGenerator()
+	tokenString, err := token.TokenGenerator()
+	if err != nil {
+		return nil, err
+	}
 
 	accessToken := &models.AccessToken{
 		Value:     tokenString,
@@ -299,50 +416,58 @@ func (u *user) Login(ctx context.Context, user *models.Login) (*models.AccessTok
 		ExpiredAt: time.Now().Add(token.ExpiredAt).String(),
 	}
 
-	err = u.postgres.CreateToken(ctx, &models.UserToken{
-		Token:        tokenString,
-		UserID:       loginUser[0].ID,
-		TokenType:    "Bearer",
-		RefreshToken: helper.NullStringFunc("", false),
-	})
+	err = u.postgres.WithTx(ctx, func(pg postgres.Postgres) error {
+		if rehash {
+			if err := pg.UpdateUser(ctx, loginUser[0]); err != nil {
+				return err
+			}
+		}
 
-	if err != nil {
-		return nil, err
-	}
+		err := pg.CreateToken(ctx, &models.UserToken{
+			Token:        tokenString,
+			UserID:       loginUser[0].ID,
+			TokenType:    "Bearer",
+			RefreshToken: helper.NullStringFunc("", false),
+		})
 
-	err = u.postgres.CreateEvent(ctx, "login", loginUser[0].ID)
+		if err != nil {
+			return err
+		}
+
+		return pg.CreateEvent(ctx, "login", loginUser[0].ID)
+	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	if loginUser[0].TFA {
-		u.SendEmailOTP(loginUser[0])
-	}
-
-	return accessToken, err
+	return accessToken, nil
 }
 
-func (u *user) Logout(user *models.User) error {
-	var logoutUser, err = u.postgres.GetUser(&models.User{XID: user.XID})
+func (u *user) Logout(ctx context.Context, user *models.User) error {
+	var logoutUser, err = u.postgres.GetUser(ctx, &models.User{XID: user.XID})
 
 	if len(logoutUser) < 1 {
 		return errors.New("user not found")
 	}
 
-	err = u.postgres.UpdateUser(logoutUser[0])
+	err = u.postgres.UpdateUser(ctx, logoutUser[0])
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (u *user) Register(user *models.RegisterRequest) error {
+func (u *user) Register(ctx context.Context, user *models.RegisterRequest) error {
 	if err := user.ValidateRegister(); err != nil {
 		return err
 	}
 
-	existingUser, err := u.postgres.GetUser(&models.User{Email: user.Email})
+	if !emails.SupportedLocale(user.Locale) {
+		return errors.New("locale not supported")
+	}
+
+	existingUser, err := u.postgres.Primary().GetUser(ctx, &models.User{Email: user.Email})
 
 	if err != nil {
 		return err
@@ -352,110 +477,163 @@ func (u *user) Register(user *models.RegisterRequest) error {
 		return errors.New("Email Already Exists")
 	}
 
-	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	if err := u.policy.Check(user.Password, []string{user.Email, user.Fullname}, nil); err != nil {
+		return err
+	}
+
+	hashedPassword, err := u.hasher.Hash(user.Password)
+	if err != nil {
+		return err
+	}
 
 	var createUser models.User
 
-	createUser.Password = string(hashedPassword)
+	createUser.Password = hashedPassword
 	createUser.Fullname = strings.ToLower(user.Fullname)
 	createUser.Email = strings.ToLower(user.Email)
 	createUser.XID = xid.New().String()
+	createUser.Locale = user.Locale
 
-	err = u.postgres.CreateUser(&createUser)
-	if err != nil {
-		return err
-	}
+	return u.postgres.WithTx(ctx, func(pg postgres.Postgres) error {
+		tx := u.withPostgres(pg)
 
-	newUser, err := u.postgres.GetUser(&models.User{XID: createUser.XID})
-	if err != nil {
-		return err
-	}
+		err := tx.postgres.CreateUser(ctx, &createUser)
+		if err != nil {
+			return err
+		}
 
-	if len(newUser) < 1 {
-		return errors.New("Register failed")
-	}
+		newUser, err := tx.postgres.GetUser(ctx, &models.User{XID: createUser.XID})
+		if err != nil {
+			return err
+		}
 
-	u.SendEmailValidation(newUser[0])
+		if len(newUser) < 1 {
+			return errors.New("Register failed")
+		}
 
-	return err
+		if err := tx.recordPassword(ctx, newUser[0]); err != nil {
+			return err
+		}
+
+		return tx.sendEmailValidation(ctx, newUser[0])
+	})
 }
 
-func (u *user) VerifyEmail(user *models.User) error {
-	var verifyUser, err = u.postgres.GetUser(user)
+func (u *user) VerifyEmail(ctx context.Context, token string) error {
+	return u.postgres.WithTx(ctx, func(pg postgres.Postgres) error {
+		tx := u.withPostgres(pg)
 
+		verification, err := tx.consumeVerificationToken(ctx, token, models.PurposeVerifyEmail)
+		if err != nil {
+			return err
+		}
+
+		verifyUser, err := tx.postgres.GetUser(ctx, &models.User{ID: verification.UserID})
+
+		if err != nil {
+			return err
+		}
+
+		if len(verifyUser) < 1 {
+			return errors.New("user not found")
+		}
+
+		if verifyUser[0].Status != "nonactive" {
+			return errors.New("email already verified")
+		}
+
+		verifyUser[0].Status = "active"
+
+		return tx.postgres.UpdateUser(ctx, verifyUser[0])
+	})
+}
+
+func (u *user) ResendEmailValidation(ctx context.Context, user *models.User) error {
+	findUser, err := u.postgres.Primary().GetUser(ctx, &models.User{Email: user.Email})
 	if err != nil {
 		return err
 	}
 
-	if len(verifyUser) < 1 {
+	if len(findUser) < 1 {
 		return errors.New("user not found")
 	}
 
-	verifyUser[0].Status = "active"
-
-	err = u.postgres.UpdateUser(verifyUser[0])
-	if err != nil {
-		return err
+	if findUser[0].Status != "nonactive" {
+		return errors.New("email already verified")
 	}
 
-	return nil
+	return u.SendEmailValidation(ctx, findUser[0])
 }
 
-func (u *user) ResendEmailValidation(user *models.User) error {
-	findUser, err := u.postgres.GetUser(&models.User{Email: user.Email})
+func (u *user) ForgotPassword(ctx context.Context, user *models.User) error {
+	var forgotUser, err = u.postgres.GetActiveUser(ctx, user)
+
 	if err != nil {
 		return err
 	}
 
-	if len(findUser) < 1 {
+	if len(forgotUser) < 1 {
 		return errors.New("user not found")
 	}
 
-	u.SendEmailValidation(findUser[0])
+	if err := u.throttleEmail(ctx, models.PurposeResetPassword, forgotUser[0].ID); err != nil {
+		return err
+	}
 
-	return nil
+	return u.postgres.WithTx(ctx, func(pg postgres.Postgres) error {
+		tx := u.withPostgres(pg)
+
+		token, err := tx.issueVerificationToken(ctx, forgotUser[0].ID, models.PurposeResetPassword, helper.HashToken(forgotUser[0].Password), u.config.Token.ResetPassword)
+		if err != nil {
+			return err
+		}
+
+		return tx.sendEmail(ctx, forgotUser[0], forgotUser[0].Email, emails.ResetPassword, &emails.Data{
+			Token: token,
+		})
+	})
 }
 
-func (u *user) ForgotPassword(user *models.User) error {
-	var forgotUser, err = u.postgres.GetActiveUser(user)
+func (u *user) RefreshToken(ctx context.Context, user *models.User) (*models.AccessToken, error) {
+	var currentUser, err = u.postgres.GetActiveUser(ctx, user)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if len(forgotUser) < 1 {
-		return errors.New("user not found")
+	if len(currentUser) < 1 {
+		return nil, errors.New("user not found")
 	}
 
-	var tokenClaim = &models.TokenClaim{
-		Email:      forgotUser[0].Email,
-		AccessType: "resetpassword",
-		ExpiredAt:  time.Minute * 5,
+	clientID, ok := helper.ClientID(ctx)
+	if !ok {
+		return nil, errClientIDNotFound
 	}
 
-	token := tokenClaim.TokenGenerator()
+	var refreshToken *models.AccessToken
+
+	err = u.postgres.WithTx(ctx, func(pg postgres.Postgres) error {
+		tx := u.withPostgres(pg)
+
+		// every refresh token starts a new family, tokens rotated from it share the family
+		refreshToken, err = tx.createRefreshToken(ctx, currentUser[0], clientID, xid.New().String())
+
+		if err != nil {
+			return err
+		}
 
-	var email models.Email
-	email.Subject = "Reset Password"
-	email.RecipientName = forgotUser[0].Fullname
-	email.RecipientEmail = forgotUser[0].Email
-	email.PlainContent = "Hi " + forgotUser[0].Fullname + ", Please input token below"
-	email.HTMLContent = `<p>Hi ` + forgotUser[0].Fullname + `,</p>
-		<p>Please input token below</p>
-		<p style="box-sizing: border-box;
-		border-color: #ED3237;font-weight: 400;text-decoration: none;display: inline-block;margin: 0;color: #ffffff;background-color: #ED3237;
-		border: solid 1px #ED3237;border-radius: 2px;font-size: 14px;padding: 12px 45px;">` + token + `</p>`
+		return tx.postgres.CreateEvent(ctx, "refresh token", currentUser[0].ID)
+	})
 
-	err = sdg.SendEmail(&email)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return refreshToken, nil
 }
 
-func (u *user) RefreshToken(ctx context.Context, user *models.User) (*models.AccessToken, error) {
-	var currentUser, err = u.postgres.GetActiveUser(user)
+func (u *user) GetNewAccessToken(ctx context.Context, token *models.AccessTokenRequest) (*models.SessionToken, error) {
+	var currentUser, err = u.postgres.GetActiveUser(ctx, &models.User{XID: token.XID})
 
 	if err != nil {
 		return nil, err
@@ -465,44 +643,161 @@ func (u *user) RefreshToken(ctx context.Context, user *models.User) (*models.Acc
 		return nil, errors.New("user not found")
 	}
 
-	clientID, err := strconv.ParseUint(fmt.Sprintf("%v", ctx.Value(helper.StringToInterface("client-id"))), 0, 64)
+	clientID, ok := helper.ClientID(ctx)
+	if !ok {
+		return nil, errClientIDNotFound
+	}
+
+	currentToken, err := u.postgres.GetToken(ctx, &models.UserToken{Token: token.RefreshToken})
+
 	if err != nil {
 		return nil, err
 	}
 
+	if len(currentToken) < 1 || currentToken[0].UserID != currentUser[0].ID || !currentToken[0].Family.Valid {
+		return nil, errors.New("Invalid auth token")
+	}
+
+	if currentToken[0].Status == "consumed" {
+		if err := u.revokeTokenFamily(ctx, currentToken[0]); err != nil {
+			return nil, err
+		}
+
+		return nil, errTokenReused
+	}
+
+	if currentToken[0].Status != "active" {
+		return nil, errors.New("Invalid auth token")
+	}
+
 	var tokenClaim = &models.TokenClaim{
 		XID:        currentUser[0].XID,
 		Email:      currentUser[0].Email,
-		AccessType: "refreshtoken",
-		ExpiredAt:  time.Hour * 8760,
+		AccessType: "login",
+		ExpiredAt:  u.config.Token.Access,
 		ClientID:   clientID,
 	}
 
-	tokenString := tokenClaim.TokenGenerator()
-
-	err = u.postgres.CreateToken(ctx, &models.UserToken{Token: tokenString, UserID: currentUser[0].ID, TokenType: "Bearer"})
-
+	tokenString, err := tokenClaim.TokenGenerator()
 	if err != nil {
 		return nil, err
 	}
 
-	err = u.postgres.CreateEvent(ctx, "refresh token", currentUser[0].ID)
+	var refreshToken *models.AccessToken
+	var reused bool
+
+	err = u.postgres.WithTx(ctx, func(pg postgres.Postgres) error {
+		tx := u.withPostgres(pg)
+
+		consumed, err := tx.postgres.ConsumeToken(ctx, currentToken[0])
+
+		if err != nil {
+			return err
+		}
+
+		// another request rotated this token between the read and the update,
+		// the revocation has to commit so the error is only returned after it
+		if !consumed {
+			reused = true
+			return tx.revokeTokenFamily(ctx, currentToken[0])
+		}
+
+		err = tx.postgres.DeleteToken(ctx, &models.UserToken{
+			Status:       "nonactive",
+			RefreshToken: helper.NullStringFunc(token.RefreshToken, true),
+		})
+
+		if err != nil {
+			return err
+		}
+
+		refreshToken, err = tx.createRefreshToken(ctx, currentUser[0], clientID, currentToken[0].Family.String)
+
+		if err != nil {
+			return err
+		}
+
+		err = tx.postgres.CreateToken(ctx, &models.UserToken{
+			Token:        tokenString,
+			UserID:       currentUser[0].ID,
+			TokenType:    "Bearer",
+			RefreshToken: helper.NullStringFunc(refreshToken.Value, true),
+			Family:       currentToken[0].Family,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return tx.postgres.CreateEvent(ctx, "new access token", currentUser[0].ID)
+	})
 
 	if err != nil {
 		return nil, err
 	}
 
+	if reused {
+		return nil, errTokenReused
+	}
+
 	accessToken := &models.AccessToken{
 		Value:     tokenString,
 		Type:      "Bearer",
 		ExpiredAt: time.Now().Add(tokenClaim.ExpiredAt).String(),
 	}
 
-	return accessToken, nil
+	return &models.SessionToken{AccessToken: accessToken, RefreshToken: refreshToken}, nil
+}
+
+func (u *user) createRefreshToken(ctx context.Context, user *models.User, clientID uint64, family string) (*models.AccessToken, error) {
+	var tokenClaim = &models.TokenClaim{
+		XID:        user.XID,
+		Email:      user.Email,
+		AccessType: "refreshtoken",
+		ExpiredAt:  u.config.Token.Refresh,
+		ClientID:   clientID,
+	}
+
+	tokenString, err := tokenClaim.TokenGenerator()
+	if err != nil {
+		return nil, err
+	}
+
+	err = u.postgres.CreateToken(ctx, &models.UserToken{
+		Token:     tokenString,
+		UserID:    user.ID,
+		TokenType: "Bearer",
+		Family:    helper.NullStringFunc(family, true),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.AccessToken{
+		Value:     tokenString,
+		Type:      "Bearer",
+		ExpiredAt: time.Now().Add(tokenClaim.ExpiredAt).String(),
+	}, nil
+}
+
+// revokeTokenFamily is called when an already rotated refresh token is presented again.
+// Either the legitimate client or an attacker holds a stolen copy, so every token
+// descended from the same login is revoked.
+func (u *user) revokeTokenFamily(ctx context.Context, token *models.UserToken) error {
+	return u.postgres.WithTx(ctx, func(pg postgres.Postgres) error {
+		err := pg.DeleteToken(ctx, &models.UserToken{Family: token.Family})
+
+		if err != nil {
+			return err
+		}
+
+		return pg.CreateEvent(ctx, "refresh token reuse", token.UserID)
+	})
 }
 
-func (u *user) GetNewAccessToken(ctx context.Context, token *models.AccessTokenRequest) (*models.AccessToken, error) {
-	var currentUser, err = u.postgres.GetActiveUser(&models.User{XID: token.XID})
+func (u *user) ByPassTfa(ctx context.Context, codes *models.OTPRequest) (*models.AccessToken, error) {
+	var currentUser, err = u.postgres.GetActiveUser(ctx, &models.User{XID: codes.XID})
 
 	if err != nil {
 		return nil, err
@@ -512,44 +807,69 @@ func (u *user) GetNewAccessToken(ctx context.Context, token *models.AccessTokenR
 		return nil, errors.New("user not found")
 	}
 
-	clientID, err := strconv.ParseUint(fmt.Sprintf("%v", ctx.Value(helper.StringToInterface("client-id"))), 0, 64)
-	if err != nil {
+	if err := u.attempt.Check(ctx, "tfa", currentUser[0].XID); err != nil {
 		return nil, err
 	}
 
+	clientID, ok := helper.ClientID(ctx)
+	if !ok {
+		return nil, errClientIDNotFound
+	}
+
 	var tokenClaim = &models.TokenClaim{
 		XID:        currentUser[0].XID,
 		Email:      currentUser[0].Email,
 		AccessType: "login",
-		ExpiredAt:  time.Hour * 24,
+		ExpiredAt:  u.config.Token.Access,
 		ClientID:   clientID,
 	}
 
-	tokenString := tokenClaim.TokenGenerator()
-
-	err = u.postgres.DeleteToken(&models.UserToken{
-		Status:       "nonactive",
-		RefreshToken: helper.NullStringFunc(token.RefreshToken, true),
-	})
-
+	tokenString, err := tokenClaim.TokenGenerator()
 	if err != nil {
 		return nil, err
 	}
 
-	err = u.postgres.CreateToken(ctx, &models.UserToken{
-		Token:        tokenString,
-		UserID:       currentUser[0].ID,
-		TokenType:    "Bearer",
-		RefreshToken: helper.NullStringFunc(token.RefreshToken, true),
+	// the code is only spent if the session it was used for is created
+	err = u.postgres.WithTx(ctx, func(pg postgres.Postgres) error {
+		used, err := pg.UseBackUpCode(ctx, &models.BackupCodes{
+			UserID: currentUser[0].ID,
+			Codes:  helper.HashBackupCode(codes.Code),
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if !used {
+			return errCodeNotValid
+		}
+
+		err = pg.CreateToken(ctx, &models.UserToken{
+			Token:     tokenString,
+			UserID:    currentUser[0].ID,
+			TokenType: "Bearer",
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return pg.CreateEvent(ctx, "bypass tfa", currentUser[0].ID)
 	})
 
+	if err == errCodeNotValid {
+		if err := u.attempt.Fail(ctx, "tfa", currentUser[0].XID, currentUser[0].ID); err != nil {
+			return nil, err
+		}
+
+		return nil, errCodeNotValid
+	}
+
 	if err != nil {
 		return nil, err
 	}
 
-	err = u.postgres.CreateEvent(ctx, "new access token", currentUser[0].ID)
-
-	if err != nil {
+	if err := u.attempt.Succeed(ctx, "tfa", currentUser[0].XID, currentUser[0].ID); err != nil {
 		return nil, err
 	}
 
@@ -562,8 +882,8 @@ func (u *user) GetNewAccessToken(ctx context.Context, token *models.AccessTokenR
 	return accessToken, nil
 }
 
-func (u *user) ByPassTfa(ctx context.Context, codes *models.OTPRequest) (*models.AccessToken, error) {
-	var currentUser, err = u.postgres.GetActiveUser(&models.User{XID: codes.XID})
+func (u *user) EnrollTfa(ctx context.Context, user *models.User) (*models.EnrollTfa, error) {
+	var currentUser, err = u.postgres.GetActiveUser(ctx, &models.User{XID: user.XID})
 
 	if err != nil {
 		return nil, err
@@ -573,100 +893,113 @@ func (u *user) ByPassTfa(ctx context.Context, codes *models.OTPRequest) (*models
 		return nil, errors.New("user not found")
 	}
 
-	resultCode, err := u.postgres.GetBackUpCode(&models.BackupCodes{
-		UserID: currentUser[0].ID,
-		Codes:  codes.Code,
-	})
+	if currentUser[0].TFA {
+		return nil, errors.New("TFA have already enabled")
+	}
 
+	secret, err := helper.GenerateTOTPSecret()
 	if err != nil {
 		return nil, err
 	}
 
-	if len(resultCode) < 1 {
-		return nil, errors.New("code not valid")
-	}
+	uri := helper.TOTPProvisioningURI(tfaIssuer, currentUser[0].Email, secret)
 
-	clientID, err := strconv.ParseUint(fmt.Sprintf("%v", ctx.Value(helper.StringToInterface("client-id"))), 0, 64)
+	var png []byte
+	png, err = qrcode.Encode(uri, qrcode.Medium, 256)
 	if err != nil {
 		return nil, err
 	}
 
-	var tokenClaim = &models.TokenClaim{
-		XID:        currentUser[0].XID,
-		Email:      currentUser[0].Email,
-		AccessType: "login",
-		ExpiredAt:  time.Hour * 24,
-		ClientID:   clientID,
-	}
-
-	tokenString := tokenClaim.TokenGenerator()
-
-	err = u.postgres.CreateToken(ctx, &models.UserToken{
-		Token:     tokenString,
-		UserID:    currentUser[0].ID,
-		TokenType: "Bearer",
-	})
+	qrString := "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
 
+	err = u.redis.Create(ctx, &models.OTP{Key: user.XID + "-secret", Value: secret, Expire: time.Now().Add(u.config.Token.TFAEnroll)})
 	if err != nil {
 		return nil, err
 	}
 
-	err = u.postgres.CreateEvent(ctx, "bypass tfa", currentUser[0].ID)
+	return &models.EnrollTfa{Secret: secret, Qr: qrString}, nil
+}
+
+func (u *user) ActivateTfa(ctx context.Context, secret *models.ActivateTfaRequest) (*models.BackupCodesResponse, error) {
+	var currentUser, err = u.postgres.GetActiveUser(ctx, &models.User{XID: secret.XID})
 
 	if err != nil {
 		return nil, err
 	}
 
-	accessToken := &models.AccessToken{
-		Value:     tokenString,
-		Type:      "Bearer",
-		ExpiredAt: time.Now().Add(tokenClaim.ExpiredAt).String(),
+	if len(currentUser) < 1 {
+		return nil, errors.New("user not found")
 	}
 
-	return accessToken, nil
-}
-
-func (u *user) EnrollTfa(user *models.User) (*models.EnrollTfa, error) {
-	var currentUser, err = u.postgres.GetActiveUser(&models.User{XID: user.XID})
+	secretID, err := u.redis.Get(ctx, &models.OTP{Key: secret.XID + "-secret"})
 
 	if err != nil {
 		return nil, err
 	}
 
-	if len(currentUser) < 1 {
-		return nil, errors.New("user not found")
+	if secretID != secret.Secret {
+		return nil, errors.New("secret or code not valid")
 	}
 
-	if currentUser[0].TFA {
-		return nil, errors.New("TFA have already enabled")
+	step, valid := helper.MatchTOTPCode(secretID, secret.Code, time.Now(), u.config.TFA.TOTPSkew)
+	if !valid {
+		return nil, errors.New("secret or code not valid")
 	}
 
-	secretCode := helper.GenerateNumericCode(100000, 999999)
-
-	var png []byte
-	png, err = qrcode.Encode(secretCode, qrcode.Medium, 256)
+	encryptedSecret, err := helper.EncryptString(u.config.TFA.SecretKey, secretID)
 	if err != nil {
 		return nil, err
 	}
 
-	qrString := "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
-	secret := helper.GenerateRandString(20)
+	currentUser[0].TFA = true
+	currentUser[0].TFASecret = helper.NullStringFunc(encryptedSecret, true)
+	currentUser[0].EnabledTfaAt = helper.NullTime{NullTime: sql.NullTime{Time: time.Now(), Valid: true}}
+
+	var backupcodes *models.BackupCodesResponse
+
+	err = u.postgres.WithTx(ctx, func(pg postgres.Postgres) error {
+		tx := u.withPostgres(pg)
+
+		backupcodes, err = tx.generateBackupCodes(ctx, currentUser[0].ID)
+		if err != nil {
+			return err
+		}
+
+		// the activation code can't be replayed to verify a login
+		if _, err := tx.postgres.UseTOTPStep(ctx, currentUser[0].ID, step); err != nil {
+			return err
+		}
+
+		return tx.postgres.UpdateUser(ctx, currentUser[0])
+	})
 
-	err = u.redis.Create(&models.OTP{Key: user.XID + "-secret", Value: secret, Expire: time.Now().Add(time.Minute * 60)})
 	if err != nil {
 		return nil, err
 	}
 
-	err = u.redis.Create(&models.OTP{Key: user.XID + "-code", Value: secretCode, Expire: time.Now().Add(time.Minute * 60)})
+	return backupcodes, nil
+}
+
+func (u *user) GetBackupCodesStatus(ctx context.Context, user *models.User) (*models.BackupCodesStatus, error) {
+	var currentUser, err = u.postgres.GetActiveUser(ctx, user)
+
 	if err != nil {
 		return nil, err
 	}
 
-	return &models.EnrollTfa{Secret: secret, Qr: qrString}, nil
+	if len(currentUser) < 1 {
+		return nil, errors.New("user not found")
+	}
+
+	if !currentUser[0].TFA {
+		return nil, errors.New("tfa is not enabled")
+	}
+
+	return u.postgres.CountBackUpCode(ctx, currentUser[0].ID)
 }
 
-func (u *user) ActivateTfa(secret *models.ActivateTfaRequest) (*models.BackupCodesResponse, error) {
-	var currentUser, err = u.postgres.GetActiveUser(&models.User{XID: secret.XID})
+func (u *user) RegenerateBackupCodes(ctx context.Context, user *models.User) (*models.BackupCodesResponse, error) {
+	var currentUser, err = u.postgres.GetActiveUser(ctx, &models.User{XID: user.XID})
 
 	if err != nil {
 		return nil, err
@@ -676,54 +1009,69 @@ func (u *user) ActivateTfa(secret *models.ActivateTfaRequest) (*models.BackupCod
 		return nil, errors.New("user not found")
 	}
 
-	secretID, err := u.redis.Get(&models.OTP{Key: secret.XID + "-secret"})
-
-	if err != nil {
+	if valid, err := u.hasher.Verify(user.Password, currentUser[0].Password); err != nil {
 		return nil, err
+	} else if !valid {
+		return nil, errors.New("current password not valid")
 	}
 
-	if secretID != secret.Secret {
-		return nil, errors.New("secret or code not valid")
+	if !currentUser[0].TFA {
+		return nil, errors.New("tfa is not enabled")
 	}
 
-	code, err := u.redis.Get(&models.OTP{Key: secret.XID + "-code"})
+	var backupcodes *models.BackupCodesResponse
+
+	err = u.postgres.WithTx(ctx, func(pg postgres.Postgres) error {
+		tx := u.withPostgres(pg)
+
+		backupcodes, err = tx.generateBackupCodes(ctx, currentUser[0].ID)
+		if err != nil {
+			return err
+		}
+
+		return tx.postgres.CreateEvent(ctx, "backup codes regenerated", currentUser[0].ID)
+	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	if code != secret.Code {
-		return nil, errors.New("secret or code not valid")
+	return backupcodes, nil
+}
+
+// generateBackupCodes replaces the user's backup codes with a new set, only
+// hashes are stored so the plaintext codes are returned this one time. Call it
+// inside WithTx so the old set is kept if the new one can't be stored.
+func (u *user) generateBackupCodes(ctx context.Context, userID uint64) (*models.BackupCodesResponse, error) {
+	if err := u.postgres.DeleteBackUpCode(ctx, userID); err != nil {
+		return nil, err
 	}
 
 	var backupcodes models.BackupCodesResponse
 
-	for i := 0; i < 2; i++ {
-		BUCodes := helper.GenerateRandChar(12)
-		err = u.postgres.CreateBackUpCode(&models.BackupCodes{
-			UserID: currentUser[0].ID,
-			Codes:  BUCodes,
-		})
-
+	for i := 0; i < u.config.TFA.BackupCodeCount; i++ {
+		code, err := helper.GenerateBackupCode()
 		if err != nil {
 			return nil, err
 		}
 
-		backupcodes.BackupCodes = append(backupcodes.BackupCodes, BUCodes)
-	}
+		err = u.postgres.CreateBackUpCode(ctx, &models.BackupCodes{
+			UserID: userID,
+			Codes:  helper.HashBackupCode(code),
+		})
 
-	currentUser[0].TFA = true
+		if err != nil {
+			return nil, err
+		}
 
-	err = u.postgres.UpdateUser(currentUser[0])
-	if err != nil {
-		return nil, err
+		backupcodes.BackupCodes = append(backupcodes.BackupCodes, code)
 	}
 
 	return &backupcodes, nil
 }
 
-func (u *user) DeleteOtherSession(token *models.AccessTokenRequest) error {
-	var currentUser, err = u.postgres.GetActiveUser(&models.User{XID: token.XID})
+func (u *user) DeleteOtherSession(ctx context.Context, token *models.AccessTokenRequest) error {
+	var currentUser, err = u.postgres.GetActiveUser(ctx, &models.User{XID: token.XID})
 
 	if err != nil {
 		return err
@@ -733,7 +1081,7 @@ func (u *user) DeleteOtherSession(token *models.AccessTokenRequest) error {
 		return errors.New("user not found")
 	}
 
-	err = u.postgres.DeleteToken(&models.UserToken{
+	err = u.postgres.DeleteToken(ctx, &models.UserToken{
 		UserID: currentUser[0].ID,
 		Status: "nonactive",
 		Token:  token.RefreshToken,
@@ -746,8 +1094,8 @@ func (u *user) DeleteOtherSession(token *models.AccessTokenRequest) error {
 	return nil
 }
 
-func (u *user) DeleteCurrentSession(token *models.UserToken) error {
-	err := u.postgres.DeleteToken(&models.UserToken{
+func (u *user) DeleteCurrentSession(ctx context.Context, token *models.UserToken) error {
+	err := u.postgres.DeleteToken(ctx, &models.UserToken{
 		Status: "nonactive",
 		Token:  token.Token,
 	})
@@ -759,8 +1107,8 @@ func (u *user) DeleteCurrentSession(token *models.UserToken) error {
 	return nil
 }
 
-func (u *user) RequestChangePassword(user *models.User) error {
-	var getUser, err = u.postgres.GetActiveUser(&models.User{XID: user.XID})
+func (u *user) RequestChangeEmail(ctx context.Context, user *models.User) error {
+	var getUser, err = u.postgres.GetActiveUser(ctx, &models.User{XID: user.XID})
 
 	if err != nil {
 		return err
@@ -770,52 +1118,152 @@ func (u *user) RequestChangePassword(user *models.User) error {
 		return errors.New("user not found")
 	}
 
-	var tokenClaim = &models.TokenClaim{
-		XID:        getUser[0].XID,
-		Email:      user.Email,
-		AccessType: "refreshtoken",
-		ExpiredAt:  time.Minute * 10,
+	newEmail := strings.ToLower(strings.TrimSpace(user.Email))
+
+	validate := validator.New()
+	if err := validate.Var(newEmail, "required,email,min=5,max=50"); err != nil {
+		return errors.New("email not valid")
 	}
 
-	token := tokenClaim.TokenGenerator()
+	if newEmail == getUser[0].Email {
+		return errors.New("new email is the same as the current one")
+	}
 
-	var email models.Email
-	email.Subject = "Change Email"
-	email.RecipientName = getUser[0].Fullname
-	email.RecipientEmail = user.Email
-	email.PlainContent = "Hi " + getUser[0].Fullname + ", Please click link below to verify your email address so we know that it's really you!"
-	email.HTMLContent = `<p>Hi ` + user.Fullname + `,</p>
-		<p>Please click link below to verify your email address so we know that it's really you!</p>
-		<p><a href="http://0.0.0.0:8080/me/change-email/` + token + `" style="box-sizing: border-box;
-		border-color: #ED3237;font-weight: 400;text-decoration: none;display: inline-block;margin: 0;color: #ffffff;background-color: #ED3237;
-		border: solid 1px #ED3237;border-radius: 2px;font-size: 14px;padding: 12px 45px;">Confirm Email Address<a></p>`
+	if err := u.checkEmailAvailable(ctx, newEmail, getUser[0].XID); err != nil {
+		return err
+	}
 
-	err = sdg.SendEmail(&email)
-	if err != nil {
+	if err := u.throttleEmail(ctx, models.PurposeChangeEmail, getUser[0].ID); err != nil {
 		return err
 	}
 
-	return nil
+	return u.postgres.WithTx(ctx, func(pg postgres.Postgres) error {
+		tx := u.withPostgres(pg)
+
+		token, err := tx.issueVerificationToken(ctx, getUser[0].ID, models.PurposeChangeEmail, newEmail, u.config.Token.ChangeEmail)
+		if err != nil {
+			return err
+		}
+
+		return tx.sendEmail(ctx, getUser[0], newEmail, emails.ChangeEmail, &emails.Data{
+			URL:      u.config.Server.PublicBaseURL + "/me/change-email/" + token,
+			NewEmail: newEmail,
+		})
+	})
+}
+
+func (u *user) ConfirmChangeEmail(ctx context.Context, token string) error {
+	return u.postgres.WithTx(ctx, func(pg postgres.Postgres) error {
+		tx := u.withPostgres(pg)
+
+		verification, err := tx.consumeVerificationToken(ctx, token, models.PurposeChangeEmail)
+		if err != nil {
+			return err
+		}
+
+		changeUser, err := tx.postgres.GetActiveUser(ctx, &models.User{ID: verification.UserID})
+		if err != nil {
+			return err
+		}
+
+		if len(changeUser) < 1 {
+			return errors.New("user not found")
+		}
+
+		oldEmail := changeUser[0].Email
+		newEmail := verification.Data.String
+
+		if err := tx.swapEmail(ctx, changeUser[0], newEmail, "email changed"); err != nil {
+			return err
+		}
+
+		revertToken, err := tx.issueVerificationToken(ctx, changeUser[0].ID, models.PurposeRevertEmail, oldEmail, u.config.Token.RevertEmail)
+		if err != nil {
+			return err
+		}
+
+		return tx.sendEmail(ctx, changeUser[0], oldEmail, emails.EmailChanged, &emails.Data{
+			URL:      u.config.Server.PublicBaseURL + "/me/revert-email/" + revertToken,
+			NewEmail: newEmail,
+		})
+	})
+}
+
+// RevertEmail restores the address that was replaced by the last email change,
+// from the link sent to that old address
+func (u *user) RevertEmail(ctx context.Context, token string) error {
+	return u.postgres.WithTx(ctx, func(pg postgres.Postgres) error {
+		tx := u.withPostgres(pg)
+
+		verification, err := tx.consumeVerificationToken(ctx, token, models.PurposeRevertEmail)
+		if err != nil {
+			return err
+		}
+
+		revertUser, err := tx.postgres.GetActiveUser(ctx, &models.User{ID: verification.UserID})
+		if err != nil {
+			return err
+		}
+
+		if len(revertUser) < 1 {
+			return errors.New("user not found")
+		}
+
+		// a pending change requested with the compromised address must not go through
+		if err := tx.postgres.RevokeVerificationToken(ctx, revertUser[0].ID, models.PurposeChangeEmail); err != nil {
+			return err
+		}
+
+		return tx.swapEmail(ctx, revertUser[0], verification.Data.String, "email change reverted")
+	})
 }
 
-func (u *user) ResetPassword(resetPass *models.ResetPass) error {
-	token, err := models.VerifyToken(resetPass.Token)
+// swapEmail sets the user's email and signs every session out, call it inside
+// WithTx
+func (u *user) swapEmail(ctx context.Context, user *models.User, email string, event string) error {
+	if err := u.checkEmailAvailable(ctx, email, user.XID); err != nil {
+		return err
+	}
+
+	user.Email = email
+
+	if err := u.postgres.UpdateUser(ctx, user); err != nil {
+		return err
+	}
+
+	if err := u.postgres.DeleteToken(ctx, &models.UserToken{UserID: user.ID}); err != nil {
+		return err
+	}
+
+	return u.postgres.CreateEvent(ctx, event, user.ID)
+}
 
+func (u *user) checkEmailAvailable(ctx context.Context, email string, xid string) error {
+	others, err := u.postgres.Primary().GetUser(ctx, &models.User{Email: email, XID: xid})
 	if err != nil {
 		return err
 	}
 
+	if len(others) > 0 {
+		return errors.New("Email Already Exists")
+	}
+
+	return nil
+}
+
+func (u *user) ResetPassword(ctx context.Context, resetPass *models.ResetPass) error {
 	validate := validator.New()
 
 	if err := validate.VarWithValue(resetPass.Password, resetPass.PasswordConfirm, "eqfield"); err != nil {
 		return errors.New("Password and password confirm must same")
 	}
 
-	if token.AccessType != "resetpassword" {
-		return errors.New("token tidak valid")
+	token, err := u.lookupVerificationToken(ctx, resetPass.Token, models.PurposeResetPassword)
+	if err != nil {
+		return err
 	}
 
-	resetUser, err := u.postgres.GetActiveUser(&models.User{Email: token.Email})
+	resetUser, err := u.postgres.GetActiveUser(ctx, &models.User{ID: token.UserID})
 
 	if err != nil {
 		return err
@@ -825,20 +1273,47 @@ func (u *user) ResetPassword(resetPass *models.ResetPass) error {
 		return errors.New("user not found")
 	}
 
-	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(resetPass.Password), bcrypt.DefaultCost)
+	if token.Data.String != helper.HashToken(resetUser[0].Password) {
+		return models.ErrTokenInvalid
+	}
 
-	resetUser[0].Password = string(hashedPassword)
+	if err := u.checkPassword(ctx, resetPass.Password, resetUser[0]); err != nil {
+		return err
+	}
 
-	err = u.postgres.UpdateUser(resetUser[0])
+	hashedPassword, err := u.hasher.Hash(resetPass.Password)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	resetUser[0].Password = hashedPassword
+
+	return u.postgres.WithTx(ctx, func(pg postgres.Postgres) error {
+		tx := u.withPostgres(pg)
+
+		if err := tx.useVerificationToken(ctx, token); err != nil {
+			return err
+		}
+
+		if err := tx.postgres.UpdateUser(ctx, resetUser[0]); err != nil {
+			return err
+		}
+
+		if err := tx.recordPassword(ctx, resetUser[0]); err != nil {
+			return err
+		}
+
+		// whoever needed the reset may not be the only one holding a session
+		if err := tx.postgres.DeleteToken(ctx, &models.UserToken{UserID: resetUser[0].ID}); err != nil {
+			return err
+		}
+
+		return tx.postgres.CreateEvent(ctx, "password reset", resetUser[0].ID)
+	})
 }
 
-func (u *user) GetUserProfile(user *models.User) (*models.ProfileResponse, error) {
-	var foundUser, err = u.postgres.GetUser(user)
+func (u *user) GetUserProfile(ctx context.Context, user *models.User) (*models.ProfileResponse, error) {
+	var foundUser, err = u.postgres.GetUser(ctx, user)
 
 	if err != nil {
 		return nil, err
@@ -855,14 +1330,23 @@ func (u *user) GetUserProfile(user *models.User) (*models.ProfileResponse, error
 	result.Location = foundUser[0].Location.String
 	result.Bio = foundUser[0].Bio.String
 	result.Web = foundUser[0].Web.String
-	result.Picture = foundUser[0].Picture.String
+	if foundUser[0].Picture.Valid {
+		result.Picture = u.storage.URL(avatar.Key(foundUser[0].Picture.String, avatar.Large))
+		result.Pictures = map[string]string{}
+
+		for _, size := range avatar.Sizes {
+			result.Pictures[strconv.Itoa(size)] = u.storage.URL(avatar.Key(foundUser[0].Picture.String, size))
+		}
+	}
+
+	result.Locale = foundUser[0].Locale
 	result.CreatedAt = foundUser[0].CreatedAt
 
 	return &result, nil
 }
 
-func (u *user) GetUserTfaStatus(user *models.User) (*models.TFAStatus, error) {
-	var foundUser, err = u.postgres.GetUser(user)
+func (u *user) GetUserTfaStatus(ctx context.Context, user *models.User) (*models.TFAStatus, error) {
+	var foundUser, err = u.postgres.GetUser(ctx, user)
 
 	if err != nil {
 		return nil, err
@@ -878,8 +1362,8 @@ func (u *user) GetUserTfaStatus(user *models.User) (*models.TFAStatus, error) {
 	}, nil
 }
 
-func (u *user) GetUserEmail(user *models.User) (*models.GetEmailResponse, error) {
-	var foundUser, err = u.postgres.GetUser(user)
+func (u *user) GetUserEmail(ctx context.Context, user *models.User) (*models.GetEmailResponse, error) {
+	var foundUser, err = u.postgres.GetUser(ctx, user)
 
 	if err != nil {
 		return nil, err
@@ -891,12 +1375,13 @@ func (u *user) GetUserEmail(user *models.User) (*models.GetEmailResponse, error)
 
 	var result models.GetEmailResponse
 	result.Email = foundUser[0].Email
+	result.Verified = foundUser[0].Status == "active"
 
 	return &result, nil
 }
 
-func (u *user) UpdateUserPicture(picture *models.UploadProfile) error {
-	var foundUser, err = u.postgres.GetUser(&models.User{XID: picture.UserXID})
+func (u *user) UpdateUserPicture(ctx context.Context, picture *models.UploadProfile) error {
+	var foundUser, err = u.postgres.Primary().GetUser(ctx, &models.User{XID: picture.UserXID})
 
 	if err != nil {
 		return err
@@ -906,44 +1391,56 @@ func (u *user) UpdateUserPicture(picture *models.UploadProfile) error {
 		return errors.New("user not found")
 	}
 
-	var buf = new(bytes.Buffer)
-	writer := multipart.NewWriter(buf)
-
-	part, _ := writer.CreateFormFile("image", "test")
-	io.Copy(part, picture.File)
-
-	writer.Close()
-	req, _ := http.NewRequest("POST", "https://api.imgur.com/3/upload", buf)
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	req.Header.Set("Authorization", "Client-ID ff15fec03c2be0e")
-
-	client := &http.Client{}
-	res, err := client.Do(req)
+	content, err := ioutil.ReadAll(picture.File)
 	if err != nil {
 		return err
 	}
-	defer res.Body.Close()
-	b, _ := ioutil.ReadAll(res.Body)
 
-	var response models.ImgurUploadResponse
-
-	err = json.Unmarshal(b, &response)
+	thumbnails, err := avatar.Process(picture.ContentType, content)
 	if err != nil {
 		return err
 	}
 
-	foundUser[0].Picture = helper.NullStringFunc(response.Data.Link, true)
+	// named after the upload, the thumbnails are stored under it by size
+	prefix := storage.ContentKey("avatars/"+foundUser[0].XID, content, "")
+
+	for _, thumbnail := range thumbnails {
+		if err := u.storage.Put(avatar.Key(prefix, thumbnail.Size), avatar.ContentType, thumbnail.Content); err != nil {
+			return err
+		}
+	}
+
+	oldPrefix := foundUser[0].Picture.String
+	foundUser[0].Picture = helper.NullStringFunc(prefix, true)
 
-	err = u.postgres.UpdateUser(foundUser[0])
+	err = u.postgres.UpdateUser(ctx, foundUser[0])
 	if err != nil {
 		return err
 	}
 
+	if oldPrefix != prefix {
+		u.deletePicture(oldPrefix)
+	}
+
 	return nil
 }
 
-func (u *user) UpdateUserProfile(user *models.User) error {
-	var foundUser, err = u.postgres.GetUser(user)
+// deletePicture removes a replaced picture from storage. The user no longer
+// points at it, so a failure only leaves an orphan behind and is just logged.
+func (u *user) deletePicture(prefix string) {
+	if prefix == "" || storage.External(prefix) {
+		return
+	}
+
+	for _, key := range avatar.Keys(prefix) {
+		if err := u.storage.Delete(key); err != nil {
+			log.Printf("delete picture %q: %v", key, err)
+		}
+	}
+}
+
+func (u *user) UpdateUserProfile(ctx context.Context, user *models.User) error {
+	var foundUser, err = u.postgres.Primary().GetUser(ctx, user)
 
 	if err != nil {
 		return err
@@ -958,7 +1455,15 @@ func (u *user) UpdateUserProfile(user *models.User) error {
 	foundUser[0].Bio = user.Bio
 	foundUser[0].Web = user.Web
 
-	err = u.postgres.UpdateUser(foundUser[0])
+	if user.Locale != "" {
+		if !emails.SupportedLocale(user.Locale) {
+			return errors.New("locale not supported")
+		}
+
+		foundUser[0].Locale = user.Locale
+	}
+
+	err = u.postgres.UpdateUser(ctx, foundUser[0])
 	if err != nil {
 		return err
 	}
@@ -966,8 +1471,8 @@ func (u *user) UpdateUserProfile(user *models.User) error {
 	return nil
 }
 
-func (u *user) DeleteProfilePicture(user *models.User) error {
-	var foundUser, err = u.postgres.GetUser(user)
+func (u *user) DeleteProfilePicture(ctx context.Context, user *models.User) error {
+	var foundUser, err = u.postgres.Primary().GetUser(ctx, user)
 
 	if err != nil {
 		return err
@@ -977,18 +1482,21 @@ func (u *user) DeleteProfilePicture(user *models.User) error {
 		return errors.New("user not found")
 	}
 
+	oldPrefix := foundUser[0].Picture.String
 	foundUser[0].Picture = helper.NullStringFunc("", false)
 
-	err = u.postgres.UpdateUser(foundUser[0])
+	err = u.postgres.UpdateUser(ctx, foundUser[0])
 	if err != nil {
 		return err
 	}
 
+	u.deletePicture(oldPrefix)
+
 	return nil
 }
 
-func (u *user) DeleteUser(user *models.User) error {
-	var foundUser, err = u.postgres.GetUser(user)
+func (u *user) DeleteUser(ctx context.Context, user *models.User) error {
+	var foundUser, err = u.postgres.Primary().GetUser(ctx, user)
 
 	if err != nil {
 		return err
@@ -998,13 +1506,15 @@ func (u *user) DeleteUser(user *models.User) error {
 		return errors.New("user not found")
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(foundUser[0].Password), []byte(user.Password)); err != nil && err == bcrypt.ErrMismatchedHashAndPassword {
+	if valid, err := u.hasher.Verify(user.Password, foundUser[0].Password); err != nil {
+		return err
+	} else if !valid {
 		return errors.New("password not valid")
 	}
 
 	foundUser[0].Status = "deleted"
 
-	err = u.postgres.UpdateUser(foundUser[0])
+	err = u.postgres.UpdateUser(ctx, foundUser[0])
 	if err != nil {
 		return err
 	}
@@ -1012,8 +1522,8 @@ func (u *user) DeleteUser(user *models.User) error {
 	return nil
 }
 
-func (u *user) UpdateUserPassword(user *models.ChangePassword) error {
-	var foundUser, err = u.postgres.GetUser(&models.User{XID: user.XID})
+func (u *user) UpdateUserPassword(ctx context.Context, user *models.ChangePassword) error {
+	var foundUser, err = u.postgres.Primary().GetUser(ctx, &models.User{XID: user.XID})
 
 	if err != nil {
 		return err
@@ -1023,7 +1533,9 @@ func (u *user) UpdateUserPassword(user *models.ChangePassword) error {
 		return errors.New("user not found")
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(foundUser[0].Password), []byte(user.PasswordCurrent)); err != nil && err == bcrypt.ErrMismatchedHashAndPassword {
+	if valid, err := u.hasher.Verify(user.PasswordCurrent, foundUser[0].Password); err != nil {
+		return err
+	} else if !valid {
 		return errors.New("current password not valid")
 	}
 
@@ -1032,20 +1544,30 @@ func (u *user) UpdateUserPassword(user *models.ChangePassword) error {
 		return errors.New("Password and password confirm must same")
 	}
 
-	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
-
-	foundUser[0].Password = string(hashedPassword)
+	if err := u.checkPassword(ctx, user.Password, foundUser[0]); err != nil {
+		return err
+	}
 
-	err = u.postgres.UpdateUser(foundUser[0])
+	hashedPassword, err := u.hasher.Hash(user.Password)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	foundUser[0].Password = hashedPassword
+
+	return u.postgres.WithTx(ctx, func(pg postgres.Postgres) error {
+		tx := u.withPostgres(pg)
+
+		if err := tx.postgres.UpdateUser(ctx, foundUser[0]); err != nil {
+			return err
+		}
+
+		return tx.recordPassword(ctx, foundUser[0])
+	})
 }
 
-func (u *user) RemoveTfa(user *models.User) error {
-	var foundUser, err = u.postgres.GetUser(user)
+func (u *user) RemoveTfa(ctx context.Context, user *models.User) error {
+	var foundUser, err = u.postgres.Primary().GetUser(ctx, user)
 
 	if err != nil {
 		return err
@@ -1055,16 +1577,83 @@ func (u *user) RemoveTfa(user *models.User) error {
 		return errors.New("user not found")
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(foundUser[0].Password), []byte(user.Password)); err != nil && err == bcrypt.ErrMismatchedHashAndPassword {
+	if valid, err := u.hasher.Verify(user.Password, foundUser[0].Password); err != nil {
+		return err
+	} else if !valid {
 		return errors.New("current password not valid")
 	}
 
 	foundUser[0].TFA = false
+	foundUser[0].TFASecret = helper.NullStringFunc("", false)
+	foundUser[0].EnabledTfaAt = helper.NullTime{}
 
-	err = u.postgres.UpdateUser(foundUser[0])
-	if err != nil {
+	return u.postgres.WithTx(ctx, func(pg postgres.Postgres) error {
+		if err := pg.UpdateUser(ctx, foundUser[0]); err != nil {
+			return err
+		}
+
+		return pg.DeleteBackUpCode(ctx, foundUser[0].ID)
+	})
+}
+
+// checkPassword applies the password policy to a new password of an existing user
+func (u *user) checkPassword(ctx context.Context, newPassword string, user *models.User) error {
+	history := []string{user.Password}
+
+	if size := u.policy.HistorySize(); size > 0 {
+		previous, err := u.postgres.GetPasswordHistory(ctx, user.ID, size)
+		if err != nil {
+			return err
+		}
+
+		for _, each := range previous {
+			history = append(history, each.Password)
+		}
+	}
+
+	return u.policy.Check(newPassword, []string{user.Email, user.Fullname}, history)
+}
+
+// recordPassword keeps the user's current password hash for the reuse check
+func (u *user) recordPassword(ctx context.Context, user *models.User) error {
+	if u.policy.HistorySize() == 0 {
+		return nil
+	}
+
+	return u.postgres.CreatePasswordHistory(ctx, &models.PasswordHistory{
+		UserID:   user.ID,
+		Password: user.Password,
+	})
+}
+
+// sendEmail renders a template in the user's locale and queues it for
+// recipient, which is not always the user's current address. Call it inside
+// WithTx so the email is only sent if the change behind it commits.
+func (u *user) sendEmail(ctx context.Context, user *models.User, recipient string, template string, data *emails.Data) error {
+	email := models.Email{
+		RecipientName:  user.Fullname,
+		RecipientEmail: recipient,
+	}
+
+	data.Name = user.Fullname
+
+	if err := u.emails.Render(&email, template, user.Locale, data); err != nil {
 		return err
 	}
 
-	return nil
+	return u.postgres.CreateOutboxEmail(ctx, &models.OutboxEmail{
+		RecipientName:  email.RecipientName,
+		RecipientEmail: email.RecipientEmail,
+		Subject:        email.Subject,
+		HTMLContent:    email.HTMLContent,
+		PlainContent:   email.PlainContent,
+	})
+}
+
+// withPostgres copies u onto pg, typically the transaction given by WithTx
+func (u *user) withPostgres(pg postgres.Postgres) *user {
+	tx := *u
+	tx.postgres = pg
+
+	return &tx
 }
@@ -0,0 +1,129 @@
+package user
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/g-graziano/user-auth-golang/helper"
+	"github.com/g-graziano/user-auth-golang/models"
+)
+
+// issueVerificationToken creates a random single-use token for purpose and
+// revokes the ones issued before it, so only the latest emailed link works
+func (u *user) issueVerificationToken(ctx context.Context, userID uint64, purpose string, data string, ttl time.Duration) (string, error) {
+	if err := u.postgres.RevokeVerificationToken(ctx, userID, purpose); err != nil {
+		return "", err
+	}
+
+	token, err := helper.GenerateURLToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = u.postgres.CreateVerificationToken(ctx, &models.VerificationToken{
+		TokenHash: helper.HashToken(token),
+		UserID:    userID,
+		Purpose:   purpose,
+		Data:      helper.NullStringFunc(data, data != ""),
+		ExpiresAt: time.Now().Add(ttl),
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// consumeVerificationToken validates token for purpose and marks it used
+func (u *user) consumeVerificationToken(ctx context.Context, token string, purpose string) (*models.VerificationToken, error) {
+	found, err := u.lookupVerificationToken(ctx, token, purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.useVerificationToken(ctx, found); err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+// CheckVerificationToken reports whether an emailed token for purpose can
+// still be used, without using it
+func (u *user) CheckVerificationToken(ctx context.Context, token string, purpose string) error {
+	_, err := u.lookupVerificationToken(ctx, token, purpose)
+	return err
+}
+
+// lookupVerificationToken validates token for purpose without using it, so a
+// request that fails for another reason doesn't burn the link
+func (u *user) lookupVerificationToken(ctx context.Context, token string, purpose string) (*models.VerificationToken, error) {
+	found, err := u.postgres.GetVerificationToken(ctx, helper.HashToken(token))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(found) < 1 || found[0].Purpose != purpose {
+		return nil, models.ErrTokenInvalid
+	}
+
+	if found[0].UsedAt.Valid {
+		return nil, models.ErrTokenUsed
+	}
+
+	if time.Now().After(found[0].ExpiresAt) {
+		return nil, models.ErrTokenExpired
+	}
+
+	return found[0], nil
+}
+
+func (u *user) useVerificationToken(ctx context.Context, token *models.VerificationToken) error {
+	used, err := u.postgres.UseVerificationToken(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	if !used {
+		return models.ErrTokenUsed
+	}
+
+	return nil
+}
+
+// throttleEmail limits how often a kind of email is sent to a user, it returns
+// a TooManyAttemptsError when the user has to wait
+func (u *user) throttleEmail(ctx context.Context, kind string, userID uint64) error {
+	key := kind + "-" + strconv.FormatUint(userID, 10)
+
+	wait, err := u.redis.TTL(ctx, &models.OTP{Key: "mail-interval-" + key})
+	if err != nil {
+		return err
+	}
+
+	if wait > 0 {
+		return &models.TooManyAttemptsError{RetryAfter: wait}
+	}
+
+	count, err := u.redis.Increment(ctx, &models.OTP{Key: "mail-count-" + key, Expire: time.Now().Add(u.config.Mail.ResendWindow)})
+	if err != nil {
+		return err
+	}
+
+	if count > int64(u.config.Mail.ResendLimit) {
+		wait, err := u.redis.TTL(ctx, &models.OTP{Key: "mail-count-" + key})
+		if err != nil {
+			return err
+		}
+
+		return &models.TooManyAttemptsError{RetryAfter: wait}
+	}
+
+	if u.config.Mail.ResendInterval > 0 {
+		return u.redis.Create(ctx, &models.OTP{Key: "mail-interval-" + key, Value: "1", Expire: time.Now().Add(u.config.Mail.ResendInterval)})
+	}
+
+	return nil
+}